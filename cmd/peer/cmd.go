@@ -6,13 +6,19 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/get"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/history"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/outbox"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/search"
 	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/send"
 	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/start"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/transfers"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/verify"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
 )
 
 var logger *logrus.Logger
 
-func NewCommand(exitCmd *cobra.Command) *cobra.Command {
+func NewCommand(n *node.Node, exitCmd *cobra.Command) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "peer <command> [options]",
 		Short: "Command line p2p messenger",
@@ -20,14 +26,21 @@ func NewCommand(exitCmd *cobra.Command) *cobra.Command {
 
 	cmd.PersistentFlags().StringP("username", "n", "", "username to use")
 	cmd.PersistentFlags().StringP("server", "s", "http://localhost:8080", "server to connect to")
+	cmd.PersistentFlags().String("stun-server", "", "STUN server to discover the public UDP address with (default is port 3478 of --server)")
 
 	viper.BindPFlag("username", cmd.PersistentFlags().Lookup("username"))
 	viper.BindPFlag("server", cmd.PersistentFlags().Lookup("server"))
+	viper.BindPFlag("stun-server", cmd.PersistentFlags().Lookup("stun-server"))
 
 	cmd.AddCommand(
-		start.NewCommand(), // start connection to stun
-		get.NewCommand(),   // get peer by username
-		send.NewCommand(),  // send image/text to a peer
+		start.NewCommand(n),     // start connection to stun
+		get.NewCommand(),        // get peer by username
+		send.NewCommand(n),      // send image/file/text to a peer
+		verify.NewCommand(n),    // compare safety numbers with a peer
+		outbox.NewCommand(n),    // list, retry or drop unsent messages
+		history.NewCommand(n),   // list the messages exchanged with a peer
+		search.NewCommand(n),    // search all the messages
+		transfers.NewCommand(n), // list, accept, reject or cancel file transfers
 		exitCmd,
 	)
 
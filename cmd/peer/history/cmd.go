@@ -0,0 +1,82 @@
+package history
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/history"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+const defaultLimit = 20
+
+var (
+	since string
+	limit int
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history <username> [--since <duration or date>] [--limit <count>]",
+		Short: "list the messages exchanged with a peer",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.ExactArgs(1),
+	}
+
+	cmd.Flags().StringVar(&since, "since", "", "only list messages since a duration ago, like 24h, or a date, like 2006-01-02")
+	cmd.Flags().IntVarP(&limit, "limit", "l", defaultLimit, "list at most this many of the last messages, 0 for all")
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	// the command is run again and again in the shell, so the flags are
+	// reset for the next run
+	defer func() {
+		since, limit = "", defaultLimit
+	}()
+
+	from, err := parseSince(since)
+	if err != nil {
+		return err
+	}
+
+	records := n.History().Conversation(args[0], from, limit)
+	if len(records) == 0 {
+		cmd.Printf("No messages with %q.\n", args[0])
+		return nil
+	}
+
+	for _, r := range records {
+		Print(cmd, r)
+	}
+	return nil
+}
+
+// Print prints r in a line of its own.
+func Print(cmd *cobra.Command, r history.Record) {
+	arrow := "->"
+	if r.Direction == history.Incoming {
+		arrow = "<-"
+	}
+	cmd.Printf("%s %s %s: %q (%s)\n", r.Time.Local().Format("2006-01-02 15:04"), arrow, r.Peer, r.Text, r.Status)
+}
+
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid --since %q, expected a duration like 24h or a date like 2006-01-02", s)
+}
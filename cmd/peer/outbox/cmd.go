@@ -0,0 +1,55 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/outbox/drop"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/outbox/retry"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "outbox [retry [message id...] | drop <message id>]",
+		Short: "list the messages waiting to be retried",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.NoArgs,
+	}
+
+	cmd.AddCommand(
+		retry.NewCommand(n),
+		drop.NewCommand(n),
+	)
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	entries := n.Outbox().List()
+	if len(entries) == 0 {
+		cmd.Println("The outbox is empty.")
+		return nil
+	}
+
+	for _, e := range entries {
+		next := "now"
+		if wait := time.Until(e.NextAttempt); wait > 0 {
+			next = "in " + wait.Round(time.Second).String()
+		}
+		cmd.Printf(
+			"%s to %q: %q\n  queued %s, %d attempts, next %s: %s\n",
+			e.ShortID(),
+			e.To,
+			e.Text,
+			e.Created.Format(time.Stamp),
+			e.Attempts,
+			next,
+			e.LastError,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package drop
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	return &cobra.Command{
+		Use:   "drop <message id>",
+		Short: "remove the specified message from the outbox without sending it",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.ExactArgs(1),
+	}
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	e, err := n.Outbox().Find(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "message %s", args[0])
+	}
+
+	if err := n.Outbox().Remove(e.ID); err != nil {
+		return err
+	}
+
+	cmd.Printf("Dropped message %s to %q.\n", e.ShortID(), e.To)
+	return nil
+}
@@ -0,0 +1,17 @@
+package retry
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	return &cobra.Command{
+		Use:   "retry [message id...]",
+		Short: "retry the specified messages in the outbox now, or all of them",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return n.RetryOutbox(args...)
+		},
+	}
+}
@@ -0,0 +1,50 @@
+package search
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/history"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+const defaultLimit = 20
+
+var limit int
+
+func NewCommand(n *node.Node) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "search <query> [--limit <count>]",
+		Short: "search the messages exchanged with all peers",
+		Long:  "List the last messages sent or received whose text contains the query, ignoring case.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.MinimumNArgs(1),
+	}
+
+	cmd.Flags().IntVarP(&limit, "limit", "l", defaultLimit, "list at most this many of the last matches, 0 for all")
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	defer func() {
+		limit = defaultLimit
+	}()
+
+	// the query may be given unquoted
+	query := strings.Join(args, " ")
+
+	records := n.History().Search(query, limit)
+	if len(records) == 0 {
+		cmd.Printf("No messages contain %q.\n", query)
+		return nil
+	}
+
+	for _, r := range records {
+		history.Print(cmd, r)
+	}
+	return nil
+}
@@ -3,20 +3,23 @@ package send
 import (
 	"github.com/spf13/cobra"
 
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/send/file"
 	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/send/image"
 	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/send/text"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
 )
 
-func NewCommand() *cobra.Command {
+func NewCommand(n *node.Node) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "send image <target username> <image filename> OR send text <target username> <desired text>",
-		Short: "send text/image to specified username in a P2P way",
+		Use:   "send image <target username> <image filename> OR send file <target username> <path> OR send text <target username> <desired text>",
+		Short: "send text/image/file to specified username in a P2P way",
 		RunE:  run,
 	}
 
 	cmd.AddCommand(
-		image.NewCommand(),
-		text.NewCommand(),
+		image.NewCommand(n),
+		file.NewCommand(n),
+		text.NewCommand(n),
 	)
 
 	return cmd
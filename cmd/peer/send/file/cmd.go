@@ -0,0 +1,60 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	return &cobra.Command{
+		Use:   "file <target username> <path>",
+		Short: "send any file to the specified username in a P2P way",
+		Long: "Send a file of any kind to the specified username over UDP. The receiver checks\n" +
+			"it against its size and SHA-256 before writing it as new<filename>.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.ExactArgs(2),
+	}
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	username, err := cmd.Flags().GetString("username")
+	if err != nil {
+		panic(err)
+	}
+
+	var (
+		targetUsername = args[0]
+		path           = args[1]
+	)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s", path)
+	}
+	if len(data) > protocol.MaxFileSize {
+		return errors.Errorf("%s is larger than the maximum of %d bytes", path, protocol.MaxFileSize)
+	}
+
+	target, err := n.Lookup(cmd.Context(), targetUsername)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up %s", targetUsername)
+	}
+
+	m := protocol.NewManifest(username, filepath.Base(path), "", data)
+
+	id, err := n.SendFile(cmd.Context(), target, m, data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to send %q to %s", m.Filename, targetUsername)
+	}
+
+	cmd.Printf("sending %q (%s, %d bytes) to %q as %s, see transfers list\n", m.Filename, m.MIMEType, m.Size, targetUsername, id.Short())
+	return nil
+}
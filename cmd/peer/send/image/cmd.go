@@ -1,26 +1,39 @@
 package image
 
 import (
+	"bytes"
 	"encoding/json"
 	"image"
 	"net/http"
 	"os"
+	"path/filepath"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/ArminGh02/golang-p2p-messenger/internal/imgutil"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
 )
 
-func NewCommand() *cobra.Command {
-	return &cobra.Command{
+var logger *logrus.Logger
+
+func NewCommand(n *node.Node) *cobra.Command {
+	cmd := &cobra.Command{
 		Use:   "image <target username> <image filename>",
 		Short: "send the specified image file to the specified username in a P2P way",
-		RunE:  run,
-		Args:  cobra.MatchAll(cobra.ExactArgs(2), validateArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.MatchAll(cobra.ExactArgs(2), validateArgs),
 	}
+
+	logger = logrus.New()
+	logger.Out = cmd.OutOrStdout()
+
+	return cmd
 }
 
 func validateArgs(cmd *cobra.Command, args []string) error {
@@ -38,7 +51,7 @@ func isValidImage(i string) bool {
 	return true
 }
 
-func run(cmd *cobra.Command, args []string) error {
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
 	stunAddr, err := cmd.Flags().GetString("server")
 	if err != nil {
 		panic(err)
@@ -84,7 +97,7 @@ func run(cmd *cobra.Command, args []string) error {
 		)
 	}
 
-	f, err := os.Open(imageFilename)
+	data, err := os.ReadFile(imageFilename)
 	if err != nil {
 		cmd.Println("could not open the file")
 		return err
@@ -92,15 +105,30 @@ func run(cmd *cobra.Command, args []string) error {
 
 	cmd.Println("opened the file")
 
-	targetAddr := respBody.Peers[0].UDPAddr
-
-	img, _, err := image.Decode(f)
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "%s isn't an image", imageFilename)
 	}
 
-	pixels := imgutil.ToPixels(img)
+	var (
+		target = respBody.Peers[0]
+		id     protocol.FileID
+	)
+	if protocol.NegotiateVersion(target.WireVersion) >= protocol.ChunkVersion {
+		// the file is sent as is
+		m := protocol.NewManifest(username, filepath.Base(imageFilename), format, data)
+		id, err = n.SendFile(cmd.Context(), target, m, data)
+	} else {
+		var img image.Image
+		img, _, err = image.Decode(bytes.NewReader(data))
+		if err == nil {
+			id, err = n.SendPixels(cmd.Context(), target, imgutil.ToPixels(img), imageFilename, username)
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to send %q to %s", imageFilename, targetUsername)
+	}
 
-	cmd.Println("sending...")
-	return protocol.SendImage(targetAddr, pixels, imageFilename, username)
+	cmd.Printf("sending %q to %q as %s, see transfers list\n", imageFilename, targetUsername, id.Short())
+	return nil
 }
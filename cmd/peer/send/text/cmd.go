@@ -1,65 +1,47 @@
 package text
 
 import (
-	"encoding/json"
-	"net/http"
-
-	"github.com/spf13/cobra"
 	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
 
-	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
-	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
 )
 
-func NewCommand() *cobra.Command {
+func NewCommand(n *node.Node) *cobra.Command {
 	return &cobra.Command{
 		Use:   "text <target username> <desired text>",
 		Short: "send a text to specified username in a P2P way",
-		RunE:  run,
-		Args:  cobra.ExactArgs(2),
+		Long: "Send a text to the specified username. If they're offline, it's left in their\n" +
+			"mailbox on the server if it keeps one. If they can't be reached, it's queued\n" +
+			"in the outbox and retried until they can, see the outbox command.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.ExactArgs(2),
 	}
 }
 
-func run(cmd *cobra.Command, args []string) error {
-	stunAddr, err := cmd.Flags().GetString("server")
-	if err != nil {
-		panic(err)
-	}
-
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
 	var (
 		targetUsername = args[0]
 		text           = args[1]
 	)
 
-	resp, err := http.Get(stunAddr + "/peer/" + targetUsername)
+	sent, err := n.Send(cmd.Context(), targetUsername, text)
 	if err != nil {
-		return errors.Wrapf(
-			err,
-			"failed to make the get request for target username %q from server at %q",
-			targetUsername,
-			stunAddr,
-		)
+		if sent.ID.IsZero() {
+			return err
+		}
+		return errors.Wrapf(err, "message %s to %s failed", sent.ID.Short(), targetUsername)
 	}
 
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return errors.Errorf("failed to get peer from server at %s with status: %s", stunAddr, resp.Status)
-	}
-
-	var respBody response.GetPeer
-	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
-		return err
+	switch sent.Status {
+	case node.StatusStored:
+		cmd.Printf("message %s to %q %s until they're back online\n", sent.ID.Short(), targetUsername, sent.Status)
+	case node.StatusQueued:
+		cmd.Printf("message %s to %q %s in the outbox, to be retried\n", sent.ID.Short(), targetUsername, sent.Status)
+	default:
+		cmd.Printf("message %s to %q %s\n", sent.ID.Short(), targetUsername, sent.Status)
 	}
-
-	if !respBody.OK {
-		return errors.Errorf(
-			"something went wrong retrieving peer with username %s on server at %s. error: %s",
-			targetUsername,
-			stunAddr,
-			respBody.Error,
-		)
-	}
-
-	return protocol.SendText(respBody.Peers[0].TCPAddr, text)
+	return nil
 }
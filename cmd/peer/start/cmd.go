@@ -1,28 +1,40 @@
 package start
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"net/http"
+	"context"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
-	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/client"
 )
 
-func NewCommand() *cobra.Command {
-	return &cobra.Command{
+var logger *logrus.Logger
+
+func NewCommand(n *node.Node) *cobra.Command {
+	cmd := &cobra.Command{
 		Use:   "start",
 		Short: "start peer and connect to STUN with specified username",
-		RunE:  run,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
 	}
+
+	logger = logrus.New()
+	logger.Out = cmd.OutOrStdout()
+
+	return cmd
 }
 
-func run(cmd *cobra.Command, args []string) error {
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
 	username, err := cmd.Flags().GetString("username")
 	if err != nil {
 		panic(err)
@@ -37,38 +49,54 @@ func run(cmd *cobra.Command, args []string) error {
 		panic(err)
 	}
 
-	req := request.PostPeer{
-		Username: username,
-		TCPAddr:  fmt.Sprintf("localhost:%d", viper.GetUint16("tcp-port")),
-		UDPAddr:  fmt.Sprintf("localhost:%d", viper.GetUint16("udp-port")),
-	}
+	c := client.New(stunAddr)
 
-	body, err := json.Marshal(&req)
+	localIP, err := c.LocalIP()
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Post(stunAddr+"/peer/", "application/json", bytes.NewBuffer(body))
-	if err != nil {
-		return errors.Wrapf(err, "failed to connect to STUN server: %s", stunAddr)
+	req := request.PostPeer{
+		Username:    username,
+		TCPAddr:     net.JoinHostPort(localIP.String(), strconv.Itoa(int(viper.GetUint16("tcp-port")))),
+		UDPAddr:     net.JoinHostPort(localIP.String(), strconv.Itoa(int(viper.GetUint16("udp-port")))),
+		WireVersion: protocol.WireVersion,
 	}
 
-	if resp.StatusCode == http.StatusConflict {
-		return errors.Errorf("username already exists")
+	stunServer, err := cmd.Flags().GetString("stun-server")
+	if err != nil {
+		panic(err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("failed to connect to STUN server at %s with status: %s", stunAddr, resp.Status)
+	if stunServer == "" {
+		stunServer, err = c.STUNAddr()
+		if err != nil {
+			return err
+		}
 	}
 
-	var respBody response.PostPeer
-	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
-		return errors.Wrap(err, "failed to decode response body")
+	ctx, cancel := context.WithTimeout(cmd.Context(), 5*time.Second)
+	mapped, err := n.Binding().Discover(ctx, stunServer)
+	cancel()
+	if err != nil {
+		// the server falls back to the address it observes
+		logger.Warnln("Error discovering public UDP address:", "error", err)
+	} else {
+		req.PublicUDPAddr = mapped.String()
 	}
 
-	if !respBody.OK {
-		return errors.Errorf("failed to connect to STUN server at %s: %s", stunAddr, respBody.Error)
+	// the lease lives as long as the shell, not just this command
+	if err := n.Register(cmd.Context(), c, &req); err != nil {
+		return err
 	}
 
+	count, err := n.DrainMailbox(cmd.Context())
+	switch {
+	case errors.Is(err, client.ErrMailboxDisabled):
+	case err != nil:
+		logger.Warnln("Error fetching messages kept while offline:", "error", err)
+	case count > 0:
+		logger.Infof("Received %d messages kept while offline\n", count)
+	}
 	return nil
 }
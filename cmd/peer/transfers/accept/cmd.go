@@ -0,0 +1,29 @@
+package accept
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	return &cobra.Command{
+		Use:   "accept <transfer id>",
+		Short: "accept the specified file or image a peer offers",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.ExactArgs(1),
+	}
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	o, err := n.AnswerOffer(args[0], true)
+	if err != nil {
+		return errors.Wrapf(err, "offer %s", args[0])
+	}
+
+	cmd.Printf("Accepted %q from %q.\n", o.Filename, o.Peer)
+	return nil
+}
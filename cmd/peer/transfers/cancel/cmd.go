@@ -0,0 +1,36 @@
+package cancel
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	return &cobra.Command{
+		Use:   "cancel <transfer id>",
+		Short: "cancel the specified transfer, telling the peer at the other end, reject it if it's offered, or drop it if it's kept to be resumed",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.ExactArgs(1),
+	}
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	p, err := n.CancelTransfer(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "transfer %s", args[0])
+	}
+
+	switch {
+	case p.Offered:
+		cmd.Printf("Rejected %q from %q.\n", p.Filename, p.Peer)
+	case p.Paused:
+		cmd.Printf("Dropped transfer %s of %q.\n", p.ID.Short(), p.Filename)
+	default:
+		cmd.Printf("Cancelled transfer %s of %q.\n", p.ID.Short(), p.Filename)
+	}
+	return nil
+}
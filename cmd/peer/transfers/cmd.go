@@ -0,0 +1,27 @@
+package transfers
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/transfers/accept"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/transfers/cancel"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/transfers/list"
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/transfers/reject"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "transfers list OR transfers accept|reject|cancel <transfer id>",
+		Short: "list, accept, reject or cancel the files and images being sent and received",
+	}
+
+	cmd.AddCommand(
+		list.NewCommand(n),
+		accept.NewCommand(n),
+		reject.NewCommand(n),
+		cancel.NewCommand(n),
+	)
+
+	return cmd
+}
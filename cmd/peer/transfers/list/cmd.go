@@ -0,0 +1,82 @@
+package list
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "list the files and images being sent and received, the ones offered and the ones kept to be resumed",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: cobra.NoArgs,
+	}
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	transfers := n.Transfers()
+	if len(transfers) == 0 {
+		cmd.Println("There are no transfers.")
+		return nil
+	}
+
+	for _, p := range transfers {
+		cmd.Printf("%s %s\n", p.ID.Short(), Describe(&p))
+	}
+	return nil
+}
+
+// Describe returns a line telling how far p has got.
+func Describe(p *node.Progress) string {
+	s := fmt.Sprintf("sending %q to %q", p.Filename, p.Peer)
+	if p.Incoming {
+		s = fmt.Sprintf("receiving %q from %q", p.Filename, p.Peer)
+	}
+
+	if p.Offered {
+		return fmt.Sprintf("%q offered by %q: %s, waiting to be accepted", p.Filename, p.Peer, FormatBytes(p.Size))
+	}
+	if p.Paused && !p.Incoming {
+		// the sender is only told how far the file got once it's resumed
+		return s + fmt.Sprintf(": %s, paused", FormatBytes(p.Size))
+	}
+
+	s += fmt.Sprintf(": %s of %s (%d%%)", FormatBytes(p.Bytes), FormatBytes(p.Size), Percent(p))
+	switch {
+	case p.Paused:
+		s += ", paused"
+	case p.Rate > 0:
+		s += fmt.Sprintf(", %s/s, %s left", FormatBytes(uint64(p.Rate)), p.ETA().Round(time.Second))
+	}
+	return s
+}
+
+// Percent returns how much of the file of p has arrived, in percent.
+func Percent(p *node.Progress) int {
+	if p.Size == 0 {
+		return 100
+	}
+	return int(p.Bytes * 100 / p.Size)
+}
+
+// FormatBytes returns n bytes in the largest binary unit it makes one of.
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
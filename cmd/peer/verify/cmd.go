@@ -0,0 +1,126 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/contacts"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+var (
+	logger *logrus.Logger
+
+	trust bool
+)
+
+func NewCommand(n *node.Node) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <username> [--trust <safety number or fingerprint>]",
+		Short: "print the safety number to compare with the specified username",
+		Long: "Print the safety number of your identity key and the one of the specified username.\n" +
+			"Compare it with the one they see, in person or over another channel you trust.\n" +
+			"If it matches, run again with --trust followed by the safety number or their\n" +
+			"fingerprint you compared, to mark the key as verified or to accept their new key\n" +
+			"after it has changed. The key is only pinned if it's still the one compared.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(cmd, args, n)
+		},
+		Args: func(cmd *cobra.Command, args []string) error {
+			if !trust {
+				return cobra.ExactArgs(1)(cmd, args)
+			}
+			if len(args) < 2 {
+				return errors.New("--trust needs the safety number or fingerprint you compared")
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&trust, "trust", false, "pin the key the username is registered with as verified, if it has the safety number or fingerprint given after the username")
+
+	logger = logrus.New()
+	logger.Out = cmd.OutOrStdout()
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string, n *node.Node) error {
+	username := args[0]
+
+	pinned, havePin := n.Contacts().Get(username)
+
+	var registered ed25519.PublicKey
+	p, err := n.Lookup(cmd.Context(), username)
+	if err == nil {
+		registered = p.PublicKey
+	} else if !havePin || trust {
+		return errors.Wrapf(err, "failed to look up the key of %s", username)
+	} else {
+		logger.Warnf("Could not look up the key %s is registered with: %v\n", username, err)
+	}
+
+	if trust {
+		if len(registered) == 0 {
+			return errors.Errorf("%s is registered without an identity key", username)
+		}
+		// the key may have changed since the number was compared
+		if !contacts.Matches(n.Identity().PublicKey(), registered, strings.Join(args[1:], "")) {
+			return errors.Errorf(
+				"the key %s is registered with doesn't have that safety number or fingerprint, run verify %s to compare it again",
+				username,
+				username,
+			)
+		}
+		if err := n.Contacts().Trust(username, registered); err != nil {
+			return err
+		}
+		cmd.Printf("The key of %s is now pinned as verified.\n", username)
+		pinned, havePin = n.Contacts().Get(username)
+	}
+
+	key := registered
+	changed := false
+	if havePin {
+		if registered != nil && !bytes.Equal(registered, pinned.PublicKey) {
+			changed = true
+			logger.Errorf(
+				"WARNING: %s is registered with another key than the one pinned on %s!\n"+
+					"The safety number below is for the new key. If %s reset their identity,\n"+
+					"compare it with them before trusting the new key with --trust.\n",
+				username,
+				pinned.FirstSeen.Format("2006-01-02"),
+				username,
+			)
+		} else {
+			key = pinned.PublicKey
+		}
+	}
+	if len(key) == 0 {
+		return errors.Errorf("%s has no identity key", username)
+	}
+
+	own := n.Identity().PublicKey()
+
+	cmd.Printf("Safety number with %s:\n\n%s\n\n", username, contacts.SafetyNumber(own, key))
+	cmd.Print(contacts.Grid(own, key))
+	cmd.Printf("\nYour fingerprint:  %s\n", contacts.Fingerprint(own))
+	cmd.Printf("%s's fingerprint: %s\n", username, contacts.Fingerprint(key))
+
+	switch {
+	case changed:
+		cmd.Println("Not trusted, another key is pinned.")
+	case havePin && pinned.Verified:
+		cmd.Println("Verified.")
+	case havePin:
+		cmd.Printf("Pinned on first contact on %s, not verified yet.\n", pinned.FirstSeen.Format("2006-01-02"))
+	default:
+		cmd.Println("Not pinned yet, it will be on first contact.")
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package root
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/transfers/list"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+// shellPrompt returns the question about the oldest offer waiting to be
+// answered, which is answered by the next line entered, or the prompt if
+// there's none.
+func shellPrompt(n *node.Node) string {
+	offers := n.PendingOffers()
+	if len(offers) == 0 {
+		return prompt()
+	}
+
+	o := &offers[0]
+	return fmt.Sprintf("accept %q from %q (%s)? [y/n]", o.Filename, o.Peer, describeOffer(o))
+}
+
+func describeOffer(o *node.FileOffer) string {
+	if o.MIMEType == "" {
+		return list.FormatBytes(o.Size)
+	}
+	return o.MIMEType + ", " + list.FormatBytes(o.Size)
+}
+
+// parseAnswer reports whether line answers a question, and whether it
+// accepts.
+func parseAnswer(line string) (accept, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, true
+	case "n", "no":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,393 @@
+package root
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/resume"
+)
+
+// fileData is a file received whole, checked against its manifest.
+type fileData struct {
+	*protocol.Manifest
+	data     []byte
+	username string
+}
+
+type userFileIDPair struct {
+	username string
+	id       protocol.FileID
+}
+
+// incomingFile is a file whose packets are arriving.
+type incomingFile struct {
+	*resume.Incoming
+	update  protocol.ProgressFunc
+	untrack func() (node.Progress, error)
+	// conn and addr are where its last packet came from, to tell the sender
+	// if it's cancelled.
+	conn net.PacketConn
+	addr net.Addr
+	// seen is when its last packet arrived, and done when all of them had,
+	// zero until then.
+	seen, done time.Time
+}
+
+// offeredFile is a file whose manifest has arrived, waiting for the user to
+// accept it.
+type offeredFile struct {
+	manifest protocol.Manifest
+	withdraw func()
+	// conn and addr are where its manifest last came from, to answer it.
+	conn net.PacketConn
+	addr net.Addr
+	// seen is when its manifest last arrived.
+	offered, seen time.Time
+}
+
+type offerAnswer struct {
+	key      userFileIDPair
+	accepted bool
+}
+
+// cancelledFile is a file cancelled or declined lately, whose packets are
+// answered by telling the sender again until it gives up.
+type cancelledFile struct {
+	protocol.Cancel
+	seen time.Time
+}
+
+// loopReassembleFiles acknowledges the manifests and chunks of files, keeping
+// them in store to be resumed if they're interrupted, and sends out every
+// file whose packets have all arrived. The manifest of a file is only
+// acknowledged once the file is accepted, by the consent policy of nd or by
+// the user. Files are tracked by nd as they arrive, to be cancelled by
+// either end.
+func loopReassembleFiles(ctx context.Context, nd *node.Node, store *resume.Store, out chan<- fileData) error {
+	var (
+		files     = make(map[userFileIDPair]*incomingFile)
+		offered   = make(map[userFileIDPair]*offeredFile)
+		cancelled = make(map[userFileIDPair]cancelledFile)
+		cancels   = make(chan userFileIDPair)
+		answers   = make(chan offerAnswer)
+	)
+	defer func() {
+		for _, f := range files {
+			closeFile(f)
+		}
+		for _, o := range offered {
+			o.withdraw()
+		}
+	}()
+
+	// receive starts receiving the file described by m, which was accepted.
+	receive := func(key userFileIDPair, m *protocol.Manifest) (*incomingFile, error) {
+		in, resumed, err := store.Receive(key.username, m)
+		if err != nil {
+			return nil, err
+		}
+		if resumed {
+			received, total := in.Progress()
+			logger.Infof("resuming %q from %q, %d of %d packets received\n", m.Filename, key.username, received, total)
+		}
+
+		f := &incomingFile{Incoming: in}
+		f.update, f.untrack = nd.Track(node.Progress{
+			ID:       m.ID,
+			Peer:     key.username,
+			Filename: m.Filename,
+			Incoming: true,
+			Size:     m.Size,
+		}, func() {
+			select {
+			case cancels <- key:
+			case <-ctx.Done():
+			}
+		})
+		f.update(f.Progress())
+		files[key] = f
+		return f, nil
+	}
+
+	decline := func(key userFileIDPair, conn net.PacketConn, addr net.Addr, reason string) {
+		c := cancelledFile{Cancel: protocol.Cancel{ID: key.id, Declined: true, Reason: reason}, seen: time.Now()}
+		cancelled[key] = c
+		cancelFile(conn, addr, c.Cancel)
+	}
+
+	ticker := time.NewTicker(resume.SaveInterval)
+	defer ticker.Stop()
+
+	for {
+		var d node.Datagram
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			for key, f := range files {
+				// an idle file is left to be resumed from its saved state
+				if time.Since(f.seen) > protocol.ImageTimeout {
+					closeFile(f)
+					delete(files, key)
+					continue
+				}
+				// a done file is finishFile's to remove
+				if !f.done.IsZero() {
+					continue
+				}
+				if err := f.Save(); err != nil {
+					logger.Warn(err)
+				}
+			}
+			for key, o := range offered {
+				if time.Since(o.seen) > protocol.ImageTimeout || time.Since(o.offered) > protocol.OfferTimeout {
+					o.withdraw()
+					delete(offered, key)
+					logger.Infof("offer of %q from %q expired\n", o.manifest.Filename, key.username)
+				}
+			}
+			for key, c := range cancelled {
+				if time.Since(c.seen) > protocol.ImageTimeout {
+					delete(cancelled, key)
+				}
+			}
+			continue
+		case key := <-cancels:
+			f := files[key]
+			if f == nil || !f.done.IsZero() {
+				continue
+			}
+			dropFile(f)
+			delete(files, key)
+			c := cancelledFile{Cancel: protocol.Cancel{ID: key.id}, seen: time.Now()}
+			cancelled[key] = c
+			cancelFile(f.conn, f.addr, c.Cancel)
+			logger.Infof("cancelled receiving %q from %q\n", f.Manifest.Filename, key.username)
+			continue
+		case a := <-answers:
+			o := offered[a.key]
+			if o == nil {
+				continue
+			}
+			delete(offered, a.key)
+			if !a.accepted {
+				decline(a.key, o.conn, o.addr, "")
+				logger.Infof("rejected %q from %q\n", o.manifest.Filename, a.key.username)
+				continue
+			}
+
+			f, err := receive(a.key, &o.manifest)
+			if err != nil {
+				logger.Warnf("Dropping file from %q: %v\n", a.key.username, err)
+				continue
+			}
+			f.conn, f.addr, f.seen = o.conn, o.addr, time.Now()
+			ackFile(o.conn, o.addr, f.ACK(0))
+			if completeFile(f) {
+				go finishFile(ctx, f, out)
+			}
+			continue
+		case d = <-nd.Files():
+		}
+
+		kind, payload, err := protocol.DecodeDatagram(d.B)
+		if err != nil {
+			continue
+		}
+
+		var (
+			m     protocol.Manifest
+			chunk protocol.Chunk
+			c     protocol.Cancel
+			key   = userFileIDPair{username: d.Peer}
+		)
+		switch kind {
+		case protocol.KindManifest:
+			err = json.Unmarshal(payload, &m)
+			key.id = m.ID
+		case protocol.KindChunk:
+			err = chunk.UnmarshalBinary(payload)
+			key.id = chunk.ID
+		case protocol.KindCancel:
+			err = json.Unmarshal(payload, &c)
+			key.id = c.ID
+		}
+		if err != nil {
+			logger.Warnf("Dropping invalid file packet from %q: %v\n", d.Peer, err)
+			continue
+		}
+
+		f := files[key]
+		if kind == protocol.KindCancel {
+			if o := offered[key]; o != nil {
+				o.withdraw()
+				delete(offered, key)
+				logger.Infof("%q withdrew the offer of %q\n", d.Peer, o.manifest.Filename)
+			}
+			if f != nil && f.done.IsZero() {
+				dropFile(f)
+				delete(files, key)
+				logger.Infof("%q cancelled sending %q\n", d.Peer, f.Manifest.Filename)
+			}
+			continue
+		}
+		if c, ok := cancelled[key]; ok {
+			c.seen = time.Now()
+			cancelled[key] = c
+			cancelFile(d.Conn, d.Addr, c.Cancel)
+			continue
+		}
+
+		var seq uint64
+		if kind == protocol.KindManifest {
+			if o := offered[key]; o != nil {
+				// left unanswered until the user answers, while the sender
+				// keeps offering it
+				o.conn, o.addr, o.seen = d.Conn, d.Addr, time.Now()
+				continue
+			}
+			if f == nil {
+				// the sender named in the manifest is only trusted as far as
+				// the transfer was keyed by it
+				m.Sender = d.Peer
+				if err := m.Validate(); err != nil {
+					logger.Warnf("Dropping file from %q: %v\n", d.Peer, err)
+					continue
+				}
+
+				// a file kept to be resumed was accepted already
+				if !store.Receiving(d.Peer, m.ID) {
+					offer := node.FileOffer{
+						ID:       m.ID,
+						Peer:     d.Peer,
+						Filename: m.Filename,
+						MIMEType: m.MIMEType,
+						Size:     m.Size,
+					}
+					switch decision, reason := nd.Consent(&offer); decision {
+					case node.Reject:
+						decline(key, d.Conn, d.Addr, reason)
+						logger.Infof("declined %q from %q: %s\n", m.Filename, d.Peer, reason)
+						continue
+					case node.Ask:
+						o := &offeredFile{manifest: m, conn: d.Conn, addr: d.Addr, offered: time.Now(), seen: time.Now()}
+						offered[key] = o
+						o.withdraw = nd.Offer(offer, func(accepted bool) {
+							select {
+							case answers <- offerAnswer{key: key, accepted: accepted}:
+							case <-ctx.Done():
+							}
+						})
+						continue
+					}
+				}
+
+				f, err = receive(key, &m)
+				if err != nil {
+					logger.Warnf("Dropping file from %q: %v\n", d.Peer, err)
+					continue
+				}
+			}
+		} else {
+			if f == nil {
+				// the sender waits for the manifest to be acknowledged
+				// before sending chunks, so these are left to be resent
+				continue
+			}
+			isNew, err := f.AddChunk(&chunk)
+			if err != nil {
+				logger.Warnf("Dropping invalid file packet from %q: %v\n", d.Peer, err)
+				continue
+			}
+			if isNew {
+				f.update(f.Progress())
+			}
+			seq = chunk.Seq
+		}
+		f.conn, f.addr, f.seen = d.Conn, d.Addr, time.Now()
+
+		// duplicates are acknowledged again, as the ACK may have been lost
+		ackFile(d.Conn, d.Addr, f.ACK(seq))
+
+		if completeFile(f) {
+			go finishFile(ctx, f, out)
+		}
+	}
+}
+
+// completeFile reports whether all the packets of f have arrived, the first
+// time they have, and stops tracking it. f is left to finishFile then.
+func completeFile(f *incomingFile) bool {
+	if !f.Done() || !f.done.IsZero() {
+		return false
+	}
+	f.done = time.Now()
+	f.untrack()
+	return true
+}
+
+// finishFile reads f, checking it against its manifest, sends it out and
+// removes its state as it won't be resumed. It runs apart from the loop
+// reassembling files, as reading and hashing a large file takes a while.
+func finishFile(ctx context.Context, f *incomingFile, out chan<- fileData) {
+	data, err := f.Bytes()
+	// it won't be resumed whether it's intact or not
+	if rerr := f.Remove(); rerr != nil {
+		logger.Warn(rerr)
+	}
+	if err != nil {
+		logger.Errorf("Error receiving %q from %q: %v\n", f.Manifest.Filename, f.From, err)
+		return
+	}
+
+	select {
+	case out <- fileData{Manifest: f.Manifest, data: data, username: f.From}:
+	case <-ctx.Done():
+	}
+}
+
+// closeFile stops tracking f, and saves its state to be resumed unless all
+// of it arrived.
+func closeFile(f *incomingFile) {
+	f.untrack()
+	if !f.done.IsZero() {
+		return
+	}
+	if err := f.Close(); err != nil {
+		logger.Warn(err)
+	}
+}
+
+// dropFile stops tracking f, and removes its state as it won't be resumed.
+func dropFile(f *incomingFile) {
+	f.untrack()
+	if err := f.Remove(); err != nil {
+		logger.Warn(err)
+	}
+}
+
+func cancelFile(conn net.PacketConn, addr net.Addr, c protocol.Cancel) {
+	b, err := protocol.EncodeDatagram(protocol.KindCancel, c)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, err := conn.WriteTo(b, addr); err != nil {
+		logger.Error(err)
+	}
+}
+
+func ackFile(conn net.PacketConn, addr net.Addr, ack protocol.ChunkACK) {
+	b, err := protocol.EncodeDatagram(protocol.KindChunkACK, ack)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, err := conn.WriteTo(b, addr); err != nil {
+		logger.Error(err)
+	}
+}
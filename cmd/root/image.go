@@ -3,16 +3,16 @@ package root
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"image/color"
 	"io"
 	"log"
-	"math"
+	"mime"
 	"net"
-
-	"github.com/pkg/errors"
+	"path/filepath"
+	"time"
 
 	"github.com/ArminGh02/golang-p2p-messenger/internal/imgutil"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
 )
 
@@ -32,88 +32,335 @@ type userFilePair struct {
 	filename string
 }
 
-func loopReceiveImage(ctx context.Context, out chan<- imageData) error {
-	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", udpPort))
-	if err != nil {
-		return errors.Wrapf(err, "unable to start listening on port %d for UDP packets", udpPort)
-	}
-	defer conn.Close()
+// receivedPacket is an image packet along with where to acknowledge it.
+type receivedPacket struct {
+	imgPacket protocol.ImagePacket
+	addr      net.Addr
+	conn      net.PacketConn
+}
 
-	type sharedPacket struct {
-		imgPacket protocol.ImagePacket
-		addr      net.Addr
-	}
-	packetsChan := make(chan sharedPacket)
-	defer close(packetsChan)
+// udpQueueSize is how many datagrams read from the UDP socket wait at most to
+// be handled. Beyond that they're dropped for their senders to resend, so
+// that the socket is read as fast as datagrams arrive.
+const udpQueueSize = 1024
+
+type udpDatagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// loopReadUDP passes the datagrams arriving on the node's UDP socket to the
+// node, handling them apart from reading the socket.
+func loopReadUDP(ctx context.Context, conn net.PacketConn, nd *node.Node) error {
+	defer conn.Close()
 
 	go func() {
-		packets := make(map[userFilePair]map[rowOffsetPair]storedPacket)
-		for p := range packetsChan {
-			imgPacket := p.imgPacket
-			addr := p.addr
+		<-ctx.Done()
+		conn.Close()
+	}()
 
-			key := userFilePair{imgPacket.Sender, imgPacket.Filename}
-			rowOffset := rowOffsetPair{imgPacket.Row, imgPacket.Offset}
+	queue := make(chan udpDatagram, udpQueueSize)
+	defer close(queue)
+	go func() {
+		for d := range queue {
+			nd.HandleDatagram(ctx, d.b, d.addr, conn)
+		}
+	}()
 
-			allPacketsCount := imgPacket.Height * uint64(math.Ceil(float64(imgPacket.Width)/protocol.PayloadPixelsCount))
-			if packets[key] == nil {
-				packets[key] = make(map[rowOffsetPair]storedPacket, allPacketsCount)
+	buf := make([]byte, 256*256)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
-
-			if _, duplicate := packets[key][rowOffset]; duplicate {
-				continue
+			if err != io.EOF {
+				logger.Error("read error:", err)
 			}
+			continue
+		}
 
-			packets[key][rowOffset] = toStoredPacket(imgPacket)
+		select {
+		case queue <- udpDatagram{append([]byte(nil), buf[:n]...), addr}:
+		default:
+			logger.Debugf("Dropping datagram from %s as %d are waiting\n", addr, udpQueueSize)
+		}
+	}
+}
 
-			ack(conn, addr, imgPacket)
+// loopReceiveImage passes on the image packets peers send, directly or
+// through relays of the discovery server.
+func loopReceiveImage(ctx context.Context, nd *node.Node, packets chan<- receivedPacket) error {
+	for {
+		var d node.Datagram
+		select {
+		case <-ctx.Done():
+			return nil
+		case d = <-nd.Images():
+		}
 
-			logger.Infof("packet %d from %d\n", len(packets[key]), allPacketsCount)
+		receiveImagePacket(ctx, d, packets)
+	}
+}
 
-			if uint64(len(packets[key])) == allPacketsCount {
-				reassembleImage(
-					packets[key],
-					imgPacket.Sender,
-					imgPacket.Filename,
-					imgPacket.Width,
-					imgPacket.Height,
-					out,
-				)
-			}
+func receiveImagePacket(ctx context.Context, d node.Datagram, packets chan<- receivedPacket) {
+	kind, payload, err := protocol.DecodeDatagram(d.B)
+	if err != nil || kind != protocol.KindImage {
+		return
+	}
+
+	var imgPacket protocol.ImagePacket
+	if err := json.Unmarshal(payload, &imgPacket); err != nil {
+		logger.Error(err)
+		return
+	}
+	// the sender named in the packet is only trusted as far as the transfer
+	// was keyed by it
+	imgPacket.Sender = d.Peer
+
+	select {
+	case packets <- receivedPacket{imgPacket, d.Addr, d.Conn}:
+	case <-ctx.Done():
+	}
+}
+
+// maxImagePackets bounds the size of the images accepted, as the space for
+// all their packets is set aside with the first one.
+const maxImagePackets = 1 << 20
+
+// maxImageSide bounds the width and height of the images accepted, so that
+// the packet count and size derived from them can't overflow.
+const maxImageSide = 1 << 16
+
+// incomingImage is an image whose packets are arriving.
+type incomingImage struct {
+	packets  map[rowOffsetPair]storedPacket
+	received *protocol.Received
+	update   protocol.ProgressFunc
+	untrack  func() (node.Progress, error)
+	// seen is when its last packet arrived, and reassembled when all of them
+	// had, zero until then.
+	seen, reassembled time.Time
+}
+
+// offeredImage is an image whose first packet has arrived, waiting for the
+// user to accept it. Its packets are dropped until then.
+type offeredImage struct {
+	id       protocol.FileID
+	packets  uint64
+	size     uint64
+	withdraw func()
+	// seen is when its last packet arrived.
+	offered, seen time.Time
+}
+
+type imageAnswer struct {
+	key      userFilePair
+	accepted bool
+}
+
+// loopReassembleImages acknowledges image packets and sends out every image
+// whose packets have all arrived. Images are tracked by nd as they arrive,
+// to be cancelled, which the sender is only told of by their packets not
+// being acknowledged anymore. As the sender can't be asked before it sends
+// an image, its packets are dropped the same way until the image is
+// accepted, by the consent policy of nd or by the user.
+func loopReassembleImages(ctx context.Context, nd *node.Node, in <-chan receivedPacket, out chan<- imageData) error {
+	var (
+		images  = make(map[userFilePair]*incomingImage)
+		offered = make(map[userFilePair]*offeredImage)
+		cancels = make(chan userFilePair)
+		answers = make(chan imageAnswer)
+		// cancelled are the images cancelled or declined lately, whose
+		// packets are dropped until the sender gives up
+		cancelled = make(map[userFilePair]time.Time)
+	)
+	defer func() {
+		for _, im := range images {
+			im.untrack()
+		}
+		for _, o := range offered {
+			o.withdraw()
 		}
 	}()
 
-	for {
-		buf := make([]byte, 256*256)
+	// receive starts receiving the image with id, which was accepted.
+	receive := func(key userFilePair, id protocol.FileID, packets, size uint64) *incomingImage {
+		im := &incomingImage{
+			packets:  make(map[rowOffsetPair]storedPacket),
+			received: protocol.NewReceived(packets),
+		}
+		im.update, im.untrack = nd.Track(node.Progress{
+			ID:       id,
+			Peer:     key.username,
+			Filename: key.filename,
+			Incoming: true,
+			Size:     size,
+		}, func() {
+			select {
+			case cancels <- key:
+			case <-ctx.Done():
+			}
+		})
+		images[key] = im
+		return im
+	}
 
-		n, addr, err := conn.ReadFrom(buf)
-		if err != nil {
-			if err != io.EOF {
-				logger.Error("read error:", err)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		var p receivedPacket
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// images can't be resumed, so idle ones are given up on
+			for key, im := range images {
+				if time.Since(im.seen) > protocol.ImageTimeout {
+					im.untrack()
+					delete(images, key)
+				}
+			}
+			for key, o := range offered {
+				if time.Since(o.seen) > protocol.ImageTimeout || time.Since(o.offered) > protocol.OfferTimeout {
+					o.withdraw()
+					delete(offered, key)
+					logger.Infof("offer of %q from %q expired\n", key.filename, key.username)
+				}
+			}
+			for key, at := range cancelled {
+				if time.Since(at) > protocol.ImageTimeout {
+					delete(cancelled, key)
+				}
+			}
+			continue
+		case key := <-cancels:
+			im := images[key]
+			if im == nil || !im.reassembled.IsZero() {
+				continue
+			}
+			im.untrack()
+			delete(images, key)
+			cancelled[key] = time.Now()
+			logger.Infof("cancelled receiving %q from %q\n", key.filename, key.username)
+			continue
+		case a := <-answers:
+			o := offered[a.key]
+			if o == nil {
+				continue
 			}
+			delete(offered, a.key)
+			if !a.accepted {
+				cancelled[a.key] = time.Now()
+				logger.Infof("rejected %q from %q\n", a.key.filename, a.key.username)
+				continue
+			}
+			// its packets are acknowledged as the sender resends them
+			receive(a.key, o.id, o.packets, o.size).seen = time.Now()
+			continue
+		case p = <-in:
 		}
 
-		go func() {
-			var imgPacket protocol.ImagePacket
-			if err := json.Unmarshal(buf[:n], &imgPacket); err != nil {
-				logger.Error(err)
+		imgPacket := p.imgPacket
+
+		key := userFilePair{imgPacket.Sender, imgPacket.Filename}
+		rowOffset := rowOffsetPair{imgPacket.Row, imgPacket.Offset}
+
+		if _, ok := cancelled[key]; ok {
+			cancelled[key] = time.Now()
+			continue
+		}
+		if o := offered[key]; o != nil {
+			o.seen = time.Now()
+			continue
+		}
+
+		if !validImagePacket(&imgPacket) {
+			logger.Warnf("Dropping packet of image %q from %q with invalid size\n", imgPacket.Filename, imgPacket.Sender)
+			continue
+		}
+		allPacketsCount := imgPacket.PacketsCount()
+
+		im := images[key]
+		if im != nil && !im.reassembled.IsZero() && time.Since(im.reassembled) > protocol.ImageTimeout {
+			// sent again rather than a late resend of the last one
+			im = nil
+		}
+		if im == nil {
+			offer := node.FileOffer{
+				ID:       protocol.NewFileID(),
+				Peer:     imgPacket.Sender,
+				Filename: imgPacket.Filename,
+				MIMEType: mime.TypeByExtension(filepath.Ext(imgPacket.Filename)),
+				Size:     imgPacket.Width * imgPacket.Height * 4,
 			}
+			switch decision, reason := nd.Consent(&offer); decision {
+			case node.Reject:
+				cancelled[key] = time.Now()
+				logger.Infof("declined %q from %q: %s\n", offer.Filename, offer.Peer, reason)
+				continue
+			case node.Ask:
+				o := &offeredImage{
+					id:      offer.ID,
+					packets: allPacketsCount,
+					size:    offer.Size,
+					offered: time.Now(),
+					seen:    time.Now(),
+				}
+				offered[key] = o
+				o.withdraw = nd.Offer(offer, func(accepted bool) {
+					select {
+					case answers <- imageAnswer{key: key, accepted: accepted}:
+					case <-ctx.Done():
+					}
+				})
+				continue
+			}
+			im = receive(key, offer.ID, allPacketsCount, offer.Size)
+		}
+		im.seen = time.Now()
+
+		// duplicates are acknowledged again, as the ACK may have been lost
+		isNew := im.received.Add(imgPacket.Seq())
+		ack(p.conn, p.addr, &imgPacket, im.received)
+		if !isNew {
+			continue
+		}
 
-			packetsChan <- sharedPacket{imgPacket, addr}
-		}()
+		im.packets[rowOffset] = toStoredPacket(imgPacket)
+		im.update(im.received.Count(), allPacketsCount)
+
+		if im.received.Done() {
+			im.untrack()
+			reassembleImage(
+				im.packets,
+				imgPacket.Sender,
+				imgPacket.Filename,
+				imgPacket.Width,
+				imgPacket.Height,
+				out,
+			)
+			im.packets = nil
+			im.reassembled = time.Now()
+		}
 	}
 }
 
-func ack(conn net.PacketConn, addr net.Addr, imgPacket protocol.ImagePacket) {
-	ack := protocol.ImageACKPacket{
-		Username: imgPacket.Sender,
-		Filename: imgPacket.Filename,
-		Flag:     true,
-		Offset:   imgPacket.Offset,
-		Row:      imgPacket.Row,
+// validImagePacket reports whether p lies within an image of a size which is
+// accepted. The sides are bounded before anything is derived from them.
+func validImagePacket(p *protocol.ImagePacket) bool {
+	if p.Width == 0 || p.Height == 0 || p.Width > maxImageSide || p.Height > maxImageSide {
+		return false
+	}
+	if p.Row >= p.Height || p.Offset > (p.Width-1)/protocol.PayloadPixelsCount {
+		return false
 	}
+	return p.PacketsCount() <= maxImagePackets
+}
 
-	b, err := json.Marshal(ack)
+func ack(conn net.PacketConn, addr net.Addr, imgPacket *protocol.ImagePacket, received *protocol.Received) {
+	b, err := protocol.EncodeDatagram(protocol.KindImageACK, protocol.NewImageACK(imgPacket, received))
 	if err != nil {
 		panic(err)
 	}
@@ -158,6 +405,10 @@ func reassembleImage(
 	for _, packet := range packets {
 		for i := 0; i < protocol.PayloadPixelsCount; i++ {
 			col := packet.offset*protocol.PayloadPixelsCount + uint64(i)
+			if packet.row >= height || col >= width {
+				// the last packet of a row is padded
+				break
+			}
 			pixels[packet.row][col] = packet.pixels[i]
 		}
 	}
@@ -0,0 +1,31 @@
+package root
+
+import (
+	"testing"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+func TestValidImagePacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet protocol.ImagePacket
+		want   bool
+	}{
+		{"first", protocol.ImagePacket{Width: 600, Height: 400}, true},
+		{"last", protocol.ImagePacket{Width: 600, Height: 400, Row: 399, Offset: 2}, true},
+		{"largest", protocol.ImagePacket{Width: maxImageSide, Height: 4096}, true},
+		{"empty", protocol.ImagePacket{Width: 0, Height: 400}, false},
+		{"row beyond the image", protocol.ImagePacket{Width: 600, Height: 400, Row: 400}, false},
+		{"offset beyond the row", protocol.ImagePacket{Width: 600, Height: 400, Offset: 3}, false},
+		{"too many packets", protocol.ImagePacket{Width: maxImageSide, Height: maxImageSide}, false},
+		// its packet count and size overflow to 2 and 2048
+		{"overflowing", protocol.ImagePacket{Width: 512, Height: 1<<63 + 1}, false},
+		{"too wide", protocol.ImagePacket{Width: 1 << 62, Height: 1}, false},
+	}
+	for _, tt := range tests {
+		if got := validImagePacket(&tt.packet); got != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
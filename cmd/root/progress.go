@@ -0,0 +1,26 @@
+package root
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer/transfers/list"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+)
+
+const (
+	// progressInterval is how often the progress of the transfers is drawn.
+	progressInterval = 500 * time.Millisecond
+
+	barWidth = 20
+)
+
+// progressLine returns the progress bars of transfers, on a line.
+func progressLine(transfers []node.Progress) string {
+	bars := make([]string, len(transfers))
+	for i, p := range transfers {
+		filled := list.Percent(&p) * barWidth / 100
+		bars[i] = "[" + strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled) + "] " + list.Describe(&p)
+	}
+	return strings.Join(bars, " | ")
+}
@@ -2,26 +2,41 @@ package root
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"fmt"
 	"image"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/ArminGh02/golang-p2p-messenger/cmd/peer"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/contacts"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/history"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/imgutil"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/outbox"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/punch"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/resume"
 )
 
 var (
 	logger *logrus.Logger
 
-	tcpPort uint16
-	udpPort uint16
-	cfgFile string
+	tcpPort     uint16
+	udpPort     uint16
+	cfgFile     string
+	simulateNAT bool
 )
 
 func initConfig() {
@@ -47,10 +62,23 @@ func NewCommand(exitCmd *cobra.Command) *cobra.Command {
 
 	cmd.Flags().Uint16VarP(&tcpPort, "tcp-port", "t", 8081, "TCP port to listen on")
 	cmd.Flags().Uint16VarP(&udpPort, "udp-port", "u", 8082, "UDP port to listen on")
+	cmd.Flags().BoolVar(&simulateNAT, "simulate-nat", false, "drop UDP datagrams from addresses not sent to first, like a port-restricted cone NAT")
+	cmd.Flags().Int("max-frame-size", protocol.DefaultMaxFrameSize, "largest message in bytes accepted from other peers")
+	cmd.Flags().Bool("read-receipts", true, "tell senders when their messages are read")
+	cmd.Flags().Bool("auto-accept-contacts", false, "accept files from peers whose safety numbers were verified, without asking")
+	cmd.Flags().Bool("reject-unknown", false, "reject files from peers whose safety numbers weren't verified, without asking")
+	cmd.Flags().Uint64("max-incoming-size", 0, "largest file in bytes accepted from other peers, larger ones are rejected without asking (default is no limit)")
+	cmd.Flags().StringSlice("allowed-types", nil, "media types of the files accepted from other peers, like image/* or application/pdf, others are rejected without asking (default is all)")
 	cmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/config.yaml and current directory)")
 
 	viper.BindPFlag("tcp-port", cmd.Flags().Lookup("tcp-port"))
 	viper.BindPFlag("udp-port", cmd.Flags().Lookup("udp-port"))
+	viper.BindPFlag("max-frame-size", cmd.Flags().Lookup("max-frame-size"))
+	viper.BindPFlag("read-receipts", cmd.Flags().Lookup("read-receipts"))
+	viper.BindPFlag("auto-accept-contacts", cmd.Flags().Lookup("auto-accept-contacts"))
+	viper.BindPFlag("reject-unknown", cmd.Flags().Lookup("reject-unknown"))
+	viper.BindPFlag("max-incoming-size", cmd.Flags().Lookup("max-incoming-size"))
+	viper.BindPFlag("allowed-types", cmd.Flags().Lookup("allowed-types"))
 
 	logger = logrus.New()
 	logger.Out = cmd.OutOrStdout()
@@ -59,22 +87,102 @@ func NewCommand(exitCmd *cobra.Command) *cobra.Command {
 }
 
 func run(cmd *cobra.Command, args []string, exitCmd *cobra.Command) error {
-	txtChan := make(chan string)
+	if viper.GetInt("max-frame-size") <= 0 {
+		return errors.New("max-frame-size must be positive")
+	}
+
+	txtChan := make(chan node.Text)
 	imgChan := make(chan imageData)
+	fileChan := make(chan fileData)
 
 	defer close(txtChan)
 	defer close(imgChan)
+	defer close(fileChan)
+
+	idPath := filepath.Join(filepath.Dir(cfgFile), identity.FileName)
+	id, created, err := identity.LoadOrCreate(idPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to load identity")
+	}
+	if created {
+		logger.Infoln("Generated a new identity in", idPath)
+	}
+
+	contactsPath := filepath.Join(filepath.Dir(cfgFile), contacts.FileName)
+	pins, err := contacts.Open(contactsPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to load contacts")
+	}
+
+	outboxPath := filepath.Join(filepath.Dir(cfgFile), outbox.FileName)
+	queue, err := outbox.Open(outboxPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to load outbox")
+	}
+
+	chats, err := history.Open(history.Path(filepath.Dir(cfgFile), id.PublicKey()))
+	if err != nil {
+		return errors.Wrap(err, "unable to load history")
+	}
+
+	transfers, err := resume.Open(filepath.Join(filepath.Dir(cfgFile), resume.DirName))
+	if err != nil {
+		return errors.Wrap(err, "unable to load transfers")
+	}
 
-	go loopRunCommand(cmd, exitCmd)
-	go loopPrintOutput(cmd, txtChan, imgChan)
+	udpConn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", udpPort))
+	if err != nil {
+		return errors.Wrapf(err, "unable to start listening on port %d for UDP packets", udpPort)
+	}
+	if simulateNAT {
+		udpConn = punch.NewRestrictedConn(udpConn)
+	}
+
+	n := node.New(logger, id, pins, queue, chats, transfers, udpConn, &node.Config{
+		MaxFrameSize: viper.GetInt("max-frame-size"),
+		ReadReceipts: viper.GetBool("read-receipts"),
+		Consent: node.ConsentPolicy{
+			AutoAcceptContacts: viper.GetBool("auto-accept-contacts"),
+			RejectUnknown:      viper.GetBool("reject-unknown"),
+			MaxSize:            viper.GetUint64("max-incoming-size"),
+			AllowedTypes:       viper.GetStringSlice("allowed-types"),
+		},
+	})
+
+	go loopRunCommand(cmd, n, exitCmd)
+	go loopPrintOutput(cmd, n, txtChan, imgChan, fileChan)
+
+	// the listeners outlive the shell until the peer has deregistered
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	defer stopListening()
+
+	group, ctx := errgroup.WithContext(listenCtx)
+	group.Go(func() error { return loopReceiveText(ctx, n, txtChan) })
+	packets := make(chan receivedPacket)
+	group.Go(func() error { return loopReadUDP(ctx, udpConn, n) })
+	group.Go(func() error { return loopReceiveImage(ctx, n, packets) })
+	group.Go(func() error { return loopReassembleImages(ctx, n, packets, imgChan) })
+	group.Go(func() error { return loopReassembleFiles(ctx, n, transfers, fileChan) })
+	group.Go(func() error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-cmd.Context().Done():
+		}
+
+		deregisterCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := n.Deregister(deregisterCtx); err != nil {
+			logger.Errorln("Error deregistering:", "error", err)
+		}
 
-	group, ctx := errgroup.WithContext(cmd.Context())
-	group.Go(func() error { return loopReceiveText(ctx, txtChan) })
-	group.Go(func() error { return loopReceiveImage(ctx, imgChan) })
+		stopListening()
+		return nil
+	})
 	return group.Wait()
 }
 
-func loopRunCommand(cmd *cobra.Command, exitCmd *cobra.Command) {
+func loopRunCommand(cmd *cobra.Command, n *node.Node, exitCmd *cobra.Command) {
 	lines := make(chan string)
 
 	go func(lines chan<- string) {
@@ -85,15 +193,29 @@ func loopRunCommand(cmd *cobra.Command, exitCmd *cobra.Command) {
 	}(lines)
 
 	for {
-		cmd.Print(prompt() + " ")
+		cmd.Print(shellPrompt(n) + " ")
 		select {
 		case <-cmd.Context().Done():
 			return
 		case line := <-lines:
-			peerCmd := peer.NewCommand(exitCmd)
+			// whatever was printed before the user entered a line was read
+			n.MarkRead()
+
+			// a line answering the question asked in the prompt isn't a
+			// command
+			if offers := n.PendingOffers(); len(offers) > 0 {
+				if accept, ok := parseAnswer(line); ok {
+					if _, err := n.AnswerOffer(offers[0].ID.String(), accept); err != nil {
+						logger.Errorln("Error answering offer:", "error", err)
+					}
+					continue
+				}
+			}
+
+			peerCmd := peer.NewCommand(n, exitCmd)
 			args := strings.Fields(line)
 			peerCmd.SetArgs(args)
-			if err := peerCmd.Execute(); err != nil {
+			if err := peerCmd.ExecuteContext(cmd.Context()); err != nil {
 				logger.Errorln("Error executing command:", "error", err)
 				// break
 			}
@@ -110,29 +232,121 @@ type imageData struct {
 	username string
 }
 
-func loopPrintOutput(cmd *cobra.Command, txtChan <-chan string, imgChan <-chan imageData) {
+func loopPrintOutput(
+	cmd *cobra.Command,
+	n *node.Node,
+	txtChan <-chan node.Text,
+	imgChan <-chan imageData,
+	fileChan <-chan fileData,
+) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	// the progress of the transfers is drawn ahead of the prompt while there
+	// are any, with the prompt or the question waiting to be answered drawn
+	// again after it, and it's cleared before anything else is printed
+	var progressShown bool
+	clearProgress := func() {
+		if progressShown {
+			cmd.Print("\r\033[K" + shellPrompt(n) + " ")
+			progressShown = false
+		}
+	}
+
 	for {
 		select {
 		case <-cmd.Context().Done():
 			return
 
+		case <-ticker.C:
+			transfers := n.ActiveTransfers()
+			if len(transfers) == 0 {
+				clearProgress()
+				break
+			}
+			cmd.Print("\r\033[K" + progressLine(transfers) + " " + shellPrompt(n) + " ")
+			progressShown = true
+
+		case sent := <-n.SentFiles():
+			clearProgress()
+			if sent.Err != nil {
+				cmd.Printf("\rfailed to send %q to %q: %v\n%s ", sent.Filename, sent.Peer, sent.Err, shellPrompt(n))
+				break
+			}
+			if sent.Stats.Skipped > 0 {
+				cmd.Printf("\rresumed %q, %d packets had been received already\n", sent.Filename, sent.Stats.Skipped)
+			}
+			cmd.Printf(
+				"\rsent %q to %q in %s: %d packets, %d retransmitted, round trip %s\n%s ",
+				sent.Filename,
+				sent.Peer,
+				sent.Stats.Duration.Round(time.Millisecond),
+				sent.Stats.Packets,
+				sent.Stats.Retransmits,
+				sent.Stats.RTT.Round(time.Microsecond),
+				shellPrompt(n),
+			)
+
 		case img := <-imgChan:
-			f, err := os.Create("new" + img.filename)
+			clearProgress()
+			// the name stripped of any directories, as for files
+			f, err := os.Create("new" + filepath.Base(img.filename))
 			if err != nil {
 				logger.Error(err)
 				break
 			}
 
 			format := strings.ToLower(filepath.Ext(img.filename))
-			if err := imgutil.Encode(f, img, format); err != nil {
+			err = imgutil.Encode(f, img, format)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
 				logger.Error(err)
 				break
 			}
 
 			logger.Infof("received file %q from %q\n", img.filename, img.username)
 
+		case file := <-fileChan:
+			clearProgress()
+			// written byte for byte, the name stripped of any directories
+			name := "new" + filepath.Base(file.Filename)
+			if err := os.WriteFile(name, file.data, 0o644); err != nil {
+				logger.Error(err)
+				break
+			}
+
+			// decoded only to be described
+			if cfg, format, err := image.DecodeConfig(bytes.NewReader(file.data)); err == nil {
+				logger.Infof("received image %q from %q (%s, %dx%d, %d bytes)\n", file.Filename, file.username, format, cfg.Width, cfg.Height, len(file.data))
+			} else {
+				logger.Infof("received file %q from %q (%s, %d bytes)\n", file.Filename, file.username, file.MIMEType, len(file.data))
+			}
+
 		case txt := <-txtChan:
-			cmd.Printf("\rreceived message: %q\n%s ", txt, prompt())
+			clearProgress()
+			if txt.Time.IsZero() {
+				cmd.Printf("\rreceived message from %q: %q\n%s ", txt.From, txt.Text, shellPrompt(n))
+			} else {
+				cmd.Printf("\rreceived message from %q at %s: %q\n%s ", txt.From, txt.Time.Format(time.Kitchen), txt.Text, shellPrompt(n))
+			}
+			n.Delivered(txt)
+
+		case o := <-n.FileOffers():
+			clearProgress()
+			cmd.Printf(
+				"\r%q offers %q (%s), answer below or run transfers accept|reject %s\n%s ",
+				o.Peer,
+				o.Filename,
+				describeOffer(&o),
+				o.ID.Short(),
+				shellPrompt(n),
+			)
+
+		case sent := <-n.Statuses():
+			clearProgress()
+			cmd.Printf("\rmessage %s to %q %s\n%s ", sent.ID.Short(), sent.To, sent.Status, shellPrompt(n))
 		}
 	}
 }
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net"
 
-	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/node"
 )
 
-func loopReceiveText(ctx context.Context, out chan<- string) error {
+// loopReceiveText accepts connections from other peers, directly over TCP or
+// through relays, and passes on the texts received over them.
+func loopReceiveText(ctx context.Context, nd *node.Node, out chan<- node.Text) error {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", tcpPort))
 	if err != nil {
 		return err
@@ -24,33 +26,41 @@ func loopReceiveText(ctx context.Context, out chan<- string) error {
 	go func(conns chan<- connErrPair) {
 		for {
 			conn, err := listener.Accept()
-			conns <- connErrPair{conn, err}
+			select {
+			case conns <- connErrPair{conn, err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
 		}
 	}(conns)
 
-	errs := make(chan error)
-
 	for {
+		var conn net.Conn
 		select {
 		case <-ctx.Done():
 			return nil
 		case connErr := <-conns:
-			conn, err := connErr.conn, connErr.err
-			if err != nil {
-				return err
+			if connErr.err != nil {
+				return connErr.err
 			}
-
-			go func() {
-				defer conn.Close()
-				txt, err := protocol.ReceiveText(conn)
-				if err != nil {
-					errs <- err
-					return
-				}
-				out <- string(txt)
-			}()
-		case err := <-errs:
-			return err
+			conn = connErr.conn
+		case conn = <-nd.Streams():
+		case txt := <-nd.Texts():
+			select {
+			case out <- txt:
+			case <-ctx.Done():
+				return nil
+			}
+			continue
 		}
+
+		go func() {
+			if err := nd.ServePeer(ctx, conn); err != nil {
+				logger.Warnln("Rejected connection:", "error", err)
+			}
+		}()
 	}
 }
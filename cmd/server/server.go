@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/mailbox"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/peer"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/binding"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/file"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/memory"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/redis"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
+)
+
+var (
+	logger *logrus.Logger
+
+	cfgFile string
+)
+
+func initConfig() {
+	if cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+	} else {
+		viper.SetConfigName("stun")
+		viper.SetConfigType("yaml")
+		viper.AddConfigPath(".")
+	}
+
+	viper.SetEnvPrefix("stun")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+	viper.ReadInConfig()
+}
+
+func NewCommand() *cobra.Command {
+	cobra.OnInitialize(initConfig)
+
+	cmd := &cobra.Command{
+		Use:   "stun",
+		Short: "Discovery server of the p2p messenger",
+		RunE:  run,
+		// runtime errors aren't usage errors
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&cfgFile, "config", "c", "", "config file (default is stun.yaml in the current directory)")
+	flags.StringP("addr", "a", "localhost:8080", "address to listen on for HTTP")
+	flags.String("stun-addr", "localhost:3478", "UDP address to answer STUN binding requests on, empty to disable")
+	flags.String("relay-addr", "", "TCP address to relay traffic between peers on, empty to disable")
+	flags.Int("relay-rate", 256<<10, "bytes per second a relay may forward, 0 for no limit")
+	flags.StringP("backend", "b", "redis", "repository backend: redis, memory or file")
+	flags.String("file", "peers.json", "path of the file used by the file backend")
+	flags.String("keys-file", "keys.json", "path of the file the file backend stores the keys of username owners in")
+	flags.String("mailbox-file", "mailboxes.json", "path of the file the file backend stores mailboxes in")
+	flags.String("redis-url", "redis://localhost:6379", "URL of the Redis server")
+	flags.Int("redis-db", 0, "Redis database, overrides the one in --redis-url")
+	flags.String("redis-password", "", "Redis password, overrides the one in --redis-url")
+	flags.String("key-prefix", "", "prefix of the keys stored in Redis")
+	flags.Duration("lease-ttl", stun.DefaultLeaseTTL, "how long a registration lives without a heartbeat")
+	flags.Duration("ownership-ttl", 0, "how long a username stays bound to the key of its owner after its last renewal, 0 for forever")
+	flags.Duration("signal-wait", stun.DefaultSignalWait, "how long polls for signals are held open, must be less than --write-timeout")
+	flags.Bool("mailbox", false, "keep messages for offline peers")
+	flags.Duration("mailbox-retention", stun.DefaultMailboxRetention, "how long messages are kept in mailboxes")
+	flags.Int("mailbox-quota", stun.DefaultMailboxQuota, "bytes of messages kept for a peer")
+	flags.Int("mailbox-max-messages", stun.DefaultMailboxMaxMessages, "number of messages kept for a peer")
+	flags.Int("max-mail-size", stun.DefaultMaxMailSize, "largest message in bytes accepted in a mailbox")
+	flags.StringSlice("trusted-proxies", nil, "IPs or CIDRs of the proxies whose X-Forwarded-For header is trusted")
+	flags.Duration("read-timeout", 5*time.Second, "maximum duration for reading a request")
+	flags.Duration("write-timeout", 10*time.Second, "maximum duration for writing a response")
+	flags.Duration("idle-timeout", 120*time.Second, "how long to keep idle connections open")
+	flags.Duration("shutdown-timeout", 30*time.Second, "how long to wait for requests to finish on shutdown")
+	flags.String("log-level", "info", "log level: trace, debug, info, warn, error, fatal or panic")
+	flags.String("log-format", "text", "log format: text or json")
+
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name != "config" {
+			viper.BindPFlag(f.Name, f)
+		}
+	})
+
+	return cmd
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	var err error
+	logger, err = newLogger()
+	if err != nil {
+		return err
+	}
+
+	backend := viper.GetString("backend")
+	repo, err := newRepository[*peer.Peer](backend, "peer:", viper.GetString("file"))
+	if err != nil {
+		return errors.Wrap(err, "error instantiating repository")
+	}
+	defer repo.Close()
+
+	keys, err := newRepository[ed25519.PublicKey](backend, "key:", viper.GetString("keys-file"))
+	if err != nil {
+		return errors.Wrap(err, "error instantiating key repository")
+	}
+	defer keys.Close()
+
+	mailboxes, err := newRepository[*mailbox.Mailbox](backend, "mailbox:", viper.GetString("mailbox-file"))
+	if err != nil {
+		return errors.Wrap(err, "error instantiating mailbox repository")
+	}
+	defer mailboxes.Close()
+
+	pong, err := repo.Ping(cmd.Context())
+	if err != nil {
+		return errors.Wrap(err, "error pinging repository")
+	}
+
+	logger.Infof("Connected to %s repository: %s\n", backend, pong)
+
+	trustedProxies, err := stun.ParseTrustedProxies(viper.GetStringSlice("trusted-proxies"))
+	if err != nil {
+		return err
+	}
+
+	stun := stun.New(repo, keys, mailboxes, logger, &stun.Config{
+		LeaseTTL:           viper.GetDuration("lease-ttl"),
+		OwnershipTTL:       viper.GetDuration("ownership-ttl"),
+		TrustedProxies:     trustedProxies,
+		SignalWait:         viper.GetDuration("signal-wait"),
+		RelayAddr:          viper.GetString("relay-addr"),
+		RelayRate:          viper.GetInt("relay-rate"),
+		Mailbox:            viper.GetBool("mailbox"),
+		MailboxRetention:   viper.GetDuration("mailbox-retention"),
+		MailboxQuota:       viper.GetInt("mailbox-quota"),
+		MailboxMaxMessages: viper.GetInt("mailbox-max-messages"),
+		MaxMailSize:        viper.GetInt("max-mail-size"),
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/challenge/", stun.ChallengeHandler())
+	mux.Handle("/peer/", stun.PeerHandler())
+	mux.Handle("/punch/", stun.PunchHandler())
+	mux.Handle("/relay/", stun.RelayHandler())
+	mux.Handle("/signal/", stun.SignalHandler())
+	mux.Handle("/key/", stun.KeyHandler())
+	mux.Handle("/mailbox/", stun.MailboxHandler())
+	mux.Handle("/healthz", stun.HealthHandler())
+	mux.Handle("/readyz", stun.ReadyHandler())
+	mux.Handle("/metrics", stun.MetricsHandler())
+
+	srv := http.Server{
+		Addr:         viper.GetString("addr"),
+		Handler:      mux,
+		ErrorLog:     log.New(logger.WriterLevel(logrus.ErrorLevel), "", 0),
+		ReadTimeout:  viper.GetDuration("read-timeout"),
+		WriteTimeout: viper.GetDuration("write-timeout"),
+		IdleTimeout:  viper.GetDuration("idle-timeout"),
+	}
+
+	if stunAddr := viper.GetString("stun-addr"); stunAddr != "" {
+		conn, err := net.ListenPacket("udp", stunAddr)
+		if err != nil {
+			return errors.Wrapf(err, "unable to listen on %s for STUN", stunAddr)
+		}
+
+		go func() {
+			logger.Infoln("Starting STUN binding service on address", stunAddr)
+			if err := binding.NewServer(logger).Serve(cmd.Context(), conn); err != nil {
+				logger.Errorln("Error serving STUN:", "error", err)
+			}
+		}()
+	}
+
+	if relayAddr := viper.GetString("relay-addr"); relayAddr != "" {
+		l, err := net.Listen("tcp", relayAddr)
+		if err != nil {
+			return errors.Wrapf(err, "unable to listen on %s for relaying", relayAddr)
+		}
+
+		go func() {
+			logger.Infoln("Starting relay on address", relayAddr)
+			if err := stun.ServeRelay(cmd.Context(), l); err != nil {
+				logger.Errorln("Error serving relay:", "error", err)
+			}
+		}()
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-cmd.Context().Done()
+		logger.Infoln("Shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown-timeout"))
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	logger.Infoln("Starting server on address", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdownErr
+}
+
+func newLogger() (*logrus.Logger, error) {
+	logger := logrus.New()
+	logger.Out = os.Stdout
+
+	level, err := logrus.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		return nil, err
+	}
+	logger.SetLevel(level)
+
+	switch format := viper.GetString("log-format"); format {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return nil, errors.Errorf("unknown log format %q", format)
+	}
+
+	return logger, nil
+}
+
+// newRepository returns a repository of the backend. Repositories sharing a
+// Redis database are told apart by prefix, and file backed ones are stored
+// in path.
+func newRepository[T any](backend, prefix, path string) (repository.Repository[T], error) {
+	switch backend {
+	case "redis":
+		// the database in the URL is overridden by any set, database 0
+		// included
+		var db *int
+		if viper.IsSet("redis-db") {
+			n := viper.GetInt("redis-db")
+			db = &n
+		}
+		return redis.New[T](&redis.Config{
+			URL:       viper.GetString("redis-url"),
+			DB:        db,
+			Password:  viper.GetString("redis-password"),
+			KeyPrefix: viper.GetString("key-prefix") + prefix,
+		})
+	case "memory":
+		return memory.New[T](), nil
+	case "file":
+		return file.New[T](&file.Config{
+			Path: path,
+		})
+	default:
+		return nil, errors.Errorf("unknown backend %q", backend)
+	}
+}
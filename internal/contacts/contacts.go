@@ -0,0 +1,164 @@
+// Package contacts pins the identity keys of the peers talked to, trusting
+// the key a username is first seen with and refusing any other one until the
+// user says otherwise.
+package contacts
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/fsutil"
+)
+
+// FileName is the name of the file the contacts are stored in, next to the
+// config file of the peer.
+const FileName = "contacts.json"
+
+type Contact struct {
+	Username  string            `json:"username"`
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	FirstSeen time.Time         `json:"first_seen"`
+	// Verified is set once the user has compared safety numbers with the
+	// contact.
+	Verified bool `json:"verified,omitempty"`
+}
+
+// KeyChangedError is returned when a contact presents another key than the
+// pinned one.
+type KeyChangedError struct {
+	Username string
+	Pinned   ed25519.PublicKey
+	Seen     ed25519.PublicKey
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("identity key of %s has changed since it was pinned", e.Username)
+}
+
+// Store is the set of contacts stored in a file.
+type Store struct {
+	path string
+
+	mu       sync.Mutex
+	contacts map[string]*Contact
+}
+
+// Open loads the contacts stored at path. The file is created once a contact
+// is pinned.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:     path,
+		contacts: make(map[string]*Contact),
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []*Contact
+	if err := json.Unmarshal(b, &contacts); err != nil {
+		return nil, errors.Wrapf(err, "invalid contacts file %s", path)
+	}
+	for _, c := range contacts {
+		s.contacts[c.Username] = c
+	}
+	return s, nil
+}
+
+// Get returns a copy of the contact with username.
+func (s *Store) Get(username string) (Contact, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.contacts[username]
+	if !ok {
+		return Contact{}, false
+	}
+	return *c, true
+}
+
+// Check checks key against the one pinned for username, pinning it if
+// username is new. It returns a *KeyChangedError if another key is pinned.
+func (s *Store) Check(username string, key ed25519.PublicKey) (pinned bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.contacts[username]
+	if ok {
+		if !bytes.Equal(c.PublicKey, key) {
+			return false, &KeyChangedError{Username: username, Pinned: c.PublicKey, Seen: key}
+		}
+		return false, nil
+	}
+
+	s.contacts[username] = &Contact{
+		Username:  username,
+		PublicKey: key,
+		FirstSeen: time.Now().UTC(),
+	}
+	if err := s.save(); err != nil {
+		delete(s.contacts, username)
+		return false, err
+	}
+	return true, nil
+}
+
+// Trust pins key for username as verified by the user, replacing any key
+// pinned before.
+func (s *Store) Trust(username string, key ed25519.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.contacts[username]
+
+	c := &Contact{
+		Username:  username,
+		PublicKey: key,
+		FirstSeen: time.Now().UTC(),
+		Verified:  true,
+	}
+	if prev != nil && bytes.Equal(prev.PublicKey, key) {
+		c.FirstSeen = prev.FirstSeen
+	}
+	s.contacts[username] = c
+
+	if err := s.save(); err != nil {
+		if prev != nil {
+			s.contacts[username] = prev
+		} else {
+			delete(s.contacts, username)
+		}
+		return err
+	}
+	return nil
+}
+
+// save must be called with s.mu held.
+func (s *Store) save() error {
+	contacts := make([]*Contact, 0, len(s.contacts))
+	for _, c := range s.contacts {
+		contacts = append(contacts, c)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].Username < contacts[j].Username
+	})
+
+	b, err := json.MarshalIndent(contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(fsutil.WriteFile(s.path, b), "failed to save contacts")
+}
@@ -0,0 +1,166 @@
+package contacts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCheck(t *testing.T) {
+	pinned, other := newKey(t), newKey(t)
+
+	tests := []struct {
+		name       string
+		username   string
+		key        ed25519.PublicKey
+		wantPinned bool
+		wantErr    bool
+	}{
+		{name: "same key", username: "bob", key: pinned},
+		{name: "changed key", username: "bob", key: other, wantErr: true},
+		{name: "new contact", username: "carol", key: other, wantPinned: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), FileName)
+			s, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isNew, err := s.Check("bob", pinned); err != nil || !isNew {
+				t.Fatalf("pinning bob = %v, %v", isNew, err)
+			}
+
+			// checked against the file, as after a restart
+			s, err = Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			isNew, err := s.Check(tt.username, tt.key)
+			if isNew != tt.wantPinned {
+				t.Errorf("pinned = %v, want %v", isNew, tt.wantPinned)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var changed *KeyChangedError
+			if !errors.As(err, &changed) {
+				t.Fatalf("err = %v, want a KeyChangedError", err)
+			}
+			if changed.Username != tt.username || !changed.Pinned.Equal(pinned) || !changed.Seen.Equal(tt.key) {
+				t.Errorf("err = %+v", changed)
+			}
+			if c, _ := s.Get(tt.username); !c.PublicKey.Equal(pinned) {
+				t.Error("changed key replaced the pinned one")
+			}
+		})
+	}
+}
+
+func TestTrust(t *testing.T) {
+	pinned, other := newKey(t), newKey(t)
+
+	tests := []struct {
+		name string
+		key  ed25519.PublicKey
+		// wantSameFirstSeen is whether the contact keeps when it was first
+		// seen, as its key is the same.
+		wantSameFirstSeen bool
+	}{
+		{name: "pinned key", key: pinned, wantSameFirstSeen: true},
+		{name: "changed key", key: other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), FileName)
+			s, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Check("bob", pinned); err != nil {
+				t.Fatal(err)
+			}
+			before, _ := s.Get("bob")
+
+			if err := s.Trust("bob", tt.key); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, ok := s.Get("bob")
+			if !ok || !c.Verified || !c.PublicKey.Equal(tt.key) {
+				t.Fatalf("contact = %+v", c)
+			}
+			if c.FirstSeen.Equal(before.FirstSeen) != tt.wantSameFirstSeen {
+				t.Errorf("first seen %v, was %v", c.FirstSeen, before.FirstSeen)
+			}
+			if _, err := s.Check("bob", tt.key); err != nil {
+				t.Errorf("trusted key refused: %v", err)
+			}
+		})
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	a, b, c := newKey(t), newKey(t), newKey(t)
+
+	if SafetyNumber(a, b) != SafetyNumber(b, a) {
+		t.Error("safety number depends on the order of the keys")
+	}
+	if SafetyNumber(a, b) == SafetyNumber(a, c) {
+		t.Error("safety numbers of different keys are the same")
+	}
+	if Grid(a, b) != Grid(b, a) {
+		t.Error("grid depends on the order of the keys")
+	}
+
+	n := SafetyNumber(a, b)
+	if rows := strings.Split(n, "\n"); len(rows) != 3 || len(onlyDigits(n)) != 2*fingerprintGroups*5 {
+		t.Errorf("safety number laid out as %q", n)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	own, key, other := newKey(t), newKey(t), newKey(t)
+	number := SafetyNumber(own, key)
+
+	tests := []struct {
+		name   string
+		number string
+		want   bool
+	}{
+		{"safety number", number, true},
+		{"safety number on one line", strings.ReplaceAll(number, "\n", " "), true},
+		{"safety number without spaces", onlyDigits(number), true},
+		{"fingerprint", Fingerprint(key), true},
+		{"own fingerprint", Fingerprint(own), false},
+		{"safety number with another key", SafetyNumber(own, other), false},
+		{"part of the safety number", number[:20], false},
+		{"empty", "", false},
+		{"no digits", "yes", false},
+	}
+	for _, tt := range tests {
+		if got := Matches(own, key, tt.number); got != tt.want {
+			t.Errorf("%s: Matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package contacts
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// fingerprintGroups is how many groups of five digits a fingerprint has.
+const fingerprintGroups = 6
+
+// Fingerprint returns the digits identifying key, in groups of five.
+func Fingerprint(key ed25519.PublicKey) string {
+	return strings.Join(fingerprintDigits(key), " ")
+}
+
+func fingerprintDigits(key ed25519.PublicKey) []string {
+	h := sha256.Sum256(append([]byte("p2p-messenger fingerprint\n"), key...))
+
+	groups := make([]string, fingerprintGroups)
+	for i := range groups {
+		var chunk [8]byte
+		copy(chunk[3:], h[5*i:5*i+5])
+		groups[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk[:])%100000)
+	}
+	return groups
+}
+
+// SafetyNumber returns the number two peers compare to make sure they have
+// each other's keys. It's the same on both sides, whichever key is a and
+// which is b, and is laid out in rows of four groups of five digits.
+func SafetyNumber(a, b ed25519.PublicKey) string {
+	fa, fb := fingerprintDigits(a), fingerprintDigits(b)
+	if strings.Join(fa, "") > strings.Join(fb, "") {
+		fa, fb = fb, fa
+	}
+	groups := append(fa, fb...)
+
+	var sb strings.Builder
+	for i, g := range groups {
+		sb.WriteString(g)
+		switch {
+		case i == len(groups)-1:
+		case i%4 == 3:
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+// Matches reports whether number, as the user entered it, is the safety
+// number of own and key or the fingerprint of key. Anything but digits in it
+// is ignored.
+func Matches(own, key ed25519.PublicKey, number string) bool {
+	digits := onlyDigits(number)
+	if digits == "" {
+		return false
+	}
+	return digits == onlyDigits(SafetyNumber(own, key)) || digits == onlyDigits(Fingerprint(key))
+}
+
+func onlyDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// Grid draws the safety number of a and b as a square of blocks, which is
+// quicker to compare by eye than digits, like a QR code shown side by side.
+func Grid(a, b ed25519.PublicKey) string {
+	h := sha256.Sum256([]byte(strings.ReplaceAll(SafetyNumber(a, b), "\n", " ")))
+
+	const size = 16
+	var sb strings.Builder
+	for row := 0; row < size; row++ {
+		bits := binary.BigEndian.Uint16(h[2*row:])
+		for col := 0; col < size; col++ {
+			if bits&(1<<(size-1-col)) != 0 {
+				sb.WriteString("██")
+			} else {
+				sb.WriteString("  ")
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -0,0 +1,51 @@
+// Package fsutil holds helpers for the files the peer and the server keep
+// their state in.
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// WriteFile writes b to a file next to path, syncs it to disk and renames it
+// over path, so that after a crash path holds either what it held or b.
+func WriteFile(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir syncs the entries of dir to disk, so that a rename in it isn't
+// lost. Directories can't be synced on Windows.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
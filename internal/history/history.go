@@ -0,0 +1,198 @@
+// Package history records the texts sent and received by a peer, for them
+// to be listed and searched later.
+package history
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Direction is whether a text was sent or received.
+type Direction string
+
+const (
+	Incoming Direction = "in"
+	Outgoing Direction = "out"
+)
+
+// Record is a text sent or received. Later records with the same ID,
+// direction and peer update its status.
+type Record struct {
+	ID        string    `json:"id"`
+	Direction Direction `json:"direction"`
+	Peer      string    `json:"peer"`
+	Time      time.Time `json:"time"`
+	Text      string    `json:"text,omitempty"`
+	Status    string    `json:"status"`
+}
+
+// recordKey tells records apart by their peer too, as the IDs of the texts
+// received are picked by their senders and one may reuse another's.
+type recordKey struct {
+	direction Direction
+	peer      string
+	id        string
+}
+
+func (r *Record) key() recordKey {
+	return recordKey{direction: r.Direction, peer: r.Peer, id: r.ID}
+}
+
+// Path returns the path of the history of the identity owning key, in dir.
+// Every identity has its own, so that a new identity doesn't inherit the
+// history of the previous one.
+func Path(dir string, key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return filepath.Join(dir, "history-"+hex.EncodeToString(sum[:8])+".jsonl")
+}
+
+// Store is the history stored in a file of JSON lines, which records are
+// only ever appended to. Records are kept in the order they were added.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	records []*Record
+	byKey   map[recordKey]*Record
+}
+
+// Open loads the history stored at path. The file is created once a record
+// is added.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		byKey: make(map[recordKey]*Record),
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	good := 0
+	for line := 1; good < len(b); line++ {
+		end := bytes.IndexByte(b[good:], '\n')
+		var r Record
+		if end < 0 || json.Unmarshal(b[good:good+end], &r) != nil {
+			if end >= 0 && good+end+1 < len(b) {
+				return nil, errors.Errorf("invalid history file %s at line %d", path, line)
+			}
+			// the last line was cut short by a crash, it's dropped so that
+			// the next record starts on a line of its own
+			if err := os.Truncate(path, int64(good)); err != nil {
+				return nil, errors.Wrapf(err, "failed to repair history file %s", path)
+			}
+			break
+		}
+		s.apply(&r)
+		good += end + 1
+	}
+	return s, nil
+}
+
+// Add records r, or updates the status of the record with its ID and
+// direction.
+func (s *Store) Add(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(&r); err != nil {
+		return err
+	}
+	s.apply(&r)
+	return nil
+}
+
+// SetStatus updates the status of the record with id and direction,
+// exchanged with peer. It's a no-op if there's none.
+func (s *Store) SetStatus(peer, id string, direction Direction, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.byKey[recordKey{direction: direction, peer: peer, id: id}]
+	if !ok || r.Status == status {
+		return nil
+	}
+
+	update := &Record{ID: id, Direction: direction, Peer: r.Peer, Time: r.Time, Status: status}
+	if err := s.append(update); err != nil {
+		return err
+	}
+	r.Status = status
+	return nil
+}
+
+// Conversation returns the last limit records exchanged with peer since
+// since, oldest first. A limit of zero means no limit.
+func (s *Store) Conversation(peer string, since time.Time, limit int) []Record {
+	return s.filter(limit, func(r *Record) bool {
+		return r.Peer == peer && !r.Time.Before(since)
+	})
+}
+
+// Search returns the last limit records whose text contains query, ignoring
+// case, oldest first. A limit of zero means no limit.
+func (s *Store) Search(query string, limit int) []Record {
+	query = strings.ToLower(query)
+	return s.filter(limit, func(r *Record) bool {
+		return strings.Contains(strings.ToLower(r.Text), query)
+	})
+}
+
+func (s *Store) filter(limit int, match func(*Record) bool) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []Record
+	for i := len(s.records) - 1; i >= 0 && (limit <= 0 || len(records) < limit); i-- {
+		if match(s.records[i]) {
+			records = append(records, *s.records[i])
+		}
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records
+}
+
+// apply must be called with s.mu held.
+func (s *Store) apply(r *Record) {
+	if prev, ok := s.byKey[r.key()]; ok {
+		prev.Status = r.Status
+		return
+	}
+	s.records = append(s.records, r)
+	s.byKey[r.key()] = r
+}
+
+// append must be called with s.mu held.
+func (s *Store) append(r *Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open history")
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write history")
+	}
+	return f.Close()
+}
@@ -0,0 +1,139 @@
+// Package identity is the long-term Ed25519 key pair a peer proves the
+// ownership of its username with.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+// FileName is the name of the file the identity is stored in, next to the
+// config file of the peer.
+const FileName = "identity.pem"
+
+// Actions a challenge can be signed for.
+const (
+	ActionRegister   = "register"
+	ActionRenew      = "renew"
+	ActionDeregister = "deregister"
+)
+
+type Identity struct {
+	key ed25519.PrivateKey
+}
+
+func Generate() (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate identity key")
+	}
+	return &Identity{key: key}, nil
+}
+
+// Load reads the identity stored at path.
+func Load(path string) (*Identity, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.Errorf("no private key found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid private key in %s", path)
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("private key in %s is not an Ed25519 key", path)
+	}
+	return &Identity{key: edKey}, nil
+}
+
+// LoadOrCreate loads the identity stored at path, generating and storing a
+// new one if there's none yet.
+func LoadOrCreate(path string) (id *Identity, created bool, err error) {
+	id, err = Load(path)
+	if err == nil {
+		return id, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+
+	id, err = Generate()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := id.Save(path); err != nil {
+		return nil, false, err
+	}
+	return id, true, nil
+}
+
+// Save stores the identity at path, which must not exist yet.
+func (id *Identity) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create identity file")
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return errors.Wrapf(err, "failed to write identity to %s", path)
+	}
+	return f.Close()
+}
+
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.key.Public().(ed25519.PublicKey)
+}
+
+func (id *Identity) Sign(b []byte) []byte {
+	return ed25519.Sign(id.key, b)
+}
+
+// SharedSecret returns the X25519 shared secret of the identity key, as its
+// Montgomery form, and point. It lets messages be sealed to the identity
+// without a handshake.
+func (id *Identity) SharedSecret(point []byte) ([]byte, error) {
+	h := sha512.Sum512(id.key.Seed())
+	// X25519 clamps the scalar itself
+	return curve25519.X25519(h[:curve25519.ScalarSize], point)
+}
+
+// SignChallenge signs the nonce the server challenged username with, to
+// prove the ownership of username for action.
+func (id *Identity) SignChallenge(action, username, nonce string) []byte {
+	return ed25519.Sign(id.key, challengeMessage(action, username, nonce))
+}
+
+// VerifyChallenge checks a signature made with SignChallenge.
+func VerifyChallenge(key ed25519.PublicKey, action, username, nonce string, sig []byte) bool {
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(key, challengeMessage(action, username, nonce), sig)
+}
+
+// challengeMessage binds the signature to the action so that it can't be
+// replayed for another one.
+func challengeMessage(action, username, nonce string) []byte {
+	return []byte("p2p-messenger challenge\n" + action + "\n" + nonce + "\n" + username)
+}
@@ -0,0 +1,69 @@
+// Package mailbox holds the messages the discovery server keeps for peers
+// while they're offline. The server only ever sees them sealed to their
+// recipient.
+package mailbox
+
+import "time"
+
+// Envelope is a message sealed to its recipient.
+type Envelope struct {
+	// ID is chosen by the sender and unique in the mailbox of the recipient.
+	ID     string    `json:"id"`
+	From   string    `json:"from"`
+	Sealed []byte    `json:"sealed"`
+	Time   time.Time `json:"time"`
+}
+
+// Mailbox is the envelopes kept for a recipient, oldest first.
+type Mailbox struct {
+	Envelopes []*Envelope `json:"envelopes"`
+}
+
+// Size returns the bytes taken by the sealed envelopes.
+func (m *Mailbox) Size() int {
+	size := 0
+	for _, e := range m.Envelopes {
+		size += len(e.Sealed)
+	}
+	return size
+}
+
+// Expire drops the envelopes deposited more than retention ago.
+func (m *Mailbox) Expire(retention time.Duration) {
+	cutoff := time.Now().Add(-retention)
+	kept := m.Envelopes[:0]
+	for _, e := range m.Envelopes {
+		if e.Time.After(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	m.Envelopes = kept
+}
+
+// Remove drops the envelopes with ids and returns how many there were.
+func (m *Mailbox) Remove(ids []string) int {
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+
+	kept := m.Envelopes[:0]
+	for _, e := range m.Envelopes {
+		if !drop[e.ID] {
+			kept = append(kept, e)
+		}
+	}
+	removed := len(m.Envelopes) - len(kept)
+	m.Envelopes = kept
+	return removed
+}
+
+// Has reports whether there's an envelope with id.
+func (m *Mailbox) Has(id string) bool {
+	for _, e := range m.Envelopes {
+		if e.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package node
+
+import (
+	"mime"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/resume"
+)
+
+// Decision is what's done with a file a peer offers.
+type Decision int
+
+const (
+	// Ask asks the user whether to accept the file.
+	Ask Decision = iota
+	Accept
+	Reject
+)
+
+// ConsentPolicy decides which of the files and images peers offer are
+// accepted or rejected without asking the user. Contacts are the peers
+// whose safety numbers have been verified.
+type ConsentPolicy struct {
+	// AutoAcceptContacts accepts the files of contacts.
+	AutoAcceptContacts bool
+	// RejectUnknown rejects the files of peers who aren't contacts.
+	RejectUnknown bool
+	// MaxSize is the largest file accepted in bytes, zero for no limit but
+	// protocol.MaxFileSize.
+	MaxSize uint64
+	// AllowedTypes are the media types of the files accepted, like
+	// "application/pdf" or "image/*", empty for all.
+	AllowedTypes []string
+}
+
+// FileOffer is a file or image a peer wants to send.
+type FileOffer struct {
+	ID       protocol.FileID
+	Peer     string
+	Filename string
+	// MIMEType is the media type of the file as the peer tells it, empty if
+	// it doesn't.
+	MIMEType string
+	Size     uint64
+	Offered  time.Time
+}
+
+// offerQueueSize is how many offers wait at most to be told of through
+// FileOffers. The ones beyond are only listed as pending.
+const offerQueueSize = 16
+
+func (o *FileOffer) key() transferKey {
+	return transferKey{id: o.ID, peer: o.Peer, incoming: true}
+}
+
+type pendingOffer struct {
+	FileOffer
+	answer func(accepted bool)
+}
+
+// Consent decides whether o is accepted, rejected or asked about by the
+// policy, and returns why it's rejected.
+func (n *Node) Consent(o *FileOffer) (Decision, string) {
+	policy := &n.cfg.Consent
+	c, known := n.contacts.Get(o.Peer)
+	contact := known && c.Verified
+
+	switch {
+	case policy.MaxSize > 0 && o.Size > policy.MaxSize:
+		return Reject, "larger than the maximum size"
+	case !typeAllowed(policy.AllowedTypes, o.MIMEType, o.Filename):
+		return Reject, "type not accepted"
+	case policy.RejectUnknown && !contact:
+		return Reject, "not from a contact"
+	case policy.AutoAcceptContacts && contact:
+		return Accept, ""
+	}
+	return Ask, ""
+}
+
+// typeAllowed reports whether a file named filename of mimeType matches one
+// of patterns. The type its extension stands for must match too, as it's
+// what the file is saved as.
+func typeAllowed(patterns []string, mimeType, filename string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	types := []string{mimeType}
+	if byExt := mime.TypeByExtension(filepath.Ext(filename)); byExt != "" {
+		types = append(types, byExt)
+	}
+	for _, t := range types {
+		mediaType, _, err := mime.ParseMediaType(t)
+		if err != nil {
+			mediaType = "application/octet-stream"
+		}
+		if !matchesType(patterns, mediaType) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesType(patterns []string, mediaType string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch {
+		case p == "*" || p == "*/*" || p == mediaType:
+			return true
+		case strings.HasSuffix(p, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(p, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// Offer asks the user whether to accept o, telling of it through
+// FileOffers unless too many offers are waiting to be told of already.
+// answer is called with the user's choice, unless withdraw is called first
+// as the peer has given up on sending it.
+func (n *Node) Offer(o FileOffer, answer func(accepted bool)) (withdraw func()) {
+	o.Offered = time.Now()
+
+	p := &pendingOffer{FileOffer: o, answer: answer}
+	n.pendingMu.Lock()
+	n.pending[o.key()] = p
+	n.pendingMu.Unlock()
+
+	select {
+	case n.fileOffers <- o:
+	default:
+		n.logger.Warnf("Too many offers waiting, %q from %q is only listed in transfers\n", o.Filename, o.Peer)
+	}
+
+	return func() {
+		n.pendingMu.Lock()
+		defer n.pendingMu.Unlock()
+
+		if n.pending[o.key()] == p {
+			delete(n.pending, o.key())
+		}
+	}
+}
+
+// FileOffers returns the files and images offered by peers which the user
+// is asked about.
+func (n *Node) FileOffers() <-chan FileOffer {
+	return n.fileOffers
+}
+
+// PendingOffers returns the offers waiting to be answered, oldest first.
+func (n *Node) PendingOffers() []FileOffer {
+	n.pendingMu.Lock()
+	offers := make([]FileOffer, 0, len(n.pending))
+	for _, o := range n.pending {
+		offers = append(offers, o.FileOffer)
+	}
+	n.pendingMu.Unlock()
+
+	sort.Slice(offers, func(i, j int) bool {
+		return offers[i].Offered.Before(offers[j].Offered)
+	})
+	return offers
+}
+
+// AnswerOffer accepts or rejects the offer whose ID starts with prefix.
+func (n *Node) AnswerOffer(prefix string, accept bool) (FileOffer, error) {
+	n.pendingMu.Lock()
+	var found *pendingOffer
+	for _, o := range n.pending {
+		if !strings.HasPrefix(o.ID.String(), prefix) {
+			continue
+		}
+		if found != nil {
+			n.pendingMu.Unlock()
+			return FileOffer{}, resume.ErrAmbiguous
+		}
+		found = o
+	}
+	n.pendingMu.Unlock()
+
+	if found == nil || !n.answerOffer(found.key(), accept) {
+		return FileOffer{}, resume.ErrNotFound
+	}
+	return found.FileOffer, nil
+}
+
+// answerOffer answers the offer with key, and reports whether it was still
+// waiting to be answered.
+func (n *Node) answerOffer(key transferKey, accept bool) bool {
+	n.pendingMu.Lock()
+	o, ok := n.pending[key]
+	delete(n.pending, key)
+	n.pendingMu.Unlock()
+
+	if ok {
+		o.answer(accept)
+	}
+	return ok
+}
@@ -0,0 +1,159 @@
+package node
+
+import (
+	"context"
+	"image/color"
+	"net"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/peer"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+// ConnectTransfer finds a UDP path to p, punching a hole to it or relaying
+// if that fails, and keys a transfer to it over the path as OpenTransfer
+// does. done must be called once the transfer is over.
+func (n *Node) ConnectTransfer(ctx context.Context, p *peer.Peer) (sealed net.PacketConn, addr net.Addr, done func(), err error) {
+	var (
+		conn     net.PacketConn = n.UDPConn()
+		closeRaw                = func() {}
+	)
+	addr, err = n.Punch(ctx, p.Username)
+	if err != nil {
+		n.logger.Warnf("Could not punch a hole to %s, relaying: %v\n", p.Username, err)
+
+		relayConn, relayErr := n.Relay(ctx, p.Username)
+		if relayErr == nil {
+			conn, addr = relayConn, relayConn.RemoteAddr()
+			closeRaw = func() { relayConn.CloseWrite() }
+		} else {
+			n.logger.Warnf("Could not relay to %s, sending directly: %v\n", p.Username, relayErr)
+
+			candidates := p.UDPCandidates(n.PublicIP())
+			if len(candidates) == 0 {
+				return nil, nil, nil, errors.Errorf("peer %s has no UDP address", p.Username)
+			}
+			addr, err = net.ResolveUDPAddr("udp", candidates[0])
+			if err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "invalid UDP address %q of peer %s", candidates[0], p.Username)
+			}
+		}
+	}
+
+	sealed, doneTransfer, err := n.OpenTransfer(ctx, conn, addr, p)
+	if err != nil {
+		closeRaw()
+		return nil, nil, nil, err
+	}
+	return sealed, addr, func() {
+		doneTransfer()
+		closeRaw()
+	}, nil
+}
+
+// SendFile starts sending data, described by m, to p over UDP once a path to
+// it has been found, and returns the ID of the transfer. The file is sent in
+// the background, and how it went is told through SentFiles. It's kept track
+// of until it's been received, and if it was being sent to p already, only
+// what p hasn't received of it is sent.
+func (n *Node) SendFile(ctx context.Context, p *peer.Peer, m *protocol.Manifest, data []byte) (protocol.FileID, error) {
+	if protocol.NegotiateVersion(p.WireVersion) < protocol.ChunkVersion {
+		return protocol.FileID{}, errors.Errorf("%s runs a version too old to receive files", p.Username)
+	}
+
+	conn, addr, done, err := n.ConnectTransfer(ctx, p)
+	if err != nil {
+		return protocol.FileID{}, err
+	}
+
+	m, _, err = n.resume.Send(p.Username, m)
+	if err != nil {
+		done()
+		return protocol.FileID{}, err
+	}
+
+	acks, doneACKs := n.FileACKs(m.ID)
+	progress := Progress{ID: m.ID, Peer: p.Username, Filename: m.Filename, Size: m.Size}
+	n.sendInBackground(ctx, progress, func(sendCtx context.Context, update protocol.ProgressFunc) (protocol.SendStats, error) {
+		defer done()
+		defer doneACKs()
+
+		stats, err := protocol.SendFile(sendCtx, conn, addr, acks, m, data, update)
+		// kept to be resumed if the peer is only exiting
+		cancelled := sendCtx.Err() != nil && ctx.Err() == nil
+		if cancelled {
+			// told to the receiver, which ignores it if it's the one who
+			// cancelled
+			sendCancel(conn, addr, m.ID)
+		}
+		if err == nil || cancelled {
+			if err := n.resume.Remove(p.Username, false, m.ID); err != nil {
+				n.logger.Warnf("Error forgetting file %s sent to %s: %v\n", m.ID.Short(), p.Username, err)
+			}
+		}
+		return stats, err
+	})
+	return m.ID, nil
+}
+
+// SendPixels starts sending the pixels of an image to p over UDP, as peers
+// older than protocol.ChunkVersion receive images, like SendFile does with
+// files. It can't be resumed, and cancelling it isn't told to p.
+func (n *Node) SendPixels(ctx context.Context, p *peer.Peer, pixels [][]color.RGBA, filename string, sender string) (protocol.FileID, error) {
+	conn, addr, done, err := n.ConnectTransfer(ctx, p)
+	if err != nil {
+		return protocol.FileID{}, err
+	}
+
+	acks, doneACKs := n.ImageACKs(filename)
+	progress := Progress{
+		ID:       protocol.NewFileID(),
+		Peer:     p.Username,
+		Filename: filename,
+	}
+	if len(pixels) > 0 {
+		progress.Size = uint64(len(pixels) * len(pixels[0]) * 4)
+	}
+	n.sendInBackground(ctx, progress, func(sendCtx context.Context, update protocol.ProgressFunc) (protocol.SendStats, error) {
+		defer done()
+		defer doneACKs()
+
+		return protocol.SendImage(sendCtx, conn, addr, acks, pixels, filename, sender, update)
+	})
+	return progress.ID, nil
+}
+
+// sendInBackground runs send as the transfer described by p, tracking it
+// until it's over and telling how it went through SentFiles.
+func (n *Node) sendInBackground(
+	ctx context.Context,
+	p Progress,
+	send func(ctx context.Context, update protocol.ProgressFunc) (protocol.SendStats, error),
+) {
+	sendCtx, cancel := context.WithCancel(ctx)
+	update, untrack := n.Track(p, cancel)
+
+	go func() {
+		defer cancel()
+
+		stats, err := send(sendCtx, update)
+		p, cancelled := untrack()
+		if cancelled != nil {
+			err = cancelled
+		}
+
+		select {
+		case n.sentFiles <- SentFile{Progress: p, Stats: stats, Err: err}:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func sendCancel(conn net.PacketConn, addr net.Addr, id protocol.FileID) {
+	b, err := protocol.EncodeDatagram(protocol.KindCancel, protocol.Cancel{ID: id})
+	if err != nil {
+		panic(err)
+	}
+	conn.WriteTo(b, addr)
+}
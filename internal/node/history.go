@@ -0,0 +1,90 @@
+package node
+
+import (
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/history"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+// Statuses of received texts in the history.
+const (
+	statusReceived = "received"
+	statusRead     = "read"
+)
+
+// History returns the record of the texts sent and received.
+func (n *Node) History() *history.Store {
+	return n.history
+}
+
+func (n *Node) recordSent(t SentText) {
+	n.historyMu.Lock()
+	defer n.historyMu.Unlock()
+
+	// receipts which came before the text was recorded couldn't update it
+	t.Status = n.latestStatus(t)
+
+	err := n.history.Add(history.Record{
+		ID:        t.ID.String(),
+		Direction: history.Outgoing,
+		Peer:      t.To,
+		Time:      t.Time,
+		Text:      t.Text,
+		Status:    t.Status.String(),
+	})
+	if err != nil {
+		n.logger.Warnf("Error recording message %s to %s: %v\n", t.ID.Short(), t.To, err)
+	}
+}
+
+func (n *Node) recordStatus(t SentText) {
+	n.historyMu.Lock()
+	defer n.historyMu.Unlock()
+
+	t.Status = n.latestStatus(t)
+	if err := n.history.SetStatus(t.To, t.ID.String(), history.Outgoing, t.Status.String()); err != nil {
+		n.logger.Warnf("Error recording status of message %s to %s: %v\n", t.ID.Short(), t.To, err)
+	}
+}
+
+// latestStatus returns the status of t, unless a receipt has advanced it
+// since t was copied.
+func (n *Node) latestStatus(t SentText) Status {
+	n.sentMu.Lock()
+	defer n.sentMu.Unlock()
+
+	if tracked, ok := n.sent[t.ID]; ok && tracked.Status > t.Status {
+		return tracked.Status
+	}
+	return t.Status
+}
+
+func (n *Node) recordReceived(t Text) {
+	// texts of older peers have no ID or time
+	id, at := t.ID, t.Time
+	if id.IsZero() {
+		id = protocol.NewMessageID()
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	err := n.history.Add(history.Record{
+		ID:        id.String(),
+		Direction: history.Incoming,
+		Peer:      t.From,
+		Time:      at,
+		Text:      t.Text,
+		Status:    statusReceived,
+	})
+	if err != nil {
+		n.logger.Warnf("Error recording message from %s: %v\n", t.From, err)
+	}
+}
+
+func (n *Node) recordRead(t Text) {
+	if err := n.history.SetStatus(t.From, t.ID.String(), history.Incoming, statusRead); err != nil {
+		n.logger.Warnf("Error recording message %s from %s as read: %v\n", t.ID.Short(), t.From, err)
+	}
+}
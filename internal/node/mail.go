@@ -0,0 +1,182 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/mailbox"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/secure"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/client"
+)
+
+// noSuchPeerError is returned for mail to a username no one owns.
+type noSuchPeerError string
+
+func (e noSuchPeerError) Error() string {
+	return "there is no peer with username " + string(e)
+}
+
+// SendMail leaves text for username in its mailbox on the discovery server,
+// sealed to its identity key, for it to read once it's back online.
+func (n *Node) SendMail(ctx context.Context, username string, text string) (SentText, error) {
+	t := SentText{
+		ID:     protocol.NewMessageID(),
+		To:     username,
+		Text:   text,
+		Time:   time.Now(),
+		Status: StatusFailed,
+	}
+
+	n.mu.Lock()
+	c, lease := n.client, n.lease
+	n.mu.Unlock()
+
+	if lease == nil {
+		return t, ErrNotRegistered
+	}
+
+	key, err := n.mailKey(ctx, c, username)
+	if err != nil {
+		return t, err
+	}
+
+	m := &protocol.Message{ID: t.ID, Sent: t.Time, Text: t.Text}
+	b, _ := m.MarshalBinary()
+	sealed, err := secure.SealMail(n.identity, lease.Username, username, key, b)
+	if err != nil {
+		return t, err
+	}
+
+	err = c.PostMail(ctx, lease.Token(), username, &mailbox.Envelope{
+		ID:     t.ID.String(),
+		From:   lease.Username,
+		Sealed: sealed,
+	})
+	if err != nil {
+		return t, err
+	}
+
+	t.Status = StatusStored
+	return t, nil
+}
+
+// mailKey returns the key to seal mail to username with, which is the one
+// pinned for it if any.
+func (n *Node) mailKey(ctx context.Context, c *client.Client, username string) (ed25519.PublicKey, error) {
+	if contact, ok := n.contacts.Get(username); ok {
+		return contact.PublicKey, nil
+	}
+
+	key, err := c.Key(ctx, username)
+	if errors.Is(err, client.ErrNotFound) {
+		return nil, noSuchPeerError(username)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up the key of %s", username)
+	}
+	return key, n.checkPin(username, key)
+}
+
+// DrainMailbox passes on the texts kept for the peer while it was offline
+// to Texts, and removes them from its mailbox. Mail whose sender's key
+// can't be looked up right now is left in it for the next time. It returns
+// how many texts there were.
+func (n *Node) DrainMailbox(ctx context.Context) (int, error) {
+	n.mu.Lock()
+	c, lease := n.client, n.lease
+	n.mu.Unlock()
+
+	if lease == nil {
+		return 0, ErrNotRegistered
+	}
+
+	envelopes, err := c.Mail(ctx, lease.Username, lease.Token())
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		ids   = make([]string, 0, len(envelopes))
+		texts = make([]Text, 0, len(envelopes))
+	)
+	for _, e := range envelopes {
+		from, b, err := secure.OpenMail(n.identity, lease.Username, e.Sealed, func(username string, key ed25519.PublicKey) error {
+			return n.verifyMailSender(ctx, c, username, key)
+		})
+		if err == nil && from != e.From {
+			err = errors.Errorf("sealed by %s, not %s", from, e.From)
+		}
+		var m protocol.Message
+		if err == nil {
+			err = m.UnmarshalBinary(b)
+		}
+
+		var lookup *lookupError
+		if errors.As(err, &lookup) {
+			// left in the mailbox to be opened the next time
+			n.logger.Warnf("Keeping mail from %s: %v\n", e.From, err)
+			continue
+		}
+		// dropped if it can't ever be opened, or it'd be retried forever
+		ids = append(ids, e.ID)
+		if err != nil {
+			n.logger.Warnf("Dropping mail from %s: %v\n", e.From, err)
+			continue
+		}
+
+		texts = append(texts, Text{From: from, ID: m.ID, Time: m.Sent, Text: m.Text})
+	}
+
+	for _, t := range texts {
+		n.recordReceived(t)
+		select {
+		case n.texts <- t:
+		case <-ctx.Done():
+			// left in the mailbox for the next time
+			return 0, ctx.Err()
+		}
+	}
+
+	if len(ids) > 0 {
+		if err := c.DeleteMail(ctx, lease.Username, lease.Token(), ids); err != nil {
+			return len(texts), err
+		}
+	}
+	return len(texts), nil
+}
+
+// lookupError is a failure to look up the key of the sender of mail, which
+// may well succeed later.
+type lookupError struct {
+	error
+}
+
+func (e *lookupError) Unwrap() error {
+	return e.error
+}
+
+// verifyMailSender checks that key owns username, as told by the discovery
+// server or pinned if the server has forgotten the owner.
+func (n *Node) verifyMailSender(ctx context.Context, c *client.Client, username string, key ed25519.PublicKey) error {
+	owner, err := c.Key(ctx, username)
+	if errors.Is(err, client.ErrNotFound) {
+		if contact, ok := n.contacts.Get(username); ok {
+			owner, err = contact.PublicKey, nil
+		}
+	}
+	if errors.Is(err, client.ErrNotFound) {
+		return errors.Errorf("%s has no owner to check the key of", username)
+	}
+	if err != nil {
+		return &lookupError{errors.Wrapf(err, "failed to look up the key of %s", username)}
+	}
+	if !bytes.Equal(owner, key) {
+		return errors.Errorf("%s sealed it with a key it doesn't own", username)
+	}
+	return n.checkPin(username, key)
+}
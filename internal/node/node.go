@@ -0,0 +1,643 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/contacts"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/history"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/outbox"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/peer"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/punch"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/relay"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/resume"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/secure"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/binding"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/client"
+)
+
+// PunchTimeout bounds how long hole punching is attempted.
+const PunchTimeout = 10 * time.Second
+
+type Config struct {
+	// MaxFrameSize is the largest message accepted from other peers.
+	MaxFrameSize int
+	// ReadReceipts is whether senders are told when their texts are read.
+	ReadReceipts bool
+	// Consent decides which files peers offer are accepted without asking.
+	Consent ConsentPolicy
+}
+
+var ErrNotRegistered = errors.New("not registered, run start first")
+
+// Node is the runtime state of the local peer which is shared between the
+// shell's receivers and the commands it runs.
+type Node struct {
+	cfg      *Config
+	logger   *logrus.Logger
+	identity *identity.Identity
+	contacts *contacts.Store
+	udpConn  net.PacketConn
+	binding  *binding.Client
+	puncher  *punch.Puncher
+
+	mu          sync.Mutex
+	client      *client.Client
+	lease       *client.Lease
+	stopSignals context.CancelFunc
+
+	acksMu   sync.Mutex
+	acks     map[string]chan protocol.ImageACKPacket
+	fileACKs map[protocol.FileID]chan protocol.ChunkACK
+
+	transfersMu sync.Mutex
+	transfers   map[string]*transfer
+	offers      map[string]chan *secure.TransferAccept
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
+
+	sentMu sync.Mutex
+	sent   map[protocol.MessageID]*SentText
+
+	unreadMu sync.Mutex
+	unread   []Text
+
+	// seen are the texts received lately, oldest first in seenOrder.
+	seenMu    sync.Mutex
+	seen      map[textKey]struct{}
+	seenOrder []textKey
+
+	outbox      *outbox.Store
+	retryOutbox chan struct{}
+
+	resume *resume.Store
+
+	// progress are the files and images being sent and received.
+	progressMu sync.Mutex
+	progress   map[transferKey]*trackedTransfer
+
+	// pending are the files offered by peers which the user hasn't answered.
+	pendingMu sync.Mutex
+	pending   map[transferKey]*pendingOffer
+
+	// historyMu orders the statuses recorded in history.
+	historyMu sync.Mutex
+	history   *history.Store
+
+	images     chan Datagram
+	files      chan Datagram
+	streams    chan net.Conn
+	texts      chan Text
+	statuses   chan SentText
+	sentFiles  chan SentFile
+	fileOffers chan FileOffer
+}
+
+// datagramQueueSize is how many packets of images and files wait at most to
+// be reassembled. Beyond that they're dropped for their senders to resend, so
+// that the socket is never left unread.
+const datagramQueueSize = 1024
+
+// Datagram is a packet of an image or file a peer sent, opened. Replies to
+// it must be written to Conn, which seals them.
+type Datagram struct {
+	B    []byte
+	Addr net.Addr
+	Conn net.PacketConn
+	// Peer is the username of the sender, which it has proven it owns.
+	Peer string
+}
+
+// New returns the node of a peer identified by id listening for UDP on
+// udpConn. The keys of the peers it talks to are pinned in contacts, the
+// texts it couldn't send yet are queued in outbox, all the texts it sends
+// and receives are recorded in history, and the files it sends are kept
+// track of in resume until they've been received.
+func New(
+	logger *logrus.Logger,
+	id *identity.Identity,
+	contacts *contacts.Store,
+	outbox *outbox.Store,
+	history *history.Store,
+	resume *resume.Store,
+	udpConn net.PacketConn,
+	cfg *Config,
+) *Node {
+	return &Node{
+		cfg:         cfg,
+		logger:      logger,
+		identity:    id,
+		contacts:    contacts,
+		udpConn:     udpConn,
+		binding:     binding.NewClient(udpConn),
+		puncher:     punch.New(udpConn),
+		acks:        make(map[string]chan protocol.ImageACKPacket),
+		fileACKs:    make(map[protocol.FileID]chan protocol.ChunkACK),
+		transfers:   make(map[string]*transfer),
+		offers:      make(map[string]chan *secure.TransferAccept),
+		sessions:    make(map[string]*session),
+		images:      make(chan Datagram, datagramQueueSize),
+		files:       make(chan Datagram, datagramQueueSize),
+		streams:     make(chan net.Conn),
+		sent:        make(map[protocol.MessageID]*SentText),
+		seen:        make(map[textKey]struct{}),
+		outbox:      outbox,
+		history:     history,
+		resume:      resume,
+		progress:    make(map[transferKey]*trackedTransfer),
+		pending:     make(map[transferKey]*pendingOffer),
+		retryOutbox: make(chan struct{}, 1),
+		texts:       make(chan Text),
+		statuses:    make(chan SentText),
+		sentFiles:   make(chan SentFile),
+		fileOffers:  make(chan FileOffer, offerQueueSize),
+	}
+}
+
+func (n *Node) Identity() *identity.Identity {
+	return n.identity
+}
+
+func (n *Node) Contacts() *contacts.Store {
+	return n.contacts
+}
+
+// Binding returns the STUN client of the node's UDP socket.
+func (n *Node) Binding() *binding.Client {
+	return n.binding
+}
+
+// UDPConn returns the socket the node listens for UDP on. Datagrams to other
+// peers must be sent from it, as it's the one the NAT holes are punched for.
+func (n *Node) UDPConn() net.PacketConn {
+	return n.udpConn
+}
+
+// Register registers the peer on the discovery server and keeps its lease
+// alive until ctx is done or the node is registered again.
+func (n *Node) Register(ctx context.Context, c *client.Client, req *request.PostPeer) error {
+	// n.mu isn't held across the round trips to the server, so that the
+	// node's other calls aren't held up by them
+	if err := n.release(ctx); err != nil {
+		n.logger.Warnln("Error releasing previous registration:", "error", err)
+	}
+
+	reg, err := c.Register(ctx, req, n.identity)
+	if err != nil {
+		return err
+	}
+	lease := c.KeepAlive(ctx, req, reg, n.identity, n.logger)
+	signalsCtx, stopSignals := context.WithCancel(ctx)
+
+	n.mu.Lock()
+	prev, stopPrev := n.lease, n.stopSignals
+	n.client = c
+	n.lease = lease
+	n.stopSignals = stopSignals
+	n.mu.Unlock()
+
+	// the node was registered again meanwhile
+	if prev != nil {
+		if err := n.releaseLease(ctx, prev, stopPrev); err != nil {
+			n.logger.Warnln("Error releasing previous registration:", "error", err)
+		}
+	}
+
+	go n.loopSignals(signalsCtx, c, lease)
+	go n.loopOutbox(signalsCtx)
+
+	return nil
+}
+
+// Deregister removes the registration of the peer from the discovery server.
+// It's a no-op if the peer isn't registered.
+func (n *Node) Deregister(ctx context.Context) error {
+	return n.release(ctx)
+}
+
+// release takes the lease off the node and releases it, if it's registered.
+func (n *Node) release(ctx context.Context) error {
+	n.mu.Lock()
+	lease, stopSignals := n.lease, n.stopSignals
+	n.lease = nil
+	n.client = nil
+	n.stopSignals = nil
+	n.mu.Unlock()
+
+	if lease == nil {
+		return nil
+	}
+	return n.releaseLease(ctx, lease, stopSignals)
+}
+
+func (n *Node) releaseLease(ctx context.Context, lease *client.Lease, stopSignals context.CancelFunc) error {
+	stopSignals()
+	n.closeSessions()
+	return lease.Release(ctx)
+}
+
+// PublicIP returns the address the discovery server saw this peer at, or an
+// empty string if the peer isn't registered.
+func (n *Node) PublicIP() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.lease == nil {
+		return ""
+	}
+	return n.lease.ObservedIP
+}
+
+// Punch opens a UDP path to target through the NATs in between, with the
+// discovery server telling both sides to probe each other.
+func (n *Node) Punch(ctx context.Context, target string) (net.Addr, error) {
+	n.mu.Lock()
+	c, lease := n.client, n.lease
+	n.mu.Unlock()
+
+	if lease == nil {
+		return nil, ErrNotRegistered
+	}
+
+	resp, err := c.Punch(ctx, lease.Username, lease.Token(), target)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, PunchTimeout)
+	defer cancel()
+	return n.puncher.Punch(ctx, resp.ID, lease.Username, target, resp.Peer.UDPCandidates(lease.ObservedIP))
+}
+
+// Relay connects to target through the relay of the discovery server. The
+// returned connection must be closed for writing once everything is sent.
+func (n *Node) Relay(ctx context.Context, target string) (*relay.Conn, error) {
+	conn, err := n.relay(ctx, target, false)
+	if err != nil {
+		return nil, err
+	}
+
+	go n.loopRelay(ctx, conn)
+	return conn, nil
+}
+
+// RelayStream is like Relay for a byte stream.
+func (n *Node) RelayStream(ctx context.Context, target string) (*relay.Stream, error) {
+	conn, err := n.relay(ctx, target, true)
+	if err != nil {
+		return nil, err
+	}
+	return relay.NewStream(conn), nil
+}
+
+func (n *Node) relay(ctx context.Context, target string, stream bool) (*relay.Conn, error) {
+	n.mu.Lock()
+	c, lease := n.client, n.lease
+	n.mu.Unlock()
+
+	if lease == nil {
+		return nil, ErrNotRegistered
+	}
+
+	resp, err := c.Relay(ctx, lease.Username, lease.Token(), target, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.joinRelay(ctx, c, lease, resp.ID, resp.Addr, target)
+}
+
+func (n *Node) joinRelay(
+	ctx context.Context,
+	c *client.Client,
+	lease *client.Lease,
+	id string,
+	addr string,
+	peer string,
+) (*relay.Conn, error) {
+	addr, err := c.RelayAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return relay.Dial(ctx, addr, &relay.Hello{
+		ID:       id,
+		Username: lease.Username,
+		Token:    lease.Token(),
+	}, peer)
+}
+
+// loopRelay handles the datagrams received through conn until the peer is
+// done sending.
+func (n *Node) loopRelay(ctx context.Context, conn *relay.Conn) {
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		buf := make([]byte, relay.MaxFrameSize)
+		k, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				n.logger.Debugf("Error reading from relay to %s: %v\n", addr, err)
+			}
+			return
+		}
+
+		n.HandleDatagram(ctx, buf[:k], addr, conn)
+	}
+}
+
+// Images returns the image packets received from peers, directly or through
+// relays.
+func (n *Node) Images() <-chan Datagram {
+	return n.images
+}
+
+// Files returns the manifests and chunks of the files received from peers,
+// and the cancellations of their transfers.
+func (n *Node) Files() <-chan Datagram {
+	return n.files
+}
+
+// Streams returns the byte streams other peers open through relays, which
+// are to be accepted like TCP connections.
+func (n *Node) Streams() <-chan net.Conn {
+	return n.streams
+}
+
+// Lookup returns the registration of username.
+func (n *Node) Lookup(ctx context.Context, username string) (*peer.Peer, error) {
+	n.mu.Lock()
+	c := n.client
+	n.mu.Unlock()
+
+	if c == nil {
+		return nil, ErrNotRegistered
+	}
+	return c.Peer(ctx, username)
+}
+
+// DialPeer opens a secure connection to p, directly if possible or through
+// a relay otherwise.
+func (n *Node) DialPeer(ctx context.Context, p *peer.Peer) (*secure.Conn, error) {
+	n.mu.Lock()
+	lease := n.lease
+	n.mu.Unlock()
+
+	if lease == nil {
+		return nil, ErrNotRegistered
+	}
+	if len(p.PublicKey) == 0 {
+		return nil, errors.Errorf("peer %s has no identity key", p.Username)
+	}
+	if err := n.checkPin(p.Username, p.PublicKey); err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	conn, err := protocol.DialAny("tcp", p.TCPCandidates(lease.ObservedIP))
+	if err != nil {
+		n.logger.Warnf("Could not reach %s directly, relaying: %v\n", p.Username, err)
+
+		var relayErr error
+		conn, relayErr = n.RelayStream(ctx, p.Username)
+		if relayErr != nil {
+			return nil, errors.Wrapf(relayErr, "failed to connect directly (%v) and to relay", err)
+		}
+	}
+
+	sc, err := secure.Client(conn, n.identity, lease.Username, p.Username, p.PublicKey)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to secure connection to %s", p.Username)
+	}
+	return sc, nil
+}
+
+// verifyPeer checks that a peer presented the key its username is
+// registered with, and pinned to.
+func (n *Node) verifyPeer(ctx context.Context, username string, key ed25519.PublicKey) (*peer.Peer, error) {
+	p, err := n.Lookup(ctx, username)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up %s", username)
+	}
+	if !bytes.Equal(p.PublicKey, key) {
+		return nil, errors.Errorf("%s presented a key it isn't registered with", username)
+	}
+	return p, n.checkPin(username, key)
+}
+
+// checkPin checks key against the one pinned for username, pinning it on
+// first contact.
+func (n *Node) checkPin(username string, key ed25519.PublicKey) error {
+	pinned, err := n.contacts.Check(username, key)
+
+	var changed *contacts.KeyChangedError
+	if errors.As(err, &changed) {
+		n.logger.Errorf(
+			"WARNING: THE IDENTITY KEY OF %s HAS CHANGED!\n"+
+				"Someone may be impersonating %s, or they may have reset their identity.\n"+
+				"Pinned key: %s\nSeen key:   %s\n"+
+				"Nothing is exchanged with %s until you compare safety numbers with `peer verify %s`\n"+
+				"and trust the new key with `peer verify %s --trust <safety number>`.\n",
+			username,
+			username,
+			contacts.Fingerprint(changed.Pinned),
+			contacts.Fingerprint(changed.Seen),
+			username,
+			username,
+			username,
+		)
+		return err
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to pin the key of %s", username)
+	}
+
+	if pinned {
+		n.logger.Infof(
+			"Pinned the key of %s on first contact, compare safety numbers with `peer verify %s`\n",
+			username,
+			username,
+		)
+	}
+	return nil
+}
+
+func (n *Node) loopSignals(ctx context.Context, c *client.Client, lease *client.Lease) {
+	for ctx.Err() == nil {
+		signals, err := c.Signals(ctx, lease.Username, lease.Token())
+		if err != nil {
+			if ctx.Err() == nil {
+				n.logger.Debugln("Error polling signals:", "error", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+			continue
+		}
+
+		for _, sig := range signals {
+			n.handleSignal(ctx, c, lease, sig)
+		}
+	}
+}
+
+func (n *Node) handleSignal(ctx context.Context, c *client.Client, lease *client.Lease, sig response.Signal) {
+	switch sig.Type {
+	case response.SignalPunch:
+		if sig.Peer == nil {
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, PunchTimeout)
+			defer cancel()
+
+			candidates := sig.Peer.UDPCandidates(lease.ObservedIP)
+			addr, err := n.puncher.Punch(ctx, sig.ID, lease.Username, sig.Peer.Username, candidates)
+			if err != nil {
+				n.logger.Warnf("Error punching a hole to %s: %v\n", sig.Peer.Username, err)
+				return
+			}
+			n.logger.Debugf("Opened UDP path to %s at %s\n", sig.Peer.Username, addr)
+		}()
+	case response.SignalRelay:
+		if sig.Peer == nil {
+			return
+		}
+		go func() {
+			conn, err := n.joinRelay(ctx, c, lease, sig.ID, sig.Addr, sig.Peer.Username)
+			if err != nil {
+				n.logger.Warnf("Error joining relay from %s: %v\n", sig.Peer.Username, err)
+				return
+			}
+			n.logger.Debugf("Joined relay from %s\n", sig.Peer.Username)
+
+			if sig.Stream {
+				select {
+				case n.streams <- relay.NewStream(conn):
+				case <-ctx.Done():
+					conn.Close()
+				}
+				return
+			}
+			n.loopRelay(ctx, conn)
+		}()
+	default:
+		n.logger.Debugln("Ignoring unknown signal:", sig.Type)
+	}
+}
+
+// HandleDatagram dispatches a datagram received from addr through conn,
+// which is the node's UDP socket or a relay. Image packets are passed on
+// through Images, and the packets of files through Files, for the shell to
+// reassemble. It never blocks, dropping the packets the shell is too far
+// behind on.
+func (n *Node) HandleDatagram(ctx context.Context, b []byte, addr net.Addr, conn net.PacketConn) {
+	if n.binding.Handle(b) {
+		return
+	}
+
+	kind, payload, err := protocol.DecodeDatagram(b)
+	if err != nil {
+		return
+	}
+
+	switch kind {
+	case protocol.KindProbe, protocol.KindProbeACK:
+		n.puncher.Handle(kind, payload, addr)
+	case protocol.KindTransferOffer:
+		var o secure.TransferOffer
+		if err := json.Unmarshal(payload, &o); err == nil {
+			go n.acceptTransfer(ctx, &o, addr, conn)
+		}
+	case protocol.KindTransferAccept:
+		var a secure.TransferAccept
+		if err := json.Unmarshal(payload, &a); err == nil {
+			n.deliverAccept(&a)
+		}
+	case protocol.KindSealed:
+		n.handleSealed(payload, addr, conn)
+	default:
+		n.logger.Debugf("Dropping unsealed datagram of kind %q from %s\n", kind, addr)
+	}
+}
+
+// ImageACKs subscribes to the ACKs of the image being sent with filename.
+// done must be called once the image is sent.
+func (n *Node) ImageACKs(filename string) (acks <-chan protocol.ImageACKPacket, done func()) {
+	ch := make(chan protocol.ImageACKPacket, protocol.MaxWindow)
+
+	n.acksMu.Lock()
+	n.acks[filename] = ch
+	n.acksMu.Unlock()
+
+	return ch, func() {
+		n.acksMu.Lock()
+		defer n.acksMu.Unlock()
+		if n.acks[filename] == ch {
+			delete(n.acks, filename)
+		}
+	}
+}
+
+func (n *Node) deliverImageACK(ack protocol.ImageACKPacket) {
+	n.acksMu.Lock()
+	defer n.acksMu.Unlock()
+
+	select {
+	case n.acks[ack.Filename] <- ack:
+	default:
+		// nobody's waiting for it, or they're too slow to keep up
+	}
+}
+
+// FileACKs subscribes to the ACKs of the file being sent with id. done must
+// be called once the file is sent.
+func (n *Node) FileACKs(id protocol.FileID) (acks <-chan protocol.ChunkACK, done func()) {
+	ch := make(chan protocol.ChunkACK, protocol.MaxWindow)
+
+	n.acksMu.Lock()
+	n.fileACKs[id] = ch
+	n.acksMu.Unlock()
+
+	return ch, func() {
+		n.acksMu.Lock()
+		defer n.acksMu.Unlock()
+		delete(n.fileACKs, id)
+	}
+}
+
+func (n *Node) deliverFileACK(ack protocol.ChunkACK) {
+	n.acksMu.Lock()
+	defer n.acksMu.Unlock()
+
+	select {
+	case n.fileACKs[ack.ID] <- ack:
+	default:
+	}
+}
@@ -0,0 +1,225 @@
+package node
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/contacts"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/outbox"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/secure"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/client"
+)
+
+const (
+	// OutboxPollInterval is how often the outbox is checked for texts to
+	// retry.
+	OutboxPollInterval = 5 * time.Second
+
+	// RetryBackoff is how long a text is waited to be retried after its
+	// first attempt, which doubles with every attempt up to MaxRetryBackoff.
+	RetryBackoff    = 5 * time.Second
+	MaxRetryBackoff = 10 * time.Minute
+)
+
+// Send sends text to username directly if it's online, leaves it in its
+// mailbox if it's offline, or queues it in the outbox if neither works for
+// now. The text is recorded in the history unless it couldn't even be
+// attempted.
+func (n *Node) Send(ctx context.Context, username string, text string) (SentText, error) {
+	t, err := n.send(ctx, username, text)
+	if !t.ID.IsZero() {
+		n.recordSent(t)
+	}
+	return t, err
+}
+
+func (n *Node) send(ctx context.Context, username string, text string) (SentText, error) {
+	p, err := n.Lookup(ctx, username)
+	if errors.Is(err, client.ErrNotFound) {
+		t, err := n.SendMail(ctx, username, text)
+		if err == nil || !retryable(err) {
+			return t, err
+		}
+		return n.queue(t, errors.Wrapf(err, "%s is offline", username))
+	}
+	if err != nil {
+		return SentText{}, err
+	}
+
+	t, err := n.SendText(ctx, p, text)
+	if err != nil && retryable(err) {
+		return n.queue(t, err)
+	}
+	return t, err
+}
+
+// queue adds t to the outbox after its first attempt failed with err.
+func (n *Node) queue(t SentText, err error) (SentText, error) {
+	n.logger.Warnf("Could not send message %s to %s, queued it in the outbox: %v\n", t.ID.Short(), t.To, err)
+
+	qerr := n.outbox.Add(outbox.Entry{
+		ID:          t.ID.String(),
+		To:          t.To,
+		Text:        t.Text,
+		Created:     t.Time,
+		Attempts:    1,
+		NextAttempt: time.Now().Add(backoff(1)),
+		LastError:   err.Error(),
+	})
+	if qerr != nil {
+		return t, errors.Wrapf(qerr, "failed to send (%v) and to queue", err)
+	}
+
+	t.Status = StatusQueued
+	return t, nil
+}
+
+// Outbox returns the texts waiting to be retried.
+func (n *Node) Outbox() *outbox.Store {
+	return n.outbox
+}
+
+// RetryOutbox retries the texts in the outbox with ids now, or all of them
+// if there are none.
+func (n *Node) RetryOutbox(ids ...string) error {
+	entries := n.outbox.List()
+	if len(ids) > 0 {
+		entries = entries[:0]
+		for _, id := range ids {
+			e, err := n.outbox.Find(id)
+			if err != nil {
+				return errors.Wrapf(err, "message %s", id)
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	for _, e := range entries {
+		e.NextAttempt = time.Now()
+		if err := n.outbox.Update(e); err != nil && !errors.Is(err, outbox.ErrNotFound) {
+			return err
+		}
+	}
+
+	select {
+	case n.retryOutbox <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// loopOutbox retries the texts in the outbox as they're due, until ctx is
+// done.
+func (n *Node) loopOutbox(ctx context.Context) {
+	ticker := time.NewTicker(OutboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, e := range n.outbox.Due(time.Now()) {
+			if ctx.Err() != nil {
+				return
+			}
+			n.retry(ctx, e)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-n.retryOutbox:
+		}
+	}
+}
+
+// retry sends e once more if its recipient is online, removing it from the
+// outbox unless it fails for a reason worth retrying.
+func (n *Node) retry(ctx context.Context, e outbox.Entry) {
+	id, err := protocol.ParseMessageID(e.ID)
+	if err != nil {
+		n.logger.Warnf("Dropping message from the outbox: %v\n", err)
+		n.outbox.Remove(e.ID)
+		return
+	}
+
+	t := &SentText{
+		ID:     id,
+		To:     e.To,
+		Text:   e.Text,
+		Time:   e.Created,
+		Status: StatusSent,
+	}
+
+	p, err := n.Lookup(ctx, e.To)
+	if err == nil {
+		err = n.sendTracked(ctx, p, t)
+	}
+	if err != nil && retryable(err) {
+		if ctx.Err() != nil {
+			return
+		}
+		e.Attempts++
+		e.NextAttempt = time.Now().Add(backoff(e.Attempts))
+		e.LastError = err.Error()
+		if errors.Is(err, client.ErrNotFound) {
+			e.LastError = e.To + " is offline"
+		}
+		// unless it's been dropped in the meantime
+		if err := n.outbox.Update(e); err != nil && !errors.Is(err, outbox.ErrNotFound) {
+			n.logger.Warnf("Error rescheduling message %s to %s: %v\n", t.ID.Short(), e.To, err)
+		}
+		return
+	}
+
+	if err != nil {
+		n.logger.Errorf("Giving up on message %s to %s: %v\n", t.ID.Short(), e.To, err)
+		n.setStatus(t, StatusFailed)
+	}
+	if err := n.outbox.Remove(e.ID); err != nil && !errors.Is(err, outbox.ErrNotFound) {
+		n.logger.Warnf("Error removing message %s from the outbox: %v\n", t.ID.Short(), err)
+	}
+
+	u := n.snapshot(t)
+	n.recordStatus(u)
+	if u.Status > StatusSent {
+		// told already by the receipt
+		return
+	}
+	select {
+	case n.statuses <- u:
+	case <-ctx.Done():
+	}
+}
+
+// retryable reports whether sending may succeed later after failing with
+// err, unlike when the identity of the recipient is in doubt.
+func retryable(err error) bool {
+	var (
+		changed *contacts.KeyChangedError
+		noPeer  noSuchPeerError
+	)
+	switch {
+	case errors.As(err, &changed),
+		errors.As(err, &noPeer),
+		errors.Is(err, ErrNotRegistered),
+		errors.Is(err, secure.ErrUnknownPeerKey),
+		errors.Is(err, secure.ErrInvalidSignature),
+		errors.Is(err, secure.ErrUnsupported):
+		return false
+	}
+	return true
+}
+
+// backoff returns how long to wait before the attempt after the given one.
+func backoff(attempts int) time.Duration {
+	d := RetryBackoff
+	for i := 1; i < attempts && d < MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxRetryBackoff {
+		d = MaxRetryBackoff
+	}
+	return d
+}
@@ -0,0 +1,256 @@
+package node
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/resume"
+)
+
+// ErrCancelled is returned for a transfer which was cancelled locally.
+var ErrCancelled = errors.New("transfer cancelled")
+
+// Progress is how far a file or image being sent or received has got.
+type Progress struct {
+	ID       protocol.FileID
+	Peer     string
+	Filename string
+	Incoming bool
+	// Bytes is how many of the Size bytes of the file have arrived.
+	Bytes   uint64
+	Size    uint64
+	Started time.Time
+	// Rate is how many bytes a second have arrived since the transfer
+	// started, zero until any have.
+	Rate float64
+	// Paused is whether the transfer isn't in progress, but is kept to be
+	// resumed.
+	Paused bool
+	// Offered is whether the file is waiting for the user to accept it.
+	Offered bool
+}
+
+// ETA returns how long is left until the file has arrived at the current
+// rate, or zero if it isn't known.
+func (p *Progress) ETA() time.Duration {
+	if p.Rate == 0 || p.Bytes >= p.Size {
+		return 0
+	}
+	return time.Duration(float64(p.Size-p.Bytes) / p.Rate * float64(time.Second))
+}
+
+// SentFile is how sending a file in the background went.
+type SentFile struct {
+	Progress
+	Stats protocol.SendStats
+	Err   error
+}
+
+// transferKey tells transfers apart by their peer and direction along with
+// their ID, as the IDs of the files being received are picked by their
+// senders, who mustn't be able to pass them off as other transfers.
+type transferKey struct {
+	id       protocol.FileID
+	peer     string
+	incoming bool
+}
+
+func (p *Progress) key() transferKey {
+	return transferKey{id: p.ID, peer: p.Peer, incoming: p.Incoming}
+}
+
+type trackedTransfer struct {
+	Progress
+	// first is how many bytes had arrived when the transfer started, as it
+	// may have been resumed.
+	first   uint64
+	updated bool
+	cancel  func()
+	// cancelled is why it was cancelled, nil if it wasn't.
+	cancelled error
+}
+
+// Track keeps track of the transfer described by p until untrack is called,
+// which returns its last progress and why it was cancelled, if it was.
+// update must be told how many of its packets have arrived as it goes on,
+// and cancel cancels it.
+func (n *Node) Track(p Progress, cancel func()) (update protocol.ProgressFunc, untrack func() (Progress, error)) {
+	p.Started = time.Now()
+	t := &trackedTransfer{Progress: p, cancel: cancel}
+
+	n.progressMu.Lock()
+	n.progress[p.key()] = t
+	n.progressMu.Unlock()
+
+	update = func(done, total uint64) {
+		n.progressMu.Lock()
+		defer n.progressMu.Unlock()
+
+		t.Bytes = t.Size
+		if total > 0 {
+			t.Bytes = t.Size * done / total
+		}
+		if !t.updated {
+			t.first, t.updated = t.Bytes, true
+		}
+		if elapsed := time.Since(t.Started).Seconds(); elapsed > 0 {
+			t.Rate = float64(t.Bytes-t.first) / elapsed
+		}
+	}
+	untrack = func() (Progress, error) {
+		n.progressMu.Lock()
+		defer n.progressMu.Unlock()
+
+		if n.progress[p.key()] == t {
+			delete(n.progress, p.key())
+		}
+		return t.Progress, t.cancelled
+	}
+	return update, untrack
+}
+
+// ActiveTransfers returns the transfers in progress, oldest first.
+func (n *Node) ActiveTransfers() []Progress {
+	n.progressMu.Lock()
+	transfers := make([]Progress, 0, len(n.progress))
+	for _, t := range n.progress {
+		transfers = append(transfers, t.Progress)
+	}
+	n.progressMu.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].Started.Before(transfers[j].Started)
+	})
+	return transfers
+}
+
+// Transfers returns the transfers in progress, oldest first, followed by
+// the files offered to the user and the transfers kept to be resumed.
+func (n *Node) Transfers() []Progress {
+	transfers := n.ActiveTransfers()
+	for _, o := range n.PendingOffers() {
+		transfers = append(transfers, Progress{
+			ID:       o.ID,
+			Peer:     o.Peer,
+			Filename: o.Filename,
+			Incoming: true,
+			Size:     o.Size,
+			Started:  o.Offered,
+			Offered:  true,
+		})
+	}
+
+	active := make(map[transferKey]bool, len(transfers))
+	for _, p := range transfers {
+		active[p.key()] = true
+	}
+
+	for _, t := range n.resume.List() {
+		p := Progress{
+			ID:       t.Manifest.ID,
+			Peer:     t.Peer,
+			Filename: t.Manifest.Filename,
+			Incoming: t.Incoming,
+			Size:     t.Manifest.Size,
+			Started:  t.Started,
+			Paused:   true,
+		}
+		if active[p.key()] {
+			continue
+		}
+		if t.Manifest.Packets > 0 {
+			p.Bytes = t.Manifest.Size * t.Received / t.Manifest.Packets
+		}
+		transfers = append(transfers, p)
+	}
+	return transfers
+}
+
+// CancelTransfer cancels the transfer whose ID starts with prefix, telling
+// the peer at the other end, or drops it if it's kept to be resumed. A file
+// offered to the user is rejected.
+func (n *Node) CancelTransfer(prefix string) (Progress, error) {
+	var found *Progress
+	for _, p := range n.Transfers() {
+		if !strings.HasPrefix(p.ID.String(), prefix) {
+			continue
+		}
+		if found != nil {
+			return Progress{}, resume.ErrAmbiguous
+		}
+		p := p
+		found = &p
+	}
+	if found == nil {
+		return Progress{}, resume.ErrNotFound
+	}
+
+	if found.Offered {
+		if !n.answerOffer(found.key(), false) {
+			return Progress{}, resume.ErrNotFound
+		}
+		return *found, nil
+	}
+	if found.Paused {
+		return *found, n.resume.Remove(found.Peer, found.Incoming, found.ID)
+	}
+	if !n.cancelTransfer(found.key(), ErrCancelled) {
+		return Progress{}, resume.ErrNotFound
+	}
+	return *found, nil
+}
+
+// cancelTransfer cancels the transfer with key because of reason, and
+// reports whether it was in progress.
+func (n *Node) cancelTransfer(key transferKey, reason error) bool {
+	n.progressMu.Lock()
+	t, ok := n.progress[key]
+	n.progressMu.Unlock()
+
+	if !ok {
+		return false
+	}
+	n.cancelTracked(t, reason)
+	return true
+}
+
+// cancelSending cancels the file being sent to peer which c tells peer has
+// cancelled or declined, and reports whether it was being sent.
+func (n *Node) cancelSending(c *protocol.Cancel, peer string) bool {
+	n.progressMu.Lock()
+	t, ok := n.progress[transferKey{id: c.ID, peer: peer}]
+	n.progressMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	reason := errors.Errorf("%s cancelled it", peer)
+	switch {
+	case c.Declined && c.Reason != "":
+		reason = errors.Errorf("%s declined it: %q", peer, c.Reason)
+	case c.Declined:
+		reason = errors.Errorf("%s declined it", peer)
+	}
+	n.cancelTracked(t, reason)
+	return true
+}
+
+func (n *Node) cancelTracked(t *trackedTransfer, reason error) {
+	n.progressMu.Lock()
+	if t.cancelled == nil {
+		t.cancelled = reason
+	}
+	n.progressMu.Unlock()
+
+	t.cancel()
+}
+
+// SentFiles returns how sending the files sent in the background went.
+func (n *Node) SentFiles() <-chan SentFile {
+	return n.sentFiles
+}
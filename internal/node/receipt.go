@@ -0,0 +1,219 @@
+package node
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+// maxTrackedTexts bounds how many sent texts are tracked for receipts. The
+// oldest are forgotten first.
+const maxTrackedTexts = 1024
+
+// Status is how far a sent text got.
+type Status int
+
+const (
+	StatusFailed Status = iota
+	// StatusStored is kept in the mailbox of the recipient while it's
+	// offline. Mail gets no receipts.
+	StatusStored
+	// StatusQueued is in the outbox, to be retried.
+	StatusQueued
+	StatusSent
+	StatusDelivered
+	StatusRead
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusFailed:
+		return "failed"
+	case StatusStored:
+		return "stored"
+	case StatusQueued:
+		return "queued"
+	case StatusSent:
+		return "sent"
+	case StatusDelivered:
+		return "delivered"
+	case StatusRead:
+		return "read"
+	default:
+		return "unknown"
+	}
+}
+
+// SentText is a text message sent to a peer.
+type SentText struct {
+	ID     protocol.MessageID
+	To     string
+	Text   string
+	Time   time.Time
+	Status Status
+}
+
+// Statuses returns the updates of the statuses of sent texts as receipts
+// for them arrive.
+func (n *Node) Statuses() <-chan SentText {
+	return n.statuses
+}
+
+// track records t to update its status as receipts for it arrive.
+func (n *Node) track(t *SentText) {
+	n.sentMu.Lock()
+	defer n.sentMu.Unlock()
+
+	if len(n.sent) >= maxTrackedTexts {
+		var oldest *SentText
+		for _, s := range n.sent {
+			if oldest == nil || s.Time.Before(oldest.Time) {
+				oldest = s
+			}
+		}
+		delete(n.sent, oldest.ID)
+	}
+	n.sent[t.ID] = t
+}
+
+func (n *Node) setStatus(t *SentText, status Status) {
+	n.sentMu.Lock()
+	defer n.sentMu.Unlock()
+	t.Status = status
+}
+
+// snapshot returns a copy of t, which receipts may be updating.
+func (n *Node) snapshot(t *SentText) SentText {
+	n.sentMu.Lock()
+	defer n.sentMu.Unlock()
+	return *t
+}
+
+// textKey tells the texts received apart by their sender along with their
+// ID, as IDs are picked by the senders and one may reuse another's.
+type textKey struct {
+	peer string
+	id   protocol.MessageID
+}
+
+// seenText reports whether a text with id was received from peer lately,
+// remembering it otherwise.
+func (n *Node) seenText(peer string, id protocol.MessageID) bool {
+	n.seenMu.Lock()
+	defer n.seenMu.Unlock()
+
+	key := textKey{peer: peer, id: id}
+	if _, ok := n.seen[key]; ok {
+		return true
+	}
+	if len(n.seenOrder) == maxTrackedTexts {
+		delete(n.seen, n.seenOrder[0])
+		n.seenOrder = n.seenOrder[1:]
+	}
+	n.seen[key] = struct{}{}
+	n.seenOrder = append(n.seenOrder, key)
+	return false
+}
+
+// handleReceipt advances the status of the texts sent to peer with ids, and
+// passes on the updates until ctx is done.
+func (n *Node) handleReceipt(ctx context.Context, peer string, ids []protocol.MessageID, status Status) {
+	var updates []SentText
+
+	n.sentMu.Lock()
+	for _, id := range ids {
+		t, ok := n.sent[id]
+		if !ok || t.To != peer || t.Status >= status {
+			continue
+		}
+		t.Status = status
+		updates = append(updates, *t)
+		if status == StatusRead {
+			delete(n.sent, id)
+		}
+	}
+	n.sentMu.Unlock()
+
+	for _, u := range updates {
+		n.recordStatus(u)
+		select {
+		case n.statuses <- u:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Delivered acknowledges t as handed to the user to its sender. It's marked
+// read on the next call to MarkRead. Texts which didn't come over a session,
+// like mail, aren't acknowledged.
+func (n *Node) Delivered(t Text) {
+	if t.ID.IsZero() {
+		return
+	}
+
+	n.unreadMu.Lock()
+	n.unread = append(n.unread, t)
+	n.unreadMu.Unlock()
+
+	if t.session != nil {
+		go n.sendReceipt(t.session, t.From, protocol.FrameDelivered, t.ID)
+	}
+}
+
+// MarkRead marks the texts delivered since the last call as read, and sends
+// read receipts for them if they're enabled.
+func (n *Node) MarkRead() {
+	n.unreadMu.Lock()
+	unread := n.unread
+	n.unread = nil
+	n.unreadMu.Unlock()
+
+	for _, t := range unread {
+		n.recordRead(t)
+	}
+
+	// only the ones which came over a session are acknowledged
+	kept := unread[:0]
+	for _, t := range unread {
+		if t.session != nil {
+			kept = append(kept, t)
+		}
+	}
+	unread = kept
+
+	if len(unread) == 0 || !n.cfg.ReadReceipts {
+		return
+	}
+
+	// one receipt per session
+	sort.SliceStable(unread, func(i, j int) bool { return unread[i].From < unread[j].From })
+	for i := 0; i < len(unread); {
+		j := i
+		var ids []protocol.MessageID
+		for ; j < len(unread) && unread[j].session == unread[i].session; j++ {
+			ids = append(ids, unread[j].ID)
+		}
+		go n.sendReceipt(unread[i].session, unread[i].From, protocol.FrameRead, ids...)
+		i = j
+	}
+}
+
+// sendReceipt sends a receipt for ids over s, or the session cached with
+// peer if s is closed.
+func (n *Node) sendReceipt(s *session, peer string, t protocol.FrameType, ids ...protocol.MessageID) {
+	select {
+	case <-s.done:
+		if s = n.cachedSession(peer); s == nil {
+			n.logger.Debugf("Dropping %s receipt for %s, the session is closed\n", t, peer)
+			return
+		}
+	default:
+	}
+
+	if err := s.write(t, protocol.EncodeReceipt(ids...)); err != nil {
+		n.logger.Debugf("Error sending %s receipt to %s: %v\n", t, peer, err)
+	}
+}
@@ -0,0 +1,337 @@
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/peer"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/secure"
+)
+
+const (
+	// KeepaliveInterval is how often sessions are pinged.
+	KeepaliveInterval = 15 * time.Second
+
+	// SessionIdleTimeout is how long a session is kept open without any
+	// message sent or received over it.
+	SessionIdleTimeout = 5 * time.Minute
+
+	// sessionDeadTimeout is how long a session is kept open without anything
+	// received over it, not even a ping.
+	sessionDeadTimeout = 3 * KeepaliveInterval
+)
+
+// Text is a text message received from a peer. Texts of peers before
+// protocol.ReceiptVersion have neither an ID nor a time.
+type Text struct {
+	From string
+	ID   protocol.MessageID
+	Time time.Time
+	Text string
+
+	// session is the one the text was received over, which receipts for it
+	// are sent back over.
+	session *session
+}
+
+// session is a secure connection to a peer carrying frames in both
+// directions.
+type session struct {
+	conn    *secure.Conn
+	peer    string
+	version int
+
+	wmu sync.Mutex
+	// lastUsed is when a message was last sent or received, in Unix
+	// nanoseconds.
+	lastUsed  atomic.Int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(conn *secure.Conn, peer string, version int) *session {
+	s := &session{
+		conn:    conn,
+		peer:    peer,
+		version: version,
+		done:    make(chan struct{}),
+	}
+	s.touch()
+	return s
+}
+
+func (s *session) touch() {
+	s.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (s *session) idle() time.Duration {
+	return time.Since(time.Unix(0, s.lastUsed.Load()))
+}
+
+func (s *session) write(t protocol.FrameType, payload []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(protocol.DefaultTimeout))
+	defer s.conn.SetWriteDeadline(time.Time{})
+
+	return protocol.WriteFrame(s.conn, &protocol.Frame{
+		Version: protocol.FrameFormat(s.version),
+		Type:    t,
+		Payload: payload,
+	})
+}
+
+func (s *session) sendText(m *protocol.Message) error {
+	var err error
+	if s.version >= protocol.ReceiptVersion {
+		b, _ := m.MarshalBinary()
+		err = s.write(protocol.FrameMessage, b)
+	} else {
+		err = s.write(protocol.FrameText, []byte(m.Text))
+	}
+	if err != nil {
+		return err
+	}
+	s.touch()
+	return nil
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// SendText sends text to p over the session with it, which is opened if
+// there's none yet. Peers which don't keep sessions get a connection per
+// message. The status of the returned text is updated on Statuses as
+// receipts for it arrive, for peers sending them.
+func (n *Node) SendText(ctx context.Context, p *peer.Peer, text string) (SentText, error) {
+	t := &SentText{
+		ID:     protocol.NewMessageID(),
+		To:     p.Username,
+		Text:   text,
+		Time:   time.Now(),
+		Status: StatusSent,
+	}
+
+	err := n.sendTracked(ctx, p, t)
+	return n.snapshot(t), err
+}
+
+// sendTracked sends t to p, tracking it for receipts if p sends them.
+func (n *Node) sendTracked(ctx context.Context, p *peer.Peer, t *SentText) error {
+	version := protocol.NegotiateVersion(p.WireVersion)
+	if version >= protocol.ReceiptVersion {
+		// tracked before sending, as receipts may arrive before the send returns
+		n.track(t)
+	}
+
+	if err := n.sendText(ctx, p, version, t); err != nil {
+		n.setStatus(t, StatusFailed)
+		return err
+	}
+	return nil
+}
+
+func (n *Node) sendText(ctx context.Context, p *peer.Peer, version int, t *SentText) error {
+	m := &protocol.Message{ID: t.ID, Sent: t.Time, Text: t.Text}
+
+	if version < protocol.SessionVersion {
+		conn, err := n.DialPeer(ctx, p)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		return protocol.SendText(conn, m.Text, protocol.FrameFormat(version))
+	}
+
+	if s := n.cachedSession(p.Username); s != nil {
+		err := s.sendText(m)
+		if err == nil {
+			return nil
+		}
+		// the peer may have closed it in the meantime
+		n.logger.Debugf("Error sending over session with %s, reopening it: %v\n", p.Username, err)
+		s.close()
+	}
+
+	conn, err := n.DialPeer(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	s := newSession(conn, p.Username, version)
+	n.addSession(s)
+	go n.serveSession(ctx, s)
+
+	return s.sendText(m)
+}
+
+// ServePeer serves conn opened by another peer until it's closed, once the
+// peer has proven who it is.
+func (n *Node) ServePeer(ctx context.Context, conn net.Conn) error {
+	var registered *peer.Peer
+	sc, err := secure.Server(conn, n.identity, func(username string, key ed25519.PublicKey) error {
+		var err error
+		registered, err = n.verifyPeer(ctx, username, key)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s := newSession(sc, sc.PeerUsername(), protocol.NegotiateVersion(registered.WireVersion))
+	if s.version >= protocol.SessionVersion {
+		n.addSession(s)
+	}
+	n.serveSession(ctx, s)
+	return nil
+}
+
+// Texts returns the text messages received from peers.
+func (n *Node) Texts() <-chan Text {
+	return n.texts
+}
+
+func (n *Node) serveSession(ctx context.Context, s *session) {
+	defer n.dropSession(s)
+	defer s.close()
+
+	if s.version >= protocol.SessionVersion {
+		go n.keepAlive(ctx, s)
+	}
+
+	fr := protocol.NewFrameReader(s.conn, n.cfg.MaxFrameSize)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(sessionDeadTimeout))
+		f, err := fr.ReadFrame()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				if err != io.EOF {
+					n.logger.Warnf("Closing session with %s: %v\n", s.peer, err)
+				}
+			}
+			return
+		}
+
+		switch f.Type {
+		case protocol.FrameText, protocol.FrameMessage:
+			s.touch()
+			t := Text{From: s.peer, Text: string(f.Payload), session: s}
+			if f.Type == protocol.FrameMessage {
+				var m protocol.Message
+				if err := m.UnmarshalBinary(f.Payload); err != nil {
+					n.logger.Warnf("Closing session with %s: %v\n", s.peer, err)
+					return
+				}
+				t.ID, t.Time, t.Text = m.ID, m.Sent, m.Text
+
+				if n.seenText(s.peer, t.ID) {
+					// a retry of a text whose receipt was lost
+					go n.sendReceipt(s, s.peer, protocol.FrameDelivered, t.ID)
+					continue
+				}
+			}
+			n.recordReceived(t)
+			select {
+			case n.texts <- t:
+			case <-s.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		case protocol.FrameDelivered, protocol.FrameRead:
+			ids, err := protocol.DecodeReceipt(f.Payload)
+			if err != nil {
+				n.logger.Warnf("Closing session with %s: %v\n", s.peer, err)
+				return
+			}
+			status := StatusDelivered
+			if f.Type == protocol.FrameRead {
+				status = StatusRead
+			}
+			n.handleReceipt(ctx, s.peer, ids, status)
+		case protocol.FramePing:
+			if err := s.write(protocol.FramePong, nil); err != nil {
+				return
+			}
+		case protocol.FramePong:
+		default:
+			n.logger.Debugf("Ignoring %s frame from %s\n", f.Type, s.peer)
+		}
+	}
+}
+
+// keepAlive pings s until it's closed, closing it once it's idle.
+func (n *Node) keepAlive(ctx context.Context, s *session) {
+	ticker := time.NewTicker(KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			s.close()
+			return
+		case <-ticker.C:
+		}
+
+		if s.idle() > SessionIdleTimeout {
+			n.logger.Debugf("Closing idle session with %s\n", s.peer)
+			s.close()
+			return
+		}
+		if err := s.write(protocol.FramePing, nil); err != nil {
+			s.close()
+			return
+		}
+	}
+}
+
+func (n *Node) cachedSession(username string) *session {
+	n.sessionsMu.Lock()
+	defer n.sessionsMu.Unlock()
+	return n.sessions[username]
+}
+
+// addSession caches s as the session with its peer. A session it replaces is
+// left open until either peer closes it.
+func (n *Node) addSession(s *session) {
+	n.sessionsMu.Lock()
+	defer n.sessionsMu.Unlock()
+	n.sessions[s.peer] = s
+}
+
+func (n *Node) dropSession(s *session) {
+	n.sessionsMu.Lock()
+	defer n.sessionsMu.Unlock()
+	if n.sessions[s.peer] == s {
+		delete(n.sessions, s.peer)
+	}
+}
+
+// closeSessions closes all the sessions with other peers.
+func (n *Node) closeSessions() {
+	n.sessionsMu.Lock()
+	sessions := n.sessions
+	n.sessions = make(map[string]*session)
+	n.sessionsMu.Unlock()
+
+	for _, s := range sessions {
+		s.close()
+	}
+}
@@ -0,0 +1,296 @@
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/peer"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/secure"
+)
+
+const (
+	// TransferTimeout bounds how long a peer is waited for to accept a
+	// transfer.
+	TransferTimeout = 10 * time.Second
+
+	// offerInterval is how often an offer is resent until it's accepted.
+	offerInterval = 500 * time.Millisecond
+
+	// transferIdleTimeout is how long an accepted transfer is kept without
+	// any datagram of it arriving.
+	transferIdleTimeout = 2 * time.Minute
+)
+
+type transfer struct {
+	// t is nil while the offer is being checked.
+	t *secure.Transfer
+	// accept is the datagram the offer was answered with, resent if the offer
+	// arrives again.
+	accept   []byte
+	lastSeen time.Time
+}
+
+// OpenTransfer keys a transfer to p, which is reachable at addr through conn.
+// Datagrams written to the returned connection are sealed for the transfer,
+// and the ones p sends back are opened by the node. done must be called once
+// the transfer is over.
+func (n *Node) OpenTransfer(
+	ctx context.Context,
+	conn net.PacketConn,
+	addr net.Addr,
+	p *peer.Peer,
+) (sealed net.PacketConn, done func(), err error) {
+	n.mu.Lock()
+	lease := n.lease
+	n.mu.Unlock()
+
+	if lease == nil {
+		return nil, nil, ErrNotRegistered
+	}
+	if len(p.PublicKey) == 0 {
+		return nil, nil, errors.Errorf("peer %s has no identity key", p.Username)
+	}
+	if err := n.checkPin(p.Username, p.PublicKey); err != nil {
+		return nil, nil, err
+	}
+
+	o, err := secure.Offer(n.identity, lease.Username, p.Username, p.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := protocol.EncodeDatagram(protocol.KindTransferOffer, o.Offer())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := string(o.Offer().ID)
+	accepts := make(chan *secure.TransferAccept, 1)
+
+	n.transfersMu.Lock()
+	n.offers[id] = accepts
+	n.transfersMu.Unlock()
+
+	defer func() {
+		n.transfersMu.Lock()
+		delete(n.offers, id)
+		n.transfersMu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, TransferTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(offerInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := conn.WriteTo(b, addr); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to offer transfer to %s", p.Username)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, errors.Wrapf(ctx.Err(), "%s didn't accept the transfer", p.Username)
+		case a := <-accepts:
+			t, err := o.Finish(a)
+			if err != nil {
+				n.logger.Warnf("Ignoring invalid accept of transfer to %s: %v\n", p.Username, err)
+				continue
+			}
+
+			n.transfersMu.Lock()
+			n.transfers[id] = &transfer{t: t, lastSeen: time.Now()}
+			n.transfersMu.Unlock()
+
+			return &sealedConn{conn, t}, func() { n.removeTransfer(id) }, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *Node) removeTransfer(id string) {
+	n.transfersMu.Lock()
+	defer n.transfersMu.Unlock()
+	delete(n.transfers, id)
+}
+
+// acceptTransfer answers an offer of a transfer received through conn from
+// addr.
+func (n *Node) acceptTransfer(ctx context.Context, o *secure.TransferOffer, addr net.Addr, conn net.PacketConn) {
+	id := string(o.ID)
+
+	n.transfersMu.Lock()
+	tr, ok := n.transfers[id]
+	if !ok {
+		n.sweepTransfers()
+		n.transfers[id] = &transfer{lastSeen: time.Now()}
+	}
+	n.transfersMu.Unlock()
+
+	if ok {
+		if tr.accept != nil {
+			// our accept was lost
+			conn.WriteTo(tr.accept, addr)
+		}
+		return
+	}
+
+	n.mu.Lock()
+	lease := n.lease
+	n.mu.Unlock()
+
+	if lease == nil || o.To != lease.Username {
+		n.removeTransfer(id)
+		return
+	}
+
+	t, a, err := secure.AcceptTransfer(n.identity, o, func(username string, key ed25519.PublicKey) error {
+		_, err := n.verifyPeer(ctx, username, key)
+		return err
+	})
+	if err != nil {
+		n.logger.Warnf("Rejected transfer from %s at %s: %v\n", o.From, addr, err)
+		n.removeTransfer(id)
+		return
+	}
+
+	b, err := protocol.EncodeDatagram(protocol.KindTransferAccept, a)
+	if err != nil {
+		n.removeTransfer(id)
+		return
+	}
+
+	n.transfersMu.Lock()
+	n.transfers[id] = &transfer{t: t, accept: b, lastSeen: time.Now()}
+	n.transfersMu.Unlock()
+
+	if _, err := conn.WriteTo(b, addr); err != nil {
+		n.logger.Debugf("Error accepting transfer from %s: %v\n", o.From, err)
+	}
+}
+
+// sweepTransfers forgets the transfers which have gone idle. It must be
+// called with n.transfersMu held.
+func (n *Node) sweepTransfers() {
+	now := time.Now()
+	for id, tr := range n.transfers {
+		if now.Sub(tr.lastSeen) > transferIdleTimeout {
+			delete(n.transfers, id)
+		}
+	}
+}
+
+func (n *Node) deliverAccept(a *secure.TransferAccept) {
+	n.transfersMu.Lock()
+	defer n.transfersMu.Unlock()
+
+	select {
+	case n.offers[string(a.ID)] <- a:
+	default:
+	}
+}
+
+// handleSealed opens a datagram sealed for a transfer.
+func (n *Node) handleSealed(sealed []byte, addr net.Addr, conn net.PacketConn) {
+	id, ok := secure.SealedTransferID(sealed)
+	if !ok {
+		return
+	}
+
+	n.transfersMu.Lock()
+	tr := n.transfers[string(id)]
+	if tr != nil {
+		tr.lastSeen = time.Now()
+	}
+	n.transfersMu.Unlock()
+
+	if tr == nil || tr.t == nil {
+		return
+	}
+
+	b, err := tr.t.Open(sealed)
+	if err != nil {
+		n.logger.Debugf("Dropping datagram from %s: %v\n", addr, err)
+		return
+	}
+
+	kind, payload, err := protocol.DecodeDatagram(b)
+	if err != nil {
+		return
+	}
+
+	switch kind {
+	case protocol.KindImage:
+		d := Datagram{
+			B:    b,
+			Addr: addr,
+			Conn: &sealedConn{conn, tr.t},
+			Peer: tr.t.PeerUsername(),
+		}
+		n.enqueue(n.images, d)
+	case protocol.KindImageACK:
+		var ack protocol.ImageACKPacket
+		if err := json.Unmarshal(payload, &ack); err == nil {
+			n.deliverImageACK(ack)
+		}
+	case protocol.KindManifest, protocol.KindChunk:
+		d := Datagram{
+			B:    b,
+			Addr: addr,
+			Conn: &sealedConn{conn, tr.t},
+			Peer: tr.t.PeerUsername(),
+		}
+		n.enqueue(n.files, d)
+	case protocol.KindChunkACK:
+		var ack protocol.ChunkACK
+		if err := json.Unmarshal(payload, &ack); err == nil {
+			n.deliverFileACK(ack)
+		}
+	case protocol.KindCancel:
+		var c protocol.Cancel
+		if err := json.Unmarshal(payload, &c); err != nil {
+			return
+		}
+		if n.cancelSending(&c, tr.t.PeerUsername()) {
+			return
+		}
+		// the file may be one being received
+		d := Datagram{
+			B:    b,
+			Addr: addr,
+			Conn: &sealedConn{conn, tr.t},
+			Peer: tr.t.PeerUsername(),
+		}
+		n.enqueue(n.files, d)
+	}
+}
+
+// enqueue passes d on through ch, dropping it if too many packets are waiting
+// already.
+func (n *Node) enqueue(ch chan<- Datagram, d Datagram) {
+	select {
+	case ch <- d:
+	default:
+		n.logger.Debugf("Dropping datagram from %s as %d are waiting\n", d.Addr, cap(ch))
+	}
+}
+
+// sealedConn seals the datagrams written to it for a transfer. Reads aren't
+// opened, as the socket is read by the node.
+type sealedConn struct {
+	net.PacketConn
+	transfer *secure.Transfer
+}
+
+func (c *sealedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	datagram := append([]byte{protocol.KindSealed}, c.transfer.Seal(b)...)
+	if _, err := c.PacketConn.WriteTo(datagram, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
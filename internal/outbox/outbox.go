@@ -0,0 +1,204 @@
+// Package outbox keeps the texts that couldn't be sent yet, to be retried
+// until their recipient can be reached.
+package outbox
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/fsutil"
+)
+
+// FileName is the name of the file the outbox is stored in, next to the
+// config file of the peer.
+const FileName = "outbox.json"
+
+var (
+	ErrNotFound  = errors.New("no such message in the outbox")
+	ErrAmbiguous = errors.New("several messages in the outbox match")
+)
+
+type Entry struct {
+	// ID is the message ID in hex, kept across attempts so that the
+	// recipient can tell them apart from new messages.
+	ID       string    `json:"id"`
+	To       string    `json:"to"`
+	Text     string    `json:"text"`
+	Created  time.Time `json:"created"`
+	Attempts int       `json:"attempts"`
+	// NextAttempt is when the message is to be retried.
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// shortIDLength is the length of the prefix of an ID shown to users.
+const shortIDLength = 8
+
+// ShortID returns the prefix of the ID of e shown to users, or all of it if
+// it's shorter, as the outbox file may have been edited.
+func (e *Entry) ShortID() string {
+	if len(e.ID) < shortIDLength {
+		return e.ID
+	}
+	return e.ID[:shortIDLength]
+}
+
+// Store is the outbox stored in a file.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// Open loads the outbox stored at path. The file is created once a message
+// is queued.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		entries: make(map[string]*Entry),
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, errors.Wrapf(err, "invalid outbox file %s", path)
+	}
+	for _, e := range entries {
+		s.entries[e.ID] = e
+	}
+	return s, nil
+}
+
+// Add queues e, replacing the entry with the same ID if any.
+func (s *Store) Add(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(e)
+}
+
+// Update replaces the entry with the ID of e, unless it's been removed.
+func (s *Store) Update(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[e.ID]; !ok {
+		return ErrNotFound
+	}
+	return s.put(e)
+}
+
+// put must be called with s.mu held.
+func (s *Store) put(e Entry) error {
+	prev := s.entries[e.ID]
+	s.entries[e.ID] = &e
+	if err := s.save(); err != nil {
+		if prev != nil {
+			s.entries[e.ID] = prev
+		} else {
+			delete(s.entries, e.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove drops the entry with id.
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(s.entries, id)
+	if err := s.save(); err != nil {
+		s.entries[id] = e
+		return err
+	}
+	return nil
+}
+
+// Find returns the entry whose ID starts with prefix.
+func (s *Store) Find(prefix string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found *Entry
+	for id, e := range s.entries {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		if found != nil {
+			return Entry{}, ErrAmbiguous
+		}
+		found = e
+	}
+	if found == nil {
+		return Entry{}, ErrNotFound
+	}
+	return *found, nil
+}
+
+// List returns copies of the entries, oldest first.
+func (s *Store) List() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sorted()
+}
+
+// Due returns copies of the entries to be retried by now, oldest first.
+func (s *Store) Due(now time.Time) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []Entry
+	for _, e := range s.sorted() {
+		if !e.NextAttempt.After(now) {
+			due = append(due, e)
+		}
+	}
+	return due
+}
+
+// sorted must be called with s.mu held.
+func (s *Store) sorted() []Entry {
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Created.Equal(entries[j].Created) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries
+}
+
+// save must be called with s.mu held.
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(fsutil.WriteFile(s.path, b), "failed to save outbox")
+}
@@ -1,13 +1,79 @@
 package peer
 
-import "fmt"
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+)
 
 type Peer struct {
-	UDPAddr  string `json:"udp_addr"`
-	TCPAddr  string `json:"tcp_addr"`
-	Username string `json:"username"`
+	// UDPAddr and TCPAddr are the private addresses the peer claims to
+	// listen on.
+	UDPAddr string `json:"udp_addr"`
+	TCPAddr string `json:"tcp_addr"`
+	// PublicUDPAddr and PublicTCPAddr are the ports the peer listens on at
+	// the address the server observed it at.
+	PublicUDPAddr string `json:"public_udp_addr,omitempty"`
+	PublicTCPAddr string `json:"public_tcp_addr,omitempty"`
+	Username      string `json:"username"`
+	// PublicKey is the identity key the peer proved the ownership of its
+	// username with.
+	PublicKey ed25519.PublicKey `json:"public_key,omitempty"`
+	// WireVersion is the latest version of the format of messages the peer
+	// reads. It's 0 for peers only reading the legacy format.
+	WireVersion int `json:"wire_version,omitempty"`
+	// TokenHash is the hash of the secret that proves ownership of the
+	// registration. It is never sent to other peers.
+	TokenHash string `json:"token_hash,omitempty"`
+}
+
+// Public returns a copy of p without its secrets.
+func (p *Peer) Public() *Peer {
+	pub := *p
+	pub.TokenHash = ""
+	return &pub
+}
+
+// TCPCandidates returns the addresses p may be reachable at over TCP, the
+// most promising first. Peers behind the same public IP as the caller are
+// tried on their private address first.
+func (p *Peer) TCPCandidates(localPublicIP string) []string {
+	return candidates(p.PublicTCPAddr, p.TCPAddr, localPublicIP)
+}
+
+// UDPCandidates is like TCPCandidates for UDP.
+func (p *Peer) UDPCandidates(localPublicIP string) []string {
+	return candidates(p.PublicUDPAddr, p.UDPAddr, localPublicIP)
+}
+
+func candidates(public, private, localPublicIP string) []string {
+	if public == "" || public == private {
+		return []string{private}
+	}
+	if localPublicIP != "" && host(public) == localPublicIP {
+		return []string{private, public}
+	}
+	return []string{public, private}
+}
+
+func host(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return h
 }
 
 func (p *Peer) String() string {
-	return fmt.Sprintf("Peer{Username:%s, UDPAddr:%s, TCPAddr:%s}", p.Username, p.UDPAddr, p.TCPAddr)
+	if p.PublicUDPAddr == "" && p.PublicTCPAddr == "" {
+		return fmt.Sprintf("Peer{Username:%s, UDPAddr:%s, TCPAddr:%s}", p.Username, p.UDPAddr, p.TCPAddr)
+	}
+	return fmt.Sprintf(
+		"Peer{Username:%s, UDPAddr:%s, TCPAddr:%s, PublicUDPAddr:%s, PublicTCPAddr:%s}",
+		p.Username,
+		p.UDPAddr,
+		p.TCPAddr,
+		p.PublicUDPAddr,
+		p.PublicTCPAddr,
+	)
 }
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of the datagrams peers exchange over UDP. The kind is the first byte
+// of every datagram, which never collides with STUN messages sharing the
+// socket as their first byte is either 0x00 or 0x01.
+//
+// Images, files and their ACKs are only ever sent sealed for a transfer,
+// inside a datagram of KindSealed whose payload is binary rather than JSON.
+// Files are sent as a manifest followed by chunks, which are binary too, and
+// either end may cancel the transfer of a file.
+const (
+	KindImage          byte = 'I'
+	KindImageACK       byte = 'A'
+	KindManifest       byte = 'M'
+	KindChunk          byte = 'C'
+	KindChunkACK       byte = 'B'
+	KindCancel         byte = 'X'
+	KindProbe          byte = 'P'
+	KindProbeACK       byte = 'R'
+	KindTransferOffer  byte = 'O'
+	KindTransferAccept byte = 'K'
+	KindSealed         byte = 'S'
+)
+
+// ProbePacket is sent by both ends of a hole punching attempt.
+type ProbePacket struct {
+	// ID is handed out by the discovery server to both peers.
+	ID   string
+	From string
+	To   string
+}
+
+func EncodeDatagram(kind byte, v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{kind}, b...), nil
+}
+
+func DecodeDatagram(b []byte) (kind byte, payload []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, errors.New("datagram too short")
+	}
+	return b[0], b[1:], nil
+}
@@ -0,0 +1,435 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ChunkSize is how many bytes of a file a chunk carries, which keeps
+	// sealed chunks within the MTU of most paths.
+	ChunkSize = 1024
+
+	// MaxFileSize is the largest file accepted from a peer.
+	MaxFileSize = 64 << 20
+
+	// OfferTimeout is how long the manifest of a file is resent for, waiting
+	// for the receiver to accept the file, before it's given up on.
+	OfferTimeout = 2 * time.Minute
+
+	mimeTypeMaxLength = 255
+)
+
+var ErrFileCorrupt = errors.New("file doesn't match its manifest")
+
+// FileID identifies a file sent between peers.
+type FileID [16]byte
+
+// NewFileID returns a random file ID.
+func NewFileID() FileID {
+	var id FileID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id FileID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Short returns the prefix of the ID shown to users.
+func (id FileID) Short() string {
+	return id.String()[:8]
+}
+
+func (id FileID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *FileID) UnmarshalText(b []byte) error {
+	n, err := hex.Decode(id[:], b)
+	if err != nil || n != len(id) || len(b) != 2*len(id) {
+		return errors.Errorf("invalid file ID %q", b)
+	}
+	return nil
+}
+
+// Manifest describes a file sent in chunks. It's the first packet of the
+// file, followed by a packet for every chunk.
+type Manifest struct {
+	ID       FileID
+	Sender   string
+	Filename string
+	// Format is the format of an image, like "png", empty for other files.
+	Format string
+	// MIMEType is the media type of the file as guessed by the sender, only
+	// to be shown.
+	MIMEType string
+	Size     uint64
+	// SHA256 is the hash of the whole file, in hex.
+	SHA256 string
+	// Packets is how many packets the file is sent in, the manifest
+	// included.
+	Packets uint64
+}
+
+// NewManifest returns the manifest of data. Its media type is guessed from
+// the extension of filename, or from data if it has none known.
+func NewManifest(sender, filename, format string, data []byte) *Manifest {
+	mimeType := mime.TypeByExtension(filepath.Ext(filename))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	sum := sha256.Sum256(data)
+	return &Manifest{
+		ID:       NewFileID(),
+		Sender:   sender,
+		Filename: filename,
+		Format:   format,
+		MIMEType: mimeType,
+		Size:     uint64(len(data)),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Packets:  1 + (uint64(len(data))+ChunkSize-1)/ChunkSize,
+	}
+}
+
+// Validate checks that m describes a file which may be accepted.
+func (m *Manifest) Validate() error {
+	switch {
+	case len(m.Filename) > FilenameMaxLength:
+		return errors.New("filename length exceeded")
+	case len(m.Sender) > UsernameMaxLength:
+		return errors.New("username length exceeded")
+	case len(m.MIMEType) > mimeTypeMaxLength:
+		return errors.New("media type length exceeded")
+	case m.MIMEType != "" && !validMediaType(m.MIMEType):
+		return errors.Errorf("invalid media type %q", m.MIMEType)
+	case m.Size > MaxFileSize:
+		return errors.Errorf("file of %d bytes exceeds the maximum of %d", m.Size, MaxFileSize)
+	case m.Packets != 1+(m.Size+ChunkSize-1)/ChunkSize:
+		return errors.New("packets don't match the size of the file")
+	}
+	return nil
+}
+
+func validMediaType(v string) bool {
+	_, _, err := mime.ParseMediaType(v)
+	return err == nil
+}
+
+// Chunk is a packet of a file other than its manifest:
+//
+//	file ID | packets of the file, big-endian uint64 | Seq, big-endian uint64 | data
+//
+// Chunk Seq carries the bytes from (Seq-1)*ChunkSize of the file.
+type Chunk struct {
+	ID      FileID
+	Packets uint64
+	Seq     uint64
+	Data    []byte
+}
+
+const chunkHeaderSize = len(FileID{}) + 8 + 8
+
+func (c *Chunk) MarshalBinary() ([]byte, error) {
+	b := make([]byte, chunkHeaderSize, chunkHeaderSize+len(c.Data))
+	copy(b, c.ID[:])
+	binary.BigEndian.PutUint64(b[len(c.ID):], c.Packets)
+	binary.BigEndian.PutUint64(b[len(c.ID)+8:], c.Seq)
+	return append(b, c.Data...), nil
+}
+
+func (c *Chunk) UnmarshalBinary(b []byte) error {
+	if len(b) < chunkHeaderSize {
+		return errors.New("chunk too short")
+	}
+	copy(c.ID[:], b)
+	c.Packets = binary.BigEndian.Uint64(b[len(c.ID):])
+	c.Seq = binary.BigEndian.Uint64(b[len(c.ID)+8:])
+	c.Data = b[chunkHeaderSize:]
+	if c.Seq == 0 || c.Seq >= c.Packets || len(c.Data) > ChunkSize {
+		return errors.New("invalid chunk")
+	}
+	return nil
+}
+
+// ChunkACK selectively acknowledges the packets of the file with ID.
+type ChunkACK struct {
+	ID FileID
+	SelectiveACK
+	// Have lists the runs of packets of the file which have arrived, as
+	// half-open ranges, in the answers to its manifest only. It tells the
+	// sender of a file which was interrupted which chunks are still needed.
+	// Only the first maxHaveRanges runs are listed.
+	Have [][2]uint64 `json:",omitempty"`
+}
+
+// maxHaveRanges keeps the answer to a manifest within a datagram.
+const maxHaveRanges = 32
+
+// Has reports whether a tells that packet seq has arrived.
+func (a *ChunkACK) Has(seq uint64) bool {
+	if a.Acked(seq) {
+		return true
+	}
+	for _, r := range a.Have {
+		if r[0] <= seq && seq < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// SendFile sends data, described by m, to targetAddr from conn. The manifest
+// is sent first, as the offer of the file, and only the chunks the receiver
+// doesn't have yet, as it answers once it has accepted it, follow it.
+// Packets are resent until the receiver acknowledges them through acks, see
+// SendReliable.
+func SendFile(
+	ctx context.Context,
+	conn net.PacketConn,
+	targetAddr net.Addr,
+	acks <-chan ChunkACK,
+	m *Manifest,
+	data []byte,
+	progress ProgressFunc,
+) (SendStats, error) {
+	if err := m.Validate(); err != nil {
+		return SendStats{}, err
+	}
+	if uint64(len(data)) != m.Size {
+		return SendStats{}, errors.New("data doesn't match the manifest")
+	}
+
+	manifest, err := EncodeDatagram(KindManifest, m)
+	if err != nil {
+		return SendStats{}, err
+	}
+
+	have, retransmits, err := sendManifest(ctx, conn, targetAddr, acks, manifest)
+	if err != nil {
+		return SendStats{Retransmits: retransmits}, err
+	}
+
+	// the manifest has arrived, so it's left out like the chunks the
+	// receiver has
+	packets := make([][]byte, m.Packets)
+	for seq := uint64(1); seq < m.Packets; seq++ {
+		if have.Has(seq) {
+			continue
+		}
+
+		off := (seq - 1) * ChunkSize
+		end := off + ChunkSize
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+
+		c := &Chunk{ID: m.ID, Packets: m.Packets, Seq: seq, Data: data[off:end]}
+		b, _ := c.MarshalBinary()
+		packets[seq] = append([]byte{KindChunk}, b...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	selective := make(chan SelectiveACK)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case a := <-acks:
+				select {
+				case selective <- a.SelectiveACK:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	stats, err := SendReliable(ctx, conn, targetAddr, packets, selective, progress)
+	// the manifest is counted as sent, not skipped
+	stats.Packets++
+	stats.Skipped--
+	stats.Retransmits += retransmits
+	return stats, err
+}
+
+// sendManifest sends manifest until the receiver answers it, which it only
+// does once it has accepted the file, and returns the answer.
+func sendManifest(
+	ctx context.Context,
+	conn net.PacketConn,
+	targetAddr net.Addr,
+	acks <-chan ChunkACK,
+	manifest []byte,
+) (*ChunkACK, int, error) {
+	deadline := time.Now().Add(OfferTimeout)
+	timeout := InitialRTO
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for retries := 0; ; retries++ {
+		if _, err := conn.WriteTo(manifest, targetAddr); err != nil {
+			return nil, retries, errors.Wrap(err, "failed to send the manifest")
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, retries, ctx.Err()
+			case a := <-acks:
+				if a.Seq == 0 {
+					return &a, retries, nil
+				}
+			case <-timer.C:
+				break wait
+			}
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, retries, errors.Wrap(ErrTransferFailed, "file not accepted in time")
+		}
+		timeout *= 2
+		if timeout > MaxRTO {
+			timeout = MaxRTO
+		}
+		if timeout > left {
+			timeout = left
+		}
+		timer.Reset(timeout)
+	}
+}
+
+// Cancel tells the other end of the transfer of the file with ID that it's
+// been cancelled, whichever end sends it.
+type Cancel struct {
+	ID FileID
+	// Declined is set by a receiver which turned the file down before
+	// accepting it, and Reason tells why if it wasn't the user's choice.
+	Declined bool   `json:",omitempty"`
+	Reason   string `json:",omitempty"`
+}
+
+// FileData is where the chunks of a file are kept as they arrive.
+type FileData interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// IncomingFile is a file whose chunks are arriving.
+type IncomingFile struct {
+	Manifest *Manifest
+	received *Received
+	data     FileData
+}
+
+// NewIncomingFile returns the file described by m, whose chunks are kept in
+// data. received tells which packets of it have arrived already, if it's
+// being resumed, and may be nil otherwise.
+func NewIncomingFile(m *Manifest, data FileData, received *Received) (*IncomingFile, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if received == nil {
+		received = NewReceived(m.Packets)
+	}
+	if received.Total() != m.Packets {
+		return nil, errors.New("received packets don't match the manifest")
+	}
+
+	// the manifest itself has arrived
+	received.Add(0)
+	return &IncomingFile{Manifest: m, received: received, data: data}, nil
+}
+
+// AddChunk adds c to the file, and reports whether it's new.
+func (f *IncomingFile) AddChunk(c *Chunk) (bool, error) {
+	if c.ID != f.Manifest.ID || c.Packets != f.received.Total() {
+		return false, errors.New("chunk doesn't match the file")
+	}
+	if c.Seq == 0 || c.Seq >= c.Packets {
+		return false, errors.New("invalid chunk")
+	}
+
+	off := (c.Seq - 1) * ChunkSize
+	size := f.Manifest.Size - off
+	if size > ChunkSize {
+		size = ChunkSize
+	}
+	if uint64(len(c.Data)) != size {
+		return false, errors.New("chunk doesn't match the size of the file")
+	}
+
+	if f.received.got[c.Seq] {
+		return false, nil
+	}
+	// written before it's marked as arrived, so that it's never taken to have
+	// been kept when it wasn't
+	if _, err := f.data.WriteAt(c.Data, int64(off)); err != nil {
+		return false, errors.Wrapf(err, "failed to keep chunk %d", c.Seq)
+	}
+	f.received.Add(c.Seq)
+	return true, nil
+}
+
+// ACK returns the ACK to answer packet seq of the file with, which tells
+// which packets have arrived if seq is the manifest.
+func (f *IncomingFile) ACK(seq uint64) ChunkACK {
+	a := ChunkACK{ID: f.Manifest.ID, SelectiveACK: f.received.ACK(seq)}
+	if seq == 0 {
+		a.Have = f.received.Ranges(maxHaveRanges)
+	}
+	return a
+}
+
+// Received returns the packets of the file which have arrived, to be kept
+// with its chunks.
+func (f *IncomingFile) Received() *Received {
+	return f.received
+}
+
+// Progress returns how many of the packets of the file have arrived.
+func (f *IncomingFile) Progress() (received, total uint64) {
+	return f.received.Count(), f.received.Total()
+}
+
+// Done reports whether all the packets of the file have arrived.
+func (f *IncomingFile) Done() bool {
+	return f.received.Done()
+}
+
+// Bytes returns the content of the file once all its packets have arrived,
+// checked against its manifest.
+func (f *IncomingFile) Bytes() ([]byte, error) {
+	if !f.Done() {
+		return nil, errors.New("file is incomplete")
+	}
+
+	data := make([]byte, f.Manifest.Size)
+	if n, err := f.data.ReadAt(data, 0); n < len(data) {
+		return nil, errors.Wrap(err, "failed to read the chunks")
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != f.Manifest.SHA256 {
+		return nil, ErrFileCorrupt
+	}
+	return data, nil
+}
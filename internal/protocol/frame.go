@@ -0,0 +1,259 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Versions of the protocol spoken over a stream between peers. Version 0 is
+// the legacy format of a 64-digit decimal length followed by the text, and
+// version 1 the binary frame:
+//
+//	magic "PM" | version | type | flags | length as uvarint | payload
+//
+// Both carry a single message per connection. From version 2 the connection
+// is kept open as a session carrying frames in both directions, which is
+// kept alive with pings. From version 3 texts are sent in message frames,
+// carrying an ID and the time they were sent, which receivers acknowledge
+// with receipts. From version 4 images are sent over UDP as the bytes of
+// their file, in chunks, rather than as pixels.
+//
+// Peers advertise the latest version they speak in their registration, and
+// senders use the latest one both of them know. Readers tell the formats
+// apart by the first byte, which is a digit in the legacy format.
+const (
+	LegacyVersion  = 0
+	FrameVersion   = 1
+	SessionVersion = 2
+	ReceiptVersion = 3
+	ChunkVersion   = 4
+
+	// WireVersion is the latest version spoken by this peer.
+	WireVersion = ChunkVersion
+)
+
+// DefaultMaxFrameSize is the largest payload read in a frame by default.
+const DefaultMaxFrameSize = 1 << 20
+
+// legacyHeaderSize is the size of the decimal length heading a legacy
+// message.
+const legacyHeaderSize = 64
+
+var frameMagic = [2]byte{'P', 'M'}
+
+type FrameType byte
+
+const (
+	FrameText FrameType = 1
+	FramePing FrameType = 2
+	FramePong FrameType = 3
+
+	FrameMessage   FrameType = 4
+	FrameDelivered FrameType = 5
+	FrameRead      FrameType = 6
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameText:
+		return "text"
+	case FramePing:
+		return "ping"
+	case FramePong:
+		return "pong"
+	case FrameMessage:
+		return "message"
+	case FrameDelivered:
+		return "delivered"
+	case FrameRead:
+		return "read"
+	default:
+		return fmt.Sprintf("FrameType(%d)", byte(t))
+	}
+}
+
+// Frame is a message sent over a stream between peers.
+type Frame struct {
+	// Version is the format the frame was read in or is to be written in,
+	// LegacyVersion or FrameVersion.
+	Version byte
+	Type    FrameType
+	// Flags are reserved, written as zero and ignored when read.
+	Flags   byte
+	Payload []byte
+}
+
+var (
+	ErrBadMagic           = errors.New("not a frame")
+	ErrUnsupportedVersion = errors.New("unsupported frame version")
+	ErrMalformedFrame     = errors.New("malformed frame")
+)
+
+// FrameTooLargeError is returned for a frame whose payload exceeds the
+// maximum size of the reader. Its payload isn't read, so nothing more can be
+// read from the stream.
+type FrameTooLargeError struct {
+	Size uint64
+	Max  int
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("frame of %d bytes exceeds the maximum of %d", e.Size, e.Max)
+}
+
+// UnexpectedFrameError is returned for a frame of a type that isn't
+// expected where it's read.
+type UnexpectedFrameError struct {
+	Type FrameType
+}
+
+func (e *UnexpectedFrameError) Error() string {
+	return fmt.Sprintf("unexpected %s frame", e.Type)
+}
+
+// NegotiateVersion returns the version to speak to a peer which advertised
+// peerVersion as the latest it speaks.
+func NegotiateVersion(peerVersion int) int {
+	if peerVersion <= LegacyVersion {
+		return LegacyVersion
+	}
+	if peerVersion > WireVersion {
+		return WireVersion
+	}
+	return peerVersion
+}
+
+// FrameFormat returns the format frames are written in when speaking
+// version.
+func FrameFormat(version int) byte {
+	if version == LegacyVersion {
+		return LegacyVersion
+	}
+	return FrameVersion
+}
+
+// WriteFrame writes f to w in the format of its version.
+func WriteFrame(w io.Writer, f *Frame) error {
+	switch f.Version {
+	case LegacyVersion:
+		if f.Type != FrameText {
+			return errors.Errorf("%s frames can't be written in the legacy format", f.Type)
+		}
+		_, err := io.WriteString(w, fmt.Sprintf("%0*d%s", legacyHeaderSize, len(f.Payload), f.Payload))
+		return err
+	case FrameVersion:
+		b := make([]byte, 0, len(frameMagic)+3+binary.MaxVarintLen64+len(f.Payload))
+		b = append(b, frameMagic[:]...)
+		b = append(b, f.Version, byte(f.Type), f.Flags)
+		b = binary.AppendUvarint(b, uint64(len(f.Payload)))
+		b = append(b, f.Payload...)
+		_, err := w.Write(b)
+		return err
+	default:
+		return errors.Wrapf(ErrUnsupportedVersion, "version %d", f.Version)
+	}
+}
+
+// FrameReader reads the frames of a stream, in any version.
+type FrameReader struct {
+	r       *bufio.Reader
+	maxSize int
+}
+
+// NewFrameReader returns a reader of the frames of r whose payloads are at
+// most maxSize bytes, or DefaultMaxFrameSize if maxSize isn't positive, as
+// no bound would let a peer make it allocate any length.
+func NewFrameReader(r io.Reader, maxSize int) *FrameReader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	return &FrameReader{
+		r:       bufio.NewReader(r),
+		maxSize: maxSize,
+	}
+}
+
+// ReadFrame reads the next frame. It returns io.EOF only if the stream ended
+// cleanly before the frame, and io.ErrUnexpectedEOF if it ended within it.
+func (fr *FrameReader) ReadFrame() (*Frame, error) {
+	first, err := fr.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		return fr.readLegacy()
+	}
+
+	var header [len(frameMagic) + 3]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if header[0] != frameMagic[0] || header[1] != frameMagic[1] {
+		return nil, ErrBadMagic
+	}
+
+	f := &Frame{
+		Version: header[2],
+		Type:    FrameType(header[3]),
+		Flags:   header[4],
+	}
+	if f.Version != FrameVersion {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "version %d", f.Version)
+	}
+
+	size, err := binary.ReadUvarint(fr.r)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(ErrMalformedFrame, err.Error())
+	}
+
+	f.Payload, err = fr.readPayload(size)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fr *FrameReader) readLegacy() (*Frame, error) {
+	var header [legacyHeaderSize]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	size, err := strconv.ParseUint(string(header[:]), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformedFrame, "invalid length in legacy header")
+	}
+
+	payload, err := fr.readPayload(size)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{Version: LegacyVersion, Type: FrameText, Payload: payload}, nil
+}
+
+func (fr *FrameReader) readPayload(size uint64) ([]byte, error) {
+	if size > uint64(fr.maxSize) {
+		return nil, &FrameTooLargeError{Size: size, Max: fr.maxSize}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return payload, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
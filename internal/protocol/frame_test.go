@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{"legacy text", Frame{Version: LegacyVersion, Type: FrameText, Payload: []byte("hello")}},
+		{"legacy empty", Frame{Version: LegacyVersion, Type: FrameText, Payload: []byte{}}},
+		{"text", Frame{Version: FrameVersion, Type: FrameText, Payload: []byte("hello")}},
+		{"ping", Frame{Version: FrameVersion, Type: FramePing, Payload: []byte{}}},
+		{"large", Frame{Version: FrameVersion, Type: FrameMessage, Payload: bytes.Repeat([]byte{0xab}, 300)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteFrame(&buf, &tt.frame); err != nil {
+				t.Fatal(err)
+			}
+			// a second frame after it is read on its own
+			if err := WriteFrame(&buf, &tt.frame); err != nil {
+				t.Fatal(err)
+			}
+
+			fr := NewFrameReader(&buf, 1024)
+			for i := 0; i < 2; i++ {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if f.Version != tt.frame.Version || f.Type != tt.frame.Type || !bytes.Equal(f.Payload, tt.frame.Payload) {
+					t.Errorf("read %+v, want %+v", f, tt.frame)
+				}
+			}
+			if _, err := fr.ReadFrame(); err != io.EOF {
+				t.Errorf("err = %v at the end of the stream, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestWriteFrameErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   Frame
+		wantErr error
+	}{
+		{"legacy ping", Frame{Version: LegacyVersion, Type: FramePing}, nil},
+		{"unknown version", Frame{Version: 9, Type: FrameText}, ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := WriteFrame(io.Discard, &tt.frame)
+			if err == nil {
+				t.Fatal("frame written")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	legacy := func(size int, payload string) string {
+		return fmt.Sprintf("%0*d%s", legacyHeaderSize, size, payload)
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		maxSize int
+		wantErr error
+		// tooLarge is whether a *FrameTooLargeError is wanted.
+		tooLarge bool
+	}{
+		{name: "empty", input: "", wantErr: io.EOF},
+		{name: "bad magic", input: "XM\x01\x01\x00\x00", wantErr: ErrBadMagic},
+		{name: "version mismatch", input: "PM\x02\x01\x00\x00", wantErr: ErrUnsupportedVersion},
+		{name: "version zero", input: "PM\x00\x01\x00\x00", wantErr: ErrUnsupportedVersion},
+		{name: "truncated header", input: "PM\x01", wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated length", input: "PM\x01\x01\x00\x80", wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated payload", input: "PM\x01\x01\x00\x05abc", wantErr: io.ErrUnexpectedEOF},
+		{name: "malformed length", input: "PM\x01\x01\x00" + strings.Repeat("\xff", 10) + "\x01", wantErr: ErrMalformedFrame},
+		{name: "too large", input: "PM\x01\x01\x00\x05hello", maxSize: 4, tooLarge: true},
+		{name: "too large by default", input: "PM\x01\x01\x00\x81\x80\x40", tooLarge: true},
+		{name: "legacy truncated header", input: "0000", wantErr: io.ErrUnexpectedEOF},
+		{name: "legacy truncated payload", input: legacy(5, "abc"), wantErr: io.ErrUnexpectedEOF},
+		{name: "legacy malformed length", input: "0" + strings.Repeat("x", legacyHeaderSize-1), wantErr: ErrMalformedFrame},
+		{name: "legacy too large", input: legacy(5, "hello"), maxSize: 4, tooLarge: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFrameReader(strings.NewReader(tt.input), tt.maxSize).ReadFrame()
+			if err == nil {
+				t.Fatal("frame read")
+			}
+
+			var large *FrameTooLargeError
+			if tt.tooLarge {
+				if !errors.As(err, &large) {
+					t.Errorf("err = %v, want a FrameTooLargeError", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		peer, want int
+	}{
+		{-1, LegacyVersion},
+		{LegacyVersion, LegacyVersion},
+		{FrameVersion, FrameVersion},
+		{WireVersion, WireVersion},
+		{WireVersion + 1, WireVersion},
+	}
+	for _, tt := range tests {
+		if got := NegotiateVersion(tt.peer); got != tt.want {
+			t.Errorf("NegotiateVersion(%d) = %d, want %d", tt.peer, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MessageID identifies a text message, unique across peers.
+type MessageID [16]byte
+
+// NewMessageID returns a random message ID.
+func NewMessageID() MessageID {
+	var id MessageID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// ParseMessageID parses the hex form of an ID.
+func ParseMessageID(s string) (MessageID, error) {
+	var id MessageID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, errors.Errorf("invalid message ID %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func (id MessageID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Short returns the prefix of the ID shown to users.
+func (id MessageID) Short() string {
+	return id.String()[:8]
+}
+
+func (id MessageID) IsZero() bool {
+	return id == MessageID{}
+}
+
+// Message is the payload of a message frame:
+//
+//	ID | time sent in Unix nanoseconds, big-endian int64 | UTF-8 text
+type Message struct {
+	ID   MessageID
+	Sent time.Time
+	Text string
+}
+
+const messageHeaderSize = len(MessageID{}) + 8
+
+func (m *Message) MarshalBinary() ([]byte, error) {
+	b := make([]byte, messageHeaderSize, messageHeaderSize+len(m.Text))
+	copy(b, m.ID[:])
+	binary.BigEndian.PutUint64(b[len(m.ID):], uint64(m.Sent.UnixNano()))
+	return append(b, m.Text...), nil
+}
+
+func (m *Message) UnmarshalBinary(b []byte) error {
+	if len(b) < messageHeaderSize {
+		return errors.Wrap(ErrMalformedFrame, "message too short")
+	}
+	copy(m.ID[:], b)
+	m.Sent = time.Unix(0, int64(binary.BigEndian.Uint64(b[len(m.ID):])))
+	m.Text = string(b[messageHeaderSize:])
+	return nil
+}
+
+// EncodeReceipt returns the payload of a delivery or read receipt for ids.
+func EncodeReceipt(ids ...MessageID) []byte {
+	b := make([]byte, 0, len(ids)*len(MessageID{}))
+	for _, id := range ids {
+		b = append(b, id[:]...)
+	}
+	return b
+}
+
+// DecodeReceipt returns the IDs of the messages a receipt is for.
+func DecodeReceipt(b []byte) ([]MessageID, error) {
+	if len(b)%len(MessageID{}) != 0 {
+		return nil, errors.Wrap(ErrMalformedFrame, "receipt isn't a list of message IDs")
+	}
+	ids := make([]MessageID, len(b)/len(MessageID{}))
+	for i := range ids {
+		copy(ids[i][:], b[i*len(MessageID{}):])
+	}
+	return ids, nil
+}
@@ -1,17 +1,12 @@
 package protocol
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"image/color"
-	"log"
 	"net"
-	"runtime"
-	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
-	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -21,9 +16,6 @@ const (
 
 	DefaultTimeout = 5 * time.Second
 	ImageTimeout   = 30 * time.Second
-
-	MaxRetries = 3
-	opt = false
 )
 
 type ImagePacket struct {
@@ -36,190 +28,162 @@ type ImagePacket struct {
 	Pixels   [PayloadPixelsCount]uint32
 }
 
+// Seq returns the number of the packet within its image, counting row by
+// row.
+func (p *ImagePacket) Seq() uint64 {
+	return p.Row*packetsPerRow(p.Width) + p.Offset
+}
+
+// PacketsCount returns how many packets the image is sent in.
+func (p *ImagePacket) PacketsCount() uint64 {
+	return p.Height * packetsPerRow(p.Width)
+}
+
+func packetsPerRow(width uint64) uint64 {
+	return (width + PayloadPixelsCount - 1) / PayloadPixelsCount
+}
+
+// ImageACKPacket acknowledges the packet at Row and Offset, and selectively
+// the others which have arrived, numbered as by ImagePacket.Seq.
 type ImageACKPacket struct {
 	Username string
 	Filename string
 	Flag     bool
 	Row      uint64
 	Offset   uint64
+	// Next and Bitmap are as in SelectiveACK. Older receivers leave them
+	// out, acknowledging a single packet.
+	Next   uint64 `json:",omitempty"`
+	Bitmap []byte `json:",omitempty"`
 }
 
-func SendImage(targetAddr string, pixels [][]color.RGBA, filename string, sender string) error {
-	if len(filename) > FilenameMaxLength {
-		return errors.New("filename length exceeded")
+// NewImageACK returns the ACK to answer p with, given the packets of its
+// image which have arrived.
+func NewImageACK(p *ImagePacket, received *Received) ImageACKPacket {
+	a := received.ACK(p.Seq())
+	return ImageACKPacket{
+		Username: p.Sender,
+		Filename: p.Filename,
+		Flag:     true,
+		Row:      p.Row,
+		Offset:   p.Offset,
+		Next:     a.Next,
+		Bitmap:   a.Bitmap,
 	}
+}
 
-	if len(sender) > UsernameMaxLength {
-		return errors.New("username length exceeded")
+// SendImage sends pixels to targetAddr from conn, which must be the socket
+// the sender listens on so that the hole punched for it is used. Packets are
+// resent until the receiver acknowledges them through acks, see
+// SendReliable.
+func SendImage(
+	ctx context.Context,
+	conn net.PacketConn,
+	targetAddr net.Addr,
+	acks <-chan ImageACKPacket,
+	pixels [][]color.RGBA,
+	filename string,
+	sender string,
+	progress ProgressFunc,
+) (SendStats, error) {
+	if len(filename) > FilenameMaxLength {
+		return SendStats{}, errors.New("filename length exceeded")
 	}
 
-	conn, err := net.DialTimeout("udp", targetAddr, DefaultTimeout)
-	if err != nil {
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return errors.Wrapf(err, "%s timeout reached when dialling %s", DefaultTimeout, targetAddr)
-		}
-		return err
+	if len(sender) > UsernameMaxLength {
+		return SendStats{}, errors.New("username length exceeded")
 	}
 
-	defer conn.Close()
-
-	type rowOffsetPair struct {
-		row    uint64
-		offset uint64
+	if len(pixels) == 0 || len(pixels[0]) == 0 {
+		return SendStats{}, errors.New("empty image")
 	}
-	acks := make(map[rowOffsetPair]bool)
-	go func() {
-		buf := make([]byte, 1024)
 
-		conn.SetReadDeadline(time.Now().Add(DefaultTimeout))
-		n, err := conn.Read(buf)
-		if err != nil {
-			// fix:
-			panic(err)
-		}
+	var (
+		width   = uint64(len(pixels[0]))
+		packets [][]byte
+	)
+	for i, row := range pixels {
+		var packetPixels [PayloadPixelsCount]uint32
+		for j, pix := range row {
+			packetPixels[j%PayloadPixelsCount] = uint32(pix.R)<<24 + uint32(pix.G)<<16 + uint32(pix.B)<<8 + uint32(pix.A)
+
+			if j%PayloadPixelsCount != PayloadPixelsCount-1 && j != len(row)-1 {
+				continue
+			}
 
-		var pckt ImageACKPacket
-		if err := json.Unmarshal(buf[:n], &pckt); err != nil {
-			panic(err)
+			b, err := EncodeDatagram(KindImage, ImagePacket{
+				Sender:   sender,
+				Filename: filename,
+				Width:    width,
+				Height:   uint64(len(pixels)),
+				Row:      uint64(i),
+				Offset:   uint64(j / PayloadPixelsCount),
+				Pixels:   packetPixels,
+			})
+			if err != nil {
+				return SendStats{}, err
+			}
+			packets = append(packets, b)
 		}
+	}
 
-		acks[rowOffsetPair{pckt.Row, pckt.Offset}] = true
-	}()
-
-	var packetPixels [PayloadPixelsCount]uint32
-	var packetsCount int
-
-	var group errgroup.Group
-	group.SetLimit(runtime.NumCPU())
-
-	limiter := time.NewTicker(100 * time.Millisecond)
-	errorChan := make(chan error, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	sacks := make(chan SelectiveACK)
 	go func() {
-		for i, row := range pixels {
-			for j, pix := range row {
-				packetPixels[j%PayloadPixelsCount] = uint32(pix.R)<<24 + uint32(pix.G)<<16 + uint32(pix.B)<<8 + uint32(pix.A)
-
-				if j%PayloadPixelsCount != PayloadPixelsCount-1 {
-					if j != len(row)-1 {
-						continue
-					}
-				}
-
-				pckt := ImagePacket{
-					Sender:   sender,
-					Filename: filename,
-					Width:    uint64(len(pixels[0])),
-					Height:   uint64(len(pixels)),
-					Row:      uint64(i),
-					Offset:   uint64(j / PayloadPixelsCount),
-					Pixels:   packetPixels,
-				}
-
-				b, err := json.Marshal(pckt)
-				if err != nil {
-					panic(err)
-				}
-
-				packetsCount++
-
-				group.Go(func() error {
-					<-limiter.C
-
-					if opt {
-						var ack bool
-					RetryLoop:
-						for i := 0; i < MaxRetries; i++ {
-							conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
-							_, err := conn.Write(b)
-							if err != nil {
-								return err
-							}
-
-							for i, t := 0, time.NewTicker(2*DefaultTimeout/20); i < 20; i++ {
-								<-t.C
-								if acks[rowOffsetPair{pckt.Row, pckt.Offset}] {
-									ack = true
-									break RetryLoop
-								}
-							}
-						}
-						if !ack {
-							err := errors.New("3 retries and still no ack received")
-							errorChan <- err
-							return err
-						}
-					} else {
-						conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
-						_, err := conn.Write(b)
-						if err != nil {
-							return err
-						}
-					}
-					return nil
-				})
+		for {
+			var a ImageACKPacket
+			select {
+			case <-ctx.Done():
+				return
+			case a = <-acks:
 			}
-		}
-
-		log.Printf("a total of %d packets sent\n", packetsCount)
 
-		errorChan <- group.Wait()
+			sack := SelectiveACK{
+				Seq:    a.Row*packetsPerRow(width) + a.Offset,
+				Next:   a.Next,
+				Bitmap: a.Bitmap,
+			}
+			select {
+			case sacks <- sack:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 
-	for err := range errorChan {
-		return err
-	}
-
-	return nil
+	return SendReliable(ctx, conn, targetAddr, packets, sacks, progress)
 }
 
-func SendText(targetAddr string, text string) error {
-	conn, err := net.DialTimeout("tcp", targetAddr, DefaultTimeout)
-	if err != nil {
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return errors.Wrapf(err, "%s timeout reached when dialling %s", DefaultTimeout, targetAddr)
-		}
-		return err
-	}
-
-	defer conn.Close()
-
-	msg := fmt.Sprintf("%064d%s", len(text), text)
+// SendText sends text over conn in the format of version.
+func SendText(conn net.Conn, text string, version byte) error {
 	conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
-	_, err = conn.Write([]byte(msg))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	err := WriteFrame(conn, &Frame{Version: version, Type: FrameText, Payload: []byte(text)})
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
-			return errors.Wrapf(err, "%s timeout reached when writing message to %s", DefaultTimeout, targetAddr)
+			return errors.Wrapf(err, "%s timeout reached when writing message to %s", DefaultTimeout, conn.RemoteAddr())
 		}
 	}
 	return err
 }
 
-func ReceiveText(conn net.Conn) (res []byte, err error) {
-	buf := make([]byte, 64)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return
-	}
-	if n != 64 {
-		err = errors.New("could not read 64 header bytes")
-		return
-	}
-
-	msgLen, err := strconv.Atoi(string(buf))
-	if err != nil {
-		panic(err)
+// DialAny connects to the first of addrs that accepts a connection.
+func DialAny(network string, addrs []string) (conn net.Conn, err error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address to dial")
 	}
 
-	res = make([]byte, msgLen)
-	n, err = conn.Read(res)
-	if err != nil {
-		res = nil
-		return
-	}
-	if n != msgLen {
-		return nil, errors.New("could not read the whole message")
+	for _, addr := range addrs {
+		conn, err = net.DialTimeout(network, addr, DefaultTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = errors.Wrapf(err, "%s timeout reached when dialling %s", DefaultTimeout, addr)
+		}
 	}
-
-	return
+	return nil, err
 }
@@ -0,0 +1,482 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// InitialWindow and MaxWindow bound how many packets of a transfer may be
+	// in flight. The window grows by a packet for every packet acknowledged
+	// until one is lost, which halves it, and then by a packet for every
+	// window acknowledged, as TCP's does.
+	InitialWindow = 8
+	MaxWindow     = 256
+
+	// InitialRTO is how long a packet is waited for to be acknowledged before
+	// the round trip time has been measured. The timeout is then derived from
+	// the measurements as in RFC 6298, within MinRTO and MaxRTO.
+	InitialRTO = time.Second
+	MinRTO     = 200 * time.Millisecond
+	MaxRTO     = 10 * time.Second
+
+	// MaxRetransmits is how many times a packet is resent before the
+	// transfer is given up on.
+	MaxRetransmits = 8
+
+	// sackBits is how many of the packets after the first missing one a
+	// selective ACK tells about.
+	sackBits = 256
+)
+
+// ErrTransferFailed is returned when a packet of a transfer is never
+// acknowledged.
+var ErrTransferFailed = errors.New("transfer failed")
+
+// SelectiveACK tells the sender which packets of a transfer have arrived.
+type SelectiveACK struct {
+	// Seq is the packet which the ACK answers, whose round trip is measured.
+	Seq uint64
+	// Next is the first packet which hasn't arrived. All the ones before it
+	// have.
+	Next uint64
+	// Bitmap marks the packets after Next which have arrived: bit i of byte j
+	// stands for packet Next+1+8*j+i.
+	Bitmap []byte
+}
+
+// Acked reports whether a tells that packet seq has arrived.
+func (a *SelectiveACK) Acked(seq uint64) bool {
+	if seq == a.Seq || seq < a.Next {
+		return true
+	}
+	if seq == a.Next {
+		return false
+	}
+	i := seq - a.Next - 1
+	return i/8 < uint64(len(a.Bitmap)) && a.Bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// Received keeps track of the packets of a transfer which have arrived, to
+// acknowledge them selectively.
+type Received struct {
+	got   []bool
+	next  uint64
+	count uint64
+}
+
+// NewReceived returns the tracker of a transfer of total packets.
+func NewReceived(total uint64) *Received {
+	return &Received{got: make([]bool, total)}
+}
+
+// Add marks packet seq as arrived, and reports whether it's new.
+func (r *Received) Add(seq uint64) bool {
+	if seq >= uint64(len(r.got)) || r.got[seq] {
+		return false
+	}
+
+	r.got[seq] = true
+	r.count++
+	for r.next < uint64(len(r.got)) && r.got[r.next] {
+		r.next++
+	}
+	return true
+}
+
+// Count returns how many distinct packets have arrived.
+func (r *Received) Count() uint64 {
+	return r.count
+}
+
+// Total returns how many packets the transfer has.
+func (r *Received) Total() uint64 {
+	return uint64(len(r.got))
+}
+
+// Done reports whether all the packets have arrived.
+func (r *Received) Done() bool {
+	return r.count == uint64(len(r.got))
+}
+
+// Ranges returns the runs of packets which have arrived, as half-open
+// ranges, up to max of them.
+func (r *Received) Ranges(max int) [][2]uint64 {
+	var ranges [][2]uint64
+	for seq := uint64(0); seq < uint64(len(r.got)) && len(ranges) < max; seq++ {
+		if !r.got[seq] {
+			continue
+		}
+		start := seq
+		for seq < uint64(len(r.got)) && r.got[seq] {
+			seq++
+		}
+		ranges = append(ranges, [2]uint64{start, seq})
+	}
+	return ranges
+}
+
+// MarshalBinary returns a bitmap of the packets which have arrived: bit i of
+// byte j stands for packet 8*j+i.
+func (r *Received) MarshalBinary() ([]byte, error) {
+	b := make([]byte, (len(r.got)+7)/8)
+	for seq, got := range r.got {
+		if got {
+			b[seq/8] |= 1 << (seq % 8)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary marks the packets in a bitmap returned by MarshalBinary as
+// arrived. r must have been returned by NewReceived for as many packets.
+func (r *Received) UnmarshalBinary(b []byte) error {
+	if len(b) != (len(r.got)+7)/8 {
+		return errors.New("bitmap doesn't match the packets")
+	}
+	for seq := range r.got {
+		if b[seq/8]&(1<<(seq%8)) != 0 {
+			r.Add(uint64(seq))
+		}
+	}
+	return nil
+}
+
+// ACK returns the ACK to answer packet seq with.
+func (r *Received) ACK(seq uint64) SelectiveACK {
+	a := SelectiveACK{Seq: seq, Next: r.next}
+
+	var bitmap [sackBits / 8]byte
+	last := -1
+	for i := 0; i < sackBits; i++ {
+		p := r.next + 1 + uint64(i)
+		if p >= uint64(len(r.got)) {
+			break
+		}
+		if r.got[p] {
+			bitmap[i/8] |= 1 << (i % 8)
+			last = i
+		}
+	}
+	if last >= 0 {
+		a.Bitmap = bitmap[:last/8+1]
+	}
+	return a
+}
+
+// ProgressFunc is told how many of the packets of a transfer have arrived so
+// far, as the transfer goes on.
+type ProgressFunc func(done, total uint64)
+
+// SendStats describes a completed transfer.
+type SendStats struct {
+	Packets     int
+	Retransmits int
+	// Skipped is how many packets weren't sent as the receiver already had
+	// them.
+	Skipped int
+	// RTT is the smoothed round trip time measured, zero if none could be.
+	RTT      time.Duration
+	Duration time.Duration
+}
+
+// SendReliable sends packets to addr through conn, resending each one until
+// it's acknowledged through acks. At most a window of packets are in flight
+// at a time, and a packet is resent once its retransmission timeout passes,
+// which is derived from the round trips measured. Nil packets are taken to
+// have arrived already and aren't sent. progress, if not nil, is told about
+// every packet acknowledged.
+func SendReliable(
+	ctx context.Context,
+	conn net.PacketConn,
+	addr net.Addr,
+	packets [][]byte,
+	acks <-chan SelectiveACK,
+	progress ProgressFunc,
+) (SendStats, error) {
+	return newSender(conn, addr, packets, acks, progress).run(ctx)
+}
+
+func newSender(conn net.PacketConn, addr net.Addr, packets [][]byte, acks <-chan SelectiveACK, progress ProgressFunc) *sender {
+	s := &sender{
+		conn:      conn,
+		addr:      addr,
+		acks:      acks,
+		progress:  progress,
+		packets:   packets,
+		sent:      make([]time.Time, len(packets)),
+		retries:   make([]int, len(packets)),
+		acked:     make([]bool, len(packets)),
+		window:    InitialWindow,
+		slowStart: true,
+		rto:       InitialRTO,
+	}
+	for seq, p := range packets {
+		if p == nil {
+			s.acked[seq] = true
+			s.stats.Skipped++
+		}
+	}
+	s.ackedCount = s.stats.Skipped
+	return s
+}
+
+type sender struct {
+	conn     net.PacketConn
+	addr     net.Addr
+	acks     <-chan SelectiveACK
+	progress ProgressFunc
+	packets  [][]byte
+
+	// sent is when every packet was last sent, and retries how many times it
+	// was resent.
+	sent       []time.Time
+	retries    []int
+	acked      []bool
+	ackedCount int
+
+	// base is the first packet not acknowledged, and next the first one
+	// never sent.
+	base, next int
+	inFlight   int
+	window     int
+	// slowStart is whether no packet has been lost yet, and grown how many
+	// packets have been acknowledged since the window last grew after.
+	slowStart bool
+	grown     int
+	// lastCut is when the window was last halved, so that a burst of losses
+	// only halves it once.
+	lastCut time.Time
+
+	srtt, rttvar, rto time.Duration
+	stats             SendStats
+}
+
+func (s *sender) run(ctx context.Context) (SendStats, error) {
+	start := time.Now()
+	s.stats.Packets = len(s.packets) - s.stats.Skipped
+	for s.base < len(s.packets) && s.acked[s.base] {
+		s.base++
+	}
+
+	s.report()
+
+	timer := time.NewTimer(s.rto)
+	defer timer.Stop()
+
+	for s.base < len(s.packets) {
+		for s.next < len(s.packets) && s.inFlight < s.window {
+			if s.acked[s.next] {
+				s.next++
+				continue
+			}
+			if err := s.send(s.next); err != nil {
+				return s.stats, err
+			}
+			s.next++
+			s.inFlight++
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(s.deadline()))
+
+		select {
+		case <-ctx.Done():
+			return s.stats, ctx.Err()
+		case a := <-s.acks:
+			if err := s.ack(a); err != nil {
+				return s.stats, err
+			}
+		case <-timer.C:
+			if err := s.resendExpired(); err != nil {
+				return s.stats, err
+			}
+		}
+	}
+
+	s.stats.RTT = s.srtt
+	s.stats.Duration = time.Since(start)
+	return s.stats, nil
+}
+
+func (s *sender) send(seq int) error {
+	// no write deadline, the socket may be shared with the receiver
+	if _, err := s.conn.WriteTo(s.packets[seq], s.addr); err != nil {
+		return errors.Wrapf(err, "failed to send packet %d", seq)
+	}
+	s.sent[seq] = time.Now()
+	return nil
+}
+
+// timeout returns how long packet seq is waited for to be acknowledged,
+// which doubles with every time it's resent.
+func (s *sender) timeout(seq int) time.Duration {
+	d := s.rto
+	for i := 0; i < s.retries[seq] && d < MaxRTO; i++ {
+		d *= 2
+	}
+	if d > MaxRTO {
+		d = MaxRTO
+	}
+	return d
+}
+
+// deadline returns when the first packet in flight times out.
+func (s *sender) deadline() time.Time {
+	var first time.Time
+	for seq := s.base; seq < s.next; seq++ {
+		if s.acked[seq] {
+			continue
+		}
+		if d := s.sent[seq].Add(s.timeout(seq)); first.IsZero() || d.Before(first) {
+			first = d
+		}
+	}
+	return first
+}
+
+func (s *sender) ack(a SelectiveACK) error {
+	if a.Seq >= uint64(s.next) {
+		return nil
+	}
+	now := time.Now()
+
+	// only the round trips of packets sent once are measured, as it can't be
+	// told which sending the ACK of a resent packet answers
+	if !s.acked[a.Seq] && s.retries[a.Seq] == 0 {
+		s.measure(now.Sub(s.sent[a.Seq]))
+	}
+
+	for seq := s.base; seq < s.next; seq++ {
+		if s.acked[seq] || !a.Acked(uint64(seq)) {
+			continue
+		}
+		s.acked[seq] = true
+		s.ackedCount++
+		s.inFlight--
+		s.grow()
+	}
+	for s.base < s.next && s.acked[s.base] {
+		s.base++
+	}
+	s.report()
+
+	// a packet sent before one which has been acknowledged is taken to be
+	// lost once it's later than round trips vary by, or half a round trip,
+	// which leaves room for the packets to be reordered, like RACK (RFC 8985)
+	// does
+	if s.srtt == 0 {
+		return nil
+	}
+	late := s.srtt + 4*s.rttvar
+	if late < s.srtt*3/2 {
+		late = s.srtt * 3 / 2
+	}
+	for seq := s.base; seq < s.next && uint64(seq) <= a.Next+sackBits; seq++ {
+		if s.acked[seq] || !s.sent[seq].Before(s.sent[a.Seq]) || now.Sub(s.sent[seq]) < late {
+			continue
+		}
+		if s.retries[seq] >= MaxRetransmits {
+			// left to time out
+			continue
+		}
+		if err := s.resend(seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sender) report() {
+	if s.progress != nil {
+		s.progress(uint64(s.ackedCount), uint64(len(s.packets)))
+	}
+}
+
+// measure updates the retransmission timeout with a round trip as in RFC
+// 6298.
+func (s *sender) measure(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt, s.rttvar = rtt, rtt/2
+	} else {
+		diff := s.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		s.rttvar = (3*s.rttvar + diff) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+
+	s.rto = s.srtt + 4*s.rttvar
+	if s.rto < MinRTO {
+		s.rto = MinRTO
+	}
+	if s.rto > MaxRTO {
+		s.rto = MaxRTO
+	}
+}
+
+// resendExpired resends the packets in flight which have timed out.
+func (s *sender) resendExpired() error {
+	now := time.Now()
+	for seq := s.base; seq < s.next; seq++ {
+		if s.acked[seq] || now.Before(s.sent[seq].Add(s.timeout(seq))) {
+			continue
+		}
+		if s.retries[seq] >= MaxRetransmits {
+			return errors.Wrapf(ErrTransferFailed, "packet %d not acknowledged after %d retransmissions", seq, MaxRetransmits)
+		}
+		if err := s.resend(seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resend sends packet seq again as it's taken to be lost, which halves the
+// window once a round trip.
+func (s *sender) resend(seq int) error {
+	now := time.Now()
+	rtt := s.srtt
+	if rtt == 0 {
+		rtt = s.rto
+	}
+	if now.Sub(s.lastCut) > rtt {
+		// never below two packets, or a loss could only be told by a timeout
+		s.window /= 2
+		if s.window < 2 {
+			s.window = 2
+		}
+		s.slowStart = false
+		s.grown = 0
+		s.lastCut = now
+	}
+
+	s.retries[seq]++
+	s.stats.Retransmits++
+	return s.send(seq)
+}
+
+// grow grows the window as a packet is acknowledged.
+func (s *sender) grow() {
+	if s.window == MaxWindow {
+		return
+	}
+	if s.slowStart {
+		s.window++
+		return
+	}
+	s.grown++
+	if s.grown >= s.window {
+		s.window++
+		s.grown = 0
+	}
+}
@@ -0,0 +1,472 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelectiveACKAcked(t *testing.T) {
+	a := SelectiveACK{Seq: 12, Next: 3, Bitmap: []byte{0b00000101, 0b10000000}}
+
+	tests := []struct {
+		seq  uint64
+		want bool
+	}{
+		{0, true},
+		{2, true},
+		{3, false},
+		{4, true},
+		{5, false},
+		{6, true},
+		{7, false},
+		{12, true},
+		{19, true},
+		{20, false},
+		{1000, false},
+	}
+	for _, tt := range tests {
+		if got := a.Acked(tt.seq); got != tt.want {
+			t.Errorf("Acked(%d) = %v, want %v", tt.seq, got, tt.want)
+		}
+	}
+}
+
+func TestReceived(t *testing.T) {
+	tests := []struct {
+		name       string
+		total      uint64
+		add        []uint64
+		wantCount  uint64
+		wantNext   uint64
+		wantBitmap []byte
+		wantRanges [][2]uint64
+	}{
+		{
+			name:  "none",
+			total: 10,
+		},
+		{
+			name:       "in order",
+			total:      10,
+			add:        []uint64{0, 1, 2},
+			wantCount:  3,
+			wantNext:   3,
+			wantRanges: [][2]uint64{{0, 3}},
+		},
+		{
+			name:       "reordered with gaps",
+			total:      20,
+			add:        []uint64{0, 4, 2, 3, 9, 10},
+			wantCount:  6,
+			wantNext:   1,
+			wantBitmap: []byte{0b10000111, 0b00000001},
+			wantRanges: [][2]uint64{{0, 1}, {2, 5}, {9, 11}},
+		},
+		{
+			name:       "duplicates and out of range",
+			total:      4,
+			add:        []uint64{1, 1, 7, 3},
+			wantCount:  2,
+			wantNext:   0,
+			wantBitmap: []byte{0b00000101},
+			wantRanges: [][2]uint64{{1, 2}, {3, 4}},
+		},
+		{
+			name:       "all",
+			total:      3,
+			add:        []uint64{2, 0, 1},
+			wantCount:  3,
+			wantNext:   3,
+			wantRanges: [][2]uint64{{0, 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReceived(tt.total)
+			for _, seq := range tt.add {
+				r.Add(seq)
+			}
+
+			if r.Count() != tt.wantCount {
+				t.Errorf("Count() = %d, want %d", r.Count(), tt.wantCount)
+			}
+			if r.Done() != (tt.wantCount == tt.total) {
+				t.Errorf("Done() = %v with %d of %d packets", r.Done(), tt.wantCount, tt.total)
+			}
+
+			a := r.ACK(7)
+			if a.Seq != 7 || a.Next != tt.wantNext || string(a.Bitmap) != string(tt.wantBitmap) {
+				t.Errorf("ACK(7) = %+v, want next %d and bitmap %08b", a, tt.wantNext, tt.wantBitmap)
+			}
+			for _, seq := range tt.add {
+				if seq < tt.total && !a.Acked(seq) {
+					t.Errorf("ACK doesn't acknowledge packet %d", seq)
+				}
+			}
+
+			ranges := r.Ranges(10)
+			if len(ranges) != len(tt.wantRanges) {
+				t.Fatalf("Ranges() = %v, want %v", ranges, tt.wantRanges)
+			}
+			for i := range ranges {
+				if ranges[i] != tt.wantRanges[i] {
+					t.Fatalf("Ranges() = %v, want %v", ranges, tt.wantRanges)
+				}
+			}
+			if len(tt.wantRanges) > 1 && len(r.Ranges(1)) != 1 {
+				t.Errorf("Ranges(1) returned %d ranges", len(r.Ranges(1)))
+			}
+		})
+	}
+}
+
+func TestReceivedBinary(t *testing.T) {
+	tests := []struct {
+		name  string
+		total uint64
+		add   []uint64
+	}{
+		{"empty", 0, nil},
+		{"none", 9, nil},
+		{"some", 9, []uint64{0, 3, 8}},
+		{"all", 8, []uint64{0, 1, 2, 3, 4, 5, 6, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReceived(tt.total)
+			for _, seq := range tt.add {
+				r.Add(seq)
+			}
+			b, err := r.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := NewReceived(tt.total)
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+			if got.Count() != r.Count() || got.ACK(0).Next != r.ACK(0).Next {
+				t.Errorf("got %d packets from next %d, want %d from %d",
+					got.Count(), got.ACK(0).Next, r.Count(), r.ACK(0).Next)
+			}
+			for _, seq := range tt.add {
+				if got.Add(seq) {
+					t.Errorf("packet %d wasn't restored", seq)
+				}
+			}
+
+			if err := NewReceived(tt.total + 8).UnmarshalBinary(b); err == nil {
+				t.Error("bitmap of another number of packets accepted")
+			}
+		})
+	}
+}
+
+func TestSenderMeasure(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{"first sample", []time.Duration{100 * ms}, 300 * ms},
+		{"smoothed", []time.Duration{100 * ms, 300 * ms}, 475 * ms},
+		{"at least MinRTO", []time.Duration{10 * ms}, MinRTO},
+		{"at most MaxRTO", []time.Duration{5 * time.Second}, MaxRTO},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSender(nil, nil, nil, nil, nil)
+			for _, rtt := range tt.samples {
+				s.measure(rtt)
+			}
+			if s.rto != tt.want {
+				t.Errorf("rto = %v, want %v", s.rto, tt.want)
+			}
+		})
+	}
+}
+
+func TestSenderTimeoutBacksOff(t *testing.T) {
+	s := newSender(nil, nil, numbered(1), nil, nil)
+	s.rto = time.Second
+
+	tests := []struct {
+		retries int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, MaxRTO},
+		{MaxRetransmits, MaxRTO},
+	}
+	for _, tt := range tests {
+		s.retries[0] = tt.retries
+		if got := s.timeout(0); got != tt.want {
+			t.Errorf("timeout after %d retries = %v, want %v", tt.retries, got, tt.want)
+		}
+	}
+}
+
+func TestSenderWindow(t *testing.T) {
+	tests := []struct {
+		name string
+		// acks is how many packets are acknowledged before the losses, and
+		// after them.
+		acks, losses, after int
+		want                int
+	}{
+		{"slow start", 4, 0, 0, InitialWindow + 4},
+		{"one loss halves", 4, 1, 0, (InitialWindow + 4) / 2},
+		{"a burst of losses halves once", 4, 3, 0, (InitialWindow + 4) / 2},
+		{"grows by one a window", 4, 1, 6, 7},
+		{"grows by less than one a window", 4, 1, 5, 6},
+		{"at most MaxWindow", 1000, 0, 0, MaxWindow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSender(discardConn{}, nil, numbered(10), nil, nil)
+			s.srtt = time.Minute
+			for i := 0; i < tt.acks; i++ {
+				s.grow()
+			}
+			for i := 0; i < tt.losses; i++ {
+				if err := s.resend(i); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.after; i++ {
+				s.grow()
+			}
+			if s.window != tt.want {
+				t.Errorf("window = %d, want %d", s.window, tt.want)
+			}
+		})
+	}
+
+	s := newSender(discardConn{}, nil, numbered(10), nil, nil)
+	s.window = 3
+	for i := 0; i < 3; i++ {
+		s.lastCut = time.Time{}
+		if err := s.resend(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.window != 2 {
+		t.Errorf("window = %d after repeated losses, want 2", s.window)
+	}
+}
+
+func TestSenderDetectsLoss(t *testing.T) {
+	now := time.Now()
+	s := newSender(discardConn{}, nil, numbered(5), nil, nil)
+	s.next, s.inFlight = 4, 4
+	s.srtt, s.rttvar = 10*time.Millisecond, time.Millisecond
+	s.sent = []time.Time{
+		now.Add(-100 * time.Millisecond),
+		now.Add(-100 * time.Millisecond),
+		now.Add(-2 * time.Millisecond),
+		now.Add(-time.Millisecond),
+		{},
+	}
+
+	// packet 3 arrived but not the ones before it
+	if err := s.ack(SelectiveACK{Seq: 3, Next: 0, Bitmap: []byte{0b100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{1, 1, 0, 0, 0}
+	for seq := range want {
+		if s.retries[seq] != want[seq] {
+			t.Errorf("packet %d resent %d times, want %d", seq, s.retries[seq], want[seq])
+		}
+	}
+	if !s.acked[3] || s.inFlight != 3 {
+		t.Errorf("packet 3 acknowledged %v with %d in flight", s.acked[3], s.inFlight)
+	}
+}
+
+func TestSendReliable(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets int
+		// skip is every how many packets one is nil, as if already received.
+		skip    int
+		loss    float64
+		ackLoss float64
+		jitter  time.Duration
+	}{
+		{name: "no loss", packets: 200},
+		{name: "reordered", packets: 200, jitter: 20 * time.Millisecond},
+		{name: "lossy", packets: 200, loss: 0.1},
+		{name: "lossy and reordered", packets: 200, loss: 0.2, jitter: 20 * time.Millisecond},
+		{name: "acks lost", packets: 200, ackLoss: 0.3},
+		{name: "resumed", packets: 100, skip: 3, loss: 0.1},
+		{name: "all received", packets: 10, skip: 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			packets := numbered(tt.packets)
+			want := len(packets)
+			for i := range packets {
+				if tt.skip > 0 && i%tt.skip == 0 {
+					packets[i] = nil
+					want--
+				}
+			}
+
+			conn := newLossyConn(int64(len(tt.name)), uint64(len(packets)), tt.loss, tt.ackLoss, tt.jitter)
+			defer conn.Close()
+			for i, p := range packets {
+				if p == nil {
+					conn.received.Add(uint64(i))
+				}
+			}
+
+			var done, total uint64
+			progress := func(d, n uint64) {
+				if d < done {
+					t.Errorf("progress went back from %d to %d", done, d)
+				}
+				done, total = d, n
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			stats, err := SendReliable(ctx, conn, nil, packets, conn.acks, progress)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !conn.Done() {
+				t.Error("not all packets arrived")
+			}
+			if stats.Packets != want || stats.Skipped != len(packets)-want {
+				t.Errorf("sent %d packets and skipped %d, want %d and %d",
+					stats.Packets, stats.Skipped, want, len(packets)-want)
+			}
+			if done != total || total != uint64(len(packets)) {
+				t.Errorf("progress ended at %d of %d", done, total)
+			}
+			if tt.loss > 0 && stats.Retransmits == 0 {
+				t.Error("no packet resent despite losses")
+			}
+		})
+	}
+}
+
+func TestSendReliableCancelled(t *testing.T) {
+	conn := newLossyConn(1, 4, 1, 0, 0)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := SendReliable(ctx, conn, nil, numbered(4), conn.acks, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// numbered returns n packets holding their sequence numbers.
+func numbered(n int) [][]byte {
+	packets := make([][]byte, n)
+	for i := range packets {
+		packets[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(packets[i], uint64(i))
+	}
+	return packets
+}
+
+// discardConn drops whatever is written to it.
+type discardConn struct {
+	net.PacketConn
+}
+
+func (discardConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return len(b), nil
+}
+
+// lossyConn is a receiver of packets numbered by their first 8 bytes, which
+// drops packets and ACKs at random and delays them by up to jitter, which
+// reorders them.
+type lossyConn struct {
+	net.PacketConn
+
+	acks chan SelectiveACK
+	done chan struct{}
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	received *Received
+	loss     float64
+	ackLoss  float64
+	jitter   time.Duration
+}
+
+func newLossyConn(seed int64, total uint64, loss, ackLoss float64, jitter time.Duration) *lossyConn {
+	return &lossyConn{
+		acks:     make(chan SelectiveACK),
+		done:     make(chan struct{}),
+		rand:     rand.New(rand.NewSource(seed)),
+		received: NewReceived(total),
+		loss:     loss,
+		ackLoss:  ackLoss,
+		jitter:   jitter,
+	}
+}
+
+func (c *lossyConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.mu.Lock()
+	lost := c.rand.Float64() < c.loss
+	ackLost := c.rand.Float64() < c.ackLoss
+	var delay time.Duration
+	if c.jitter > 0 {
+		delay = time.Duration(c.rand.Int63n(int64(c.jitter)))
+	}
+	c.mu.Unlock()
+
+	if lost {
+		return len(b), nil
+	}
+
+	seq := binary.BigEndian.Uint64(b)
+	time.AfterFunc(delay, func() {
+		c.mu.Lock()
+		c.received.Add(seq)
+		a := c.received.ACK(seq)
+		c.mu.Unlock()
+
+		if ackLost {
+			return
+		}
+		select {
+		case c.acks <- a:
+		case <-c.done:
+		}
+	})
+	return len(b), nil
+}
+
+func (c *lossyConn) Done() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.received.Done()
+}
+
+func (c *lossyConn) Close() error {
+	close(c.done)
+	return nil
+}
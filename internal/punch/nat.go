@@ -0,0 +1,48 @@
+package punch
+
+import (
+	"net"
+	"sync"
+)
+
+// RestrictedConn simulates a port-restricted cone NAT in front of a socket:
+// datagrams are only let in from addresses the socket has sent to before.
+// It lets hole punching be tried out with peers on a single machine.
+type RestrictedConn struct {
+	net.PacketConn
+
+	mu      sync.RWMutex
+	allowed map[string]bool
+}
+
+func NewRestrictedConn(conn net.PacketConn) *RestrictedConn {
+	return &RestrictedConn{
+		PacketConn: conn,
+		allowed:    make(map[string]bool),
+	}
+}
+
+func (c *RestrictedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.allowed[addr.String()] = true
+	c.mu.Unlock()
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *RestrictedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+
+		c.mu.RLock()
+		allowed := c.allowed[addr.String()]
+		c.mu.RUnlock()
+
+		if allowed {
+			return n, addr, nil
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package punch
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+const (
+	probeInterval = 100 * time.Millisecond
+	// linger is how long probes are still answered after a path is found,
+	// in case the other end hasn't found it yet.
+	linger = 2 * time.Second
+)
+
+var ErrNoPath = errors.New("no UDP path to peer")
+
+type attempt struct {
+	self  string
+	peer  string
+	found chan net.Addr
+}
+
+// Puncher opens paths through NATs by having both peers send probes to each
+// other from their listening sockets at the same time. Whoever reads the
+// socket must pass probe datagrams to Handle.
+type Puncher struct {
+	conn net.PacketConn
+
+	mu       sync.Mutex
+	attempts map[string]*attempt
+}
+
+func New(conn net.PacketConn) *Puncher {
+	return &Puncher{
+		conn:     conn,
+		attempts: make(map[string]*attempt),
+	}
+}
+
+// Punch probes the candidate addresses of peer until one of them answers and
+// returns it. id must be the one the discovery server gave both peers.
+func (p *Puncher) Punch(ctx context.Context, id, self, peer string, candidates []string) (net.Addr, error) {
+	addrs := make([]net.Addr, 0, len(candidates))
+	for _, candidate := range candidates {
+		addr, err := net.ResolveUDPAddr("udp", candidate)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Wrapf(ErrNoPath, "no valid candidate address for %s", peer)
+	}
+
+	a := &attempt{
+		self:  self,
+		peer:  peer,
+		found: make(chan net.Addr, 1),
+	}
+	p.mu.Lock()
+	p.attempts[id] = a
+	p.mu.Unlock()
+
+	probe, err := protocol.EncodeDatagram(protocol.KindProbe, protocol.ProbePacket{
+		ID:   id,
+		From: self,
+		To:   peer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, addr := range addrs {
+			// errors are expected while the NATs aren't open yet
+			p.conn.WriteTo(probe, addr)
+		}
+
+		select {
+		case <-ctx.Done():
+			p.forget(id)
+			return nil, errors.Wrapf(ErrNoPath, "no answer from %s", peer)
+		case addr := <-a.found:
+			time.AfterFunc(linger, func() { p.forget(id) })
+			return addr, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handle processes a probe or probe ACK received from addr.
+func (p *Puncher) Handle(kind byte, payload []byte, addr net.Addr) {
+	var pckt protocol.ProbePacket
+	if err := json.Unmarshal(payload, &pckt); err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	a := p.attempts[pckt.ID]
+	p.mu.Unlock()
+
+	// the ID keeps strangers from hijacking the path
+	if a == nil || pckt.From != a.peer || pckt.To != a.self {
+		return
+	}
+
+	if kind == protocol.KindProbe {
+		ack, err := protocol.EncodeDatagram(protocol.KindProbeACK, protocol.ProbePacket{
+			ID:   pckt.ID,
+			From: a.self,
+			To:   a.peer,
+		})
+		if err == nil {
+			p.conn.WriteTo(ack, addr)
+		}
+	}
+
+	select {
+	case a.found <- addr:
+	default:
+	}
+}
+
+func (p *Puncher) forget(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.attempts, id)
+}
@@ -0,0 +1,175 @@
+package punch
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+func listen(t *testing.T) *RestrictedConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewRestrictedConn(conn)
+}
+
+func TestRestrictedConn(t *testing.T) {
+	tests := []struct {
+		name string
+		// contacted is which socket the restricted one sends to first, b or
+		// c, if any. b then sends to it.
+		contacted string
+		want      bool
+	}{
+		{name: "stranger", contacted: ""},
+		{name: "contacted", contacted: "b", want: true},
+		{name: "another address contacted", contacted: "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, c := listen(t), listen(t), listen(t)
+			switch tt.contacted {
+			case "b":
+				a.WriteTo([]byte("hi"), b.LocalAddr())
+			case "c":
+				a.WriteTo([]byte("hi"), c.LocalAddr())
+			}
+			if _, err := b.PacketConn.WriteTo([]byte("hello"), a.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+
+			a.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			buf := make([]byte, 16)
+			n, addr, err := a.ReadFrom(buf)
+			if !tt.want {
+				if err == nil {
+					t.Fatalf("read %q from %s", buf[:n], addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "hello" || addr.String() != b.LocalAddr().String() {
+				t.Errorf("read %q from %s", buf[:n], addr)
+			}
+		})
+	}
+}
+
+// serve passes the probes read from conn to p until conn is closed, as the
+// reader of the socket of a peer does.
+func serve(conn net.PacketConn, p *Puncher) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		kind, payload, err := protocol.DecodeDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		if kind == protocol.KindProbe || kind == protocol.KindProbeACK {
+			p.Handle(kind, payload, addr)
+		}
+	}
+}
+
+func TestPunch(t *testing.T) {
+	tests := []struct {
+		name string
+		// bobID and bobSelf are the ID and username bob punches with, which
+		// alice does as "id" and to "bob".
+		bobID   string
+		bobSelf string
+		// candidates returns the addresses alice tries for bob.
+		candidates func(bob net.Addr) []string
+		want       bool
+	}{
+		{
+			name:    "both punching",
+			bobID:   "id",
+			bobSelf: "bob",
+			want:    true,
+		},
+		{
+			name:    "first candidate unreachable",
+			bobID:   "id",
+			bobSelf: "bob",
+			candidates: func(bob net.Addr) []string {
+				return []string{"127.0.0.1:1", "not an address", bob.String()}
+			},
+			want: true,
+		},
+		{
+			name:    "another ID",
+			bobID:   "other",
+			bobSelf: "bob",
+		},
+		{
+			name:    "another username",
+			bobID:   "id",
+			bobSelf: "mallory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aliceConn, bobConn := listen(t), listen(t)
+			alice, bob := New(aliceConn), New(bobConn)
+			go serve(aliceConn, alice)
+			go serve(bobConn, bob)
+
+			candidates := []string{bobConn.LocalAddr().String()}
+			if tt.candidates != nil {
+				candidates = tt.candidates(bobConn.LocalAddr())
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			type result struct {
+				addr net.Addr
+				err  error
+			}
+			bobDone := make(chan result, 1)
+			go func() {
+				addr, err := bob.Punch(ctx, tt.bobID, tt.bobSelf, "alice", []string{aliceConn.LocalAddr().String()})
+				bobDone <- result{addr, err}
+			}()
+			addr, err := alice.Punch(ctx, "id", "alice", "bob", candidates)
+			bobResult := <-bobDone
+
+			if !tt.want {
+				if !errors.Is(err, ErrNoPath) || !errors.Is(bobResult.err, ErrNoPath) {
+					t.Errorf("err = %v and %v, want %v", err, bobResult.err, ErrNoPath)
+				}
+				return
+			}
+			if err != nil || bobResult.err != nil {
+				t.Fatalf("punching failed: %v, %v", err, bobResult.err)
+			}
+			if addr.String() != bobConn.LocalAddr().String() {
+				t.Errorf("alice found bob at %s, want %s", addr, bobConn.LocalAddr())
+			}
+			if bobResult.addr.String() != aliceConn.LocalAddr().String() {
+				t.Errorf("bob found alice at %s, want %s", bobResult.addr, aliceConn.LocalAddr())
+			}
+		})
+	}
+}
+
+func TestPunchWithoutCandidates(t *testing.T) {
+	p := New(listen(t))
+	_, err := p.Punch(context.Background(), "id", "alice", "bob", []string{"not an address"})
+	if !errors.Is(err, ErrNoPath) {
+		t.Errorf("err = %v, want %v", err, ErrNoPath)
+	}
+}
@@ -0,0 +1,257 @@
+// Package relay carries datagrams or a byte stream between two peers through
+// the discovery server when they can't reach each other directly. Both are
+// sent over TCP as frames prefixed with their length as a 16-bit big-endian
+// integer.
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxFrameSize is the largest payload of a frame, the same as the
+	// largest UDP datagram.
+	MaxFrameSize = 1<<16 - 1
+
+	// JoinTimeout is how long the server waits for the second peer of a
+	// relay to connect.
+	JoinTimeout = 10 * time.Second
+)
+
+// Hello is the first frame a peer sends on a relay connection.
+type Hello struct {
+	// ID is handed out by the discovery server to both peers.
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+// Welcome answers Hello once both peers have joined, or on failure.
+type Welcome struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// WriteFrame writes b to w as a single frame.
+func WriteFrame(w io.Writer, b []byte) error {
+	if len(b) > MaxFrameSize {
+		return errors.Errorf("frame of %d bytes exceeds the maximum of %d", len(b), MaxFrameSize)
+	}
+
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads the payload of a frame from r into buf. If buf is too small
+// the frame is discarded and io.ErrShortBuffer is returned.
+func ReadFrame(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+
+	n, err := io.ReadFull(r, buf[:size])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Addr is the address of the peer at the other end of a relay.
+type Addr struct {
+	Username string
+}
+
+func (a Addr) Network() string {
+	return "relay"
+}
+
+func (a Addr) String() string {
+	return a.Username
+}
+
+// Conn is a relay connection to a peer. It's a net.PacketConn so that it can
+// stand in for the UDP socket of the peer, except that every datagram goes to
+// the same peer whatever address it's written to.
+type Conn struct {
+	conn net.Conn
+	peer Addr
+
+	wmu sync.Mutex
+}
+
+var _ net.PacketConn = (*Conn)(nil)
+
+// Dial joins the relay at addr as described by hello, and returns once peer
+// has joined it too.
+func Dial(ctx context.Context, addr string, hello *Hello, peer string) (*Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to relay at %s", addr)
+	}
+
+	deadline := time.Now().Add(JoinTimeout + 5*time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	welcome, err := handshake(conn, hello)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to join relay at %s", addr)
+	}
+	if !welcome.OK {
+		conn.Close()
+		return nil, errors.Errorf("relay at %s refused to connect us to %s: %s", addr, peer, welcome.Error)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &Conn{conn: conn, peer: Addr{peer}}, nil
+}
+
+func handshake(conn net.Conn, hello *Hello) (*Welcome, error) {
+	b, err := json.Marshal(hello)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteFrame(conn, b); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, MaxFrameSize)
+	n, err := ReadFrame(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var welcome Welcome
+	if err := json.Unmarshal(buf[:n], &welcome); err != nil {
+		return nil, err
+	}
+	return &welcome, nil
+}
+
+// ReadFrom reads a datagram sent by the peer.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := ReadFrame(c.conn, b)
+	return n, c.peer, err
+}
+
+// WriteTo sends b to the peer, whatever addr is.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := WriteFrame(c.conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite tells the peer nothing more will be sent. Reads go on until the
+// peer closes its end too.
+func (c *Conn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if conn, ok := c.conn.(*net.TCPConn); ok {
+		return conn.CloseWrite()
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Stream is a relay connection carrying a byte stream rather than datagrams,
+// cut into frames as it's written.
+type Stream struct {
+	*Conn
+
+	rmu  sync.Mutex
+	rbuf []byte
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func NewStream(conn *Conn) *Stream {
+	return &Stream{Conn: conn}
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for len(s.rbuf) == 0 {
+		buf := make([]byte, MaxFrameSize)
+		n, err := ReadFrame(s.conn, buf)
+		if err != nil {
+			return 0, err
+		}
+		s.rbuf = buf[:n]
+	}
+
+	n := copy(b, s.rbuf)
+	s.rbuf = s.rbuf[n:]
+	return n, nil
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		if _, err := s.WriteTo(chunk, s.peer); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
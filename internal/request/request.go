@@ -1,9 +1,53 @@
 package request
 
+import (
+	"crypto/ed25519"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/mailbox"
+)
+
 type (
+	PostChallenge struct {
+		Username string `json:"username"`
+	}
+	// Proof answers a challenge of the server.
+	Proof struct {
+		Nonce     string `json:"nonce"`
+		Signature []byte `json:"signature"`
+	}
 	PostPeer struct {
 		UDPAddr  string `json:"udp_addr"`
 		TCPAddr  string `json:"tcp_addr"`
 		Username string `json:"username"`
+		// PublicUDPAddr is the mapping of the UDP socket discovered over STUN.
+		PublicUDPAddr string            `json:"public_udp_addr,omitempty"`
+		PublicKey     ed25519.PublicKey `json:"public_key"`
+		WireVersion   int               `json:"wire_version,omitempty"`
+		Proof
+	}
+	PutPeer struct {
+		Proof
+	}
+	DeletePeer struct {
+		Proof
+	}
+	PostPunch struct {
+		Username string `json:"username"`
+		Target   string `json:"target"`
+	}
+	PostRelay struct {
+		Username string `json:"username"`
+		Target   string `json:"target"`
+		// Stream asks for the relay to carry a byte stream rather than
+		// datagrams.
+		Stream bool `json:"stream,omitempty"`
+	}
+	// PostMail deposits a message in the mailbox of a peer. Its time is set
+	// by the server.
+	PostMail struct {
+		mailbox.Envelope
+	}
+	DeleteMail struct {
+		IDs []string `json:"ids"`
 	}
 )
@@ -1,15 +1,101 @@
 package response
 
-import "github.com/ArminGh02/golang-p2p-messenger/internal/peer"
+import (
+	"crypto/ed25519"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/mailbox"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/peer"
+)
 
 type (
+	PostChallenge struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+		Nonce string `json:"nonce,omitempty"`
+		// TTL is how long the nonce may be used for in seconds.
+		TTL int64 `json:"ttl,omitempty"`
+	}
 	PostPeer struct {
 		OK    bool   `json:"ok"`
 		Error string `json:"error,omitempty"`
+		// TTL is the lease duration in seconds.
+		TTL int64 `json:"ttl,omitempty"`
+		// Token must be presented to signal other peers.
+		Token string `json:"token,omitempty"`
+		// ObservedIP is the address the server saw the request come from.
+		ObservedIP    string `json:"observed_ip,omitempty"`
+		PublicUDPAddr string `json:"public_udp_addr,omitempty"`
+		PublicTCPAddr string `json:"public_tcp_addr,omitempty"`
+	}
+	PutPeer struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+		TTL   int64  `json:"ttl,omitempty"`
+	}
+	DeletePeer struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
 	}
 	GetPeer struct {
 		OK    bool         `json:"ok"`
 		Error string       `json:"error,omitempty"`
 		Peers []*peer.Peer `json:"peers,omitempty"`
 	}
+	PostPunch struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+		// ID identifies the attempt in the probes of both peers.
+		ID   string     `json:"id,omitempty"`
+		Peer *peer.Peer `json:"peer,omitempty"`
+	}
+	PostRelay struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+		// ID identifies the relay in the hellos of both peers.
+		ID string `json:"id,omitempty"`
+		// Addr is the TCP address of the relay. Its host may be unspecified,
+		// in which case it's the host of the discovery server.
+		Addr string `json:"addr,omitempty"`
+	}
+	Signal struct {
+		Type string `json:"type"`
+		ID   string `json:"id,omitempty"`
+		// Peer is the peer that caused the signal.
+		Peer *peer.Peer `json:"peer,omitempty"`
+		// Addr is the address of the relay of relay signals.
+		Addr string `json:"addr,omitempty"`
+		// Stream tells whether a relay carries a byte stream.
+		Stream bool `json:"stream,omitempty"`
+	}
+	GetSignals struct {
+		OK      bool     `json:"ok"`
+		Error   string   `json:"error,omitempty"`
+		Signals []Signal `json:"signals,omitempty"`
+	}
+	GetKey struct {
+		OK        bool              `json:"ok"`
+		Error     string            `json:"error,omitempty"`
+		PublicKey ed25519.PublicKey `json:"public_key,omitempty"`
+	}
+	PostMail struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}
+	GetMail struct {
+		OK        bool                `json:"ok"`
+		Error     string              `json:"error,omitempty"`
+		Envelopes []*mailbox.Envelope `json:"envelopes,omitempty"`
+	}
+	DeleteMail struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+		// Deleted is how many of the messages were still in the mailbox.
+		Deleted int `json:"deleted"`
+	}
+)
+
+// Types of signals.
+const (
+	SignalPunch = "punch"
+	SignalRelay = "relay"
 )
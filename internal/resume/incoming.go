@@ -0,0 +1,187 @@
+package resume
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/fsutil"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+// Incoming is a file being received, whose chunks are kept in a part file
+// next to the state of the transfer.
+type Incoming struct {
+	*protocol.IncomingFile
+	From    string
+	Started time.Time
+
+	base string
+	part *os.File
+	// dirty is whether chunks have arrived since the state was last saved.
+	dirty bool
+}
+
+type incomingState struct {
+	Manifest *protocol.Manifest `json:"manifest"`
+	From     string             `json:"from"`
+	Started  time.Time          `json:"started"`
+	// Received is a bitmap of the packets which have arrived, see
+	// protocol.Received.
+	Received []byte `json:"received"`
+}
+
+// Receive opens the file described by m which username is sending, and
+// reports whether some of it had been received already, for the transfer
+// to be resumed.
+func (s *Store) Receive(username string, m *protocol.Manifest) (*Incoming, bool, error) {
+	if err := m.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	in := &Incoming{
+		From:    username,
+		Started: time.Now(),
+		base:    s.incomingBase(username, m.ID),
+	}
+	received, err := in.load(m)
+	if err != nil {
+		return nil, false, err
+	}
+	resumed := received != nil
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !resumed {
+		flags |= os.O_TRUNC
+	}
+	in.part, err = os.OpenFile(in.base+partExt, flags, 0o600)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to open the part file")
+	}
+	if !resumed {
+		if err := in.part.Truncate(int64(m.Size)); err != nil {
+			in.part.Close()
+			return nil, false, errors.Wrap(err, "failed to open the part file")
+		}
+	}
+
+	in.IncomingFile, err = protocol.NewIncomingFile(m, in.part, received)
+	if err != nil {
+		in.part.Close()
+		return nil, false, err
+	}
+
+	// saved right away for the transfer to be found after a restart
+	in.dirty = true
+	if err := in.Save(); err != nil {
+		in.part.Close()
+		return nil, false, err
+	}
+	return in, resumed, nil
+}
+
+// Receiving reports whether the file with id which username is sending is
+// kept to be resumed, having been accepted already.
+func (s *Store) Receiving(username string, id protocol.FileID) bool {
+	b, err := os.ReadFile(s.incomingBase(username, id) + stateExt)
+	if err != nil {
+		return false
+	}
+	var st incomingState
+	return json.Unmarshal(b, &st) == nil && st.From == username
+}
+
+// load returns the packets of the file described by m which had been
+// received, or nil if there's no state of it to resume from.
+func (in *Incoming) load(m *protocol.Manifest) (*protocol.Received, error) {
+	b, err := os.ReadFile(in.base + stateExt)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var st incomingState
+	if err := json.Unmarshal(b, &st); err != nil || st.Manifest == nil {
+		// started over
+		return nil, nil
+	}
+	if st.From != in.From || !sameFile(st.Manifest, m) || st.Manifest.Packets != m.Packets {
+		return nil, errors.Errorf("transfer %s is of another file", m.ID.Short())
+	}
+
+	// the chunks are only trusted as far as the part file is intact
+	info, err := os.Stat(in.base + partExt)
+	if err != nil || info.Size() != int64(m.Size) {
+		return nil, nil
+	}
+
+	received := protocol.NewReceived(m.Packets)
+	if err := received.UnmarshalBinary(st.Received); err != nil {
+		return nil, nil
+	}
+	in.Started = st.Started
+	return received, nil
+}
+
+// AddChunk adds c to the file, and reports whether it's new.
+func (in *Incoming) AddChunk(c *protocol.Chunk) (bool, error) {
+	isNew, err := in.IncomingFile.AddChunk(c)
+	if isNew {
+		in.dirty = true
+	}
+	return isNew, err
+}
+
+// Save saves which packets of the file have arrived, if any have since it
+// was last saved.
+func (in *Incoming) Save() error {
+	if !in.dirty {
+		return nil
+	}
+
+	received, _ := in.Received().MarshalBinary()
+	b, err := json.Marshal(&incomingState{
+		Manifest: in.Manifest,
+		From:     in.From,
+		Started:  in.Started,
+		Received: received,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := fsutil.WriteFile(in.base+stateExt, b); err != nil {
+		return errors.Wrapf(err, "failed to save transfer %s", in.Manifest.ID.Short())
+	}
+	in.dirty = false
+	return nil
+}
+
+// Close saves the state of the file and closes its part file, for it to be
+// resumed later.
+func (in *Incoming) Close() error {
+	err := in.Save()
+	if cerr := in.part.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Remove closes the part file and removes it along with the state of the
+// file, once all its packets have arrived.
+func (in *Incoming) Remove() error {
+	// nothing's left to save, as no new chunks can arrive
+	in.dirty = false
+	in.part.Close()
+	if err := os.Remove(in.base + partExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(in.base + stateExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package resume keeps the state of the file transfers in progress on disk,
+// for them to be resumed after a disconnect or a restart.
+package resume
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/fsutil"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+const (
+	// DirName is the name of the directory transfers are kept in, next to
+	// the config file of the peer.
+	DirName = "transfers"
+
+	// SaveInterval is how often at most the packets of a file which have
+	// arrived are saved.
+	SaveInterval = time.Second
+
+	// MaxAge is how long a transfer is kept without making progress before
+	// it's given up on.
+	MaxAge = 7 * 24 * time.Hour
+
+	outgoingFileName = "outgoing.json"
+	stateExt         = ".json"
+	partExt          = ".part"
+)
+
+var (
+	ErrNotFound  = errors.New("no such transfer")
+	ErrAmbiguous = errors.New("several transfers match")
+)
+
+// Outgoing is a file being sent.
+type Outgoing struct {
+	Manifest *protocol.Manifest `json:"manifest"`
+	To       string             `json:"to"`
+	Started  time.Time          `json:"started"`
+	// Updated is when the file was last attempted.
+	Updated time.Time `json:"updated"`
+}
+
+// Store keeps the files being sent and received in a directory.
+type Store struct {
+	dir string
+
+	mu       sync.Mutex
+	outgoing map[protocol.FileID]*Outgoing
+}
+
+// Open loads the transfers kept in dir, creating it if needed, and drops the
+// ones older than MaxAge.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "failed to create the transfers directory")
+	}
+
+	s := &Store{
+		dir:      dir,
+		outgoing: make(map[protocol.FileID]*Outgoing),
+	}
+
+	path := filepath.Join(dir, outgoingFileName)
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var outgoing []*Outgoing
+		if err := json.Unmarshal(b, &outgoing); err != nil {
+			return nil, errors.Wrapf(err, "invalid transfers file %s", path)
+		}
+		for _, o := range outgoing {
+			if o.Manifest != nil && time.Since(o.Updated) < MaxAge {
+				s.outgoing[o.Manifest.ID] = o
+			}
+		}
+	}
+
+	return s, s.pruneIncoming()
+}
+
+// pruneIncoming removes the files being received which haven't made progress
+// for MaxAge.
+func (s *Store) pruneIncoming() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if name == outgoingFileName || !strings.HasSuffix(name, stateExt) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < MaxAge {
+			continue
+		}
+
+		base := filepath.Join(s.dir, strings.TrimSuffix(name, stateExt))
+		os.Remove(base + partExt)
+		os.Remove(base + stateExt)
+	}
+	return nil
+}
+
+// Send records that the file described by m is being sent to username, and
+// returns the manifest to send it with. If the same file was being sent to
+// username already, its manifest is returned for the receiver to resume it.
+func (s *Store) Send(username string, m *protocol.Manifest) (*protocol.Manifest, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, o := range s.outgoing {
+		if o.To != username || !sameFile(o.Manifest, m) {
+			continue
+		}
+
+		updated := *o
+		updated.Updated = now
+		if err := s.put(&updated); err != nil {
+			return nil, false, err
+		}
+		return o.Manifest, true, nil
+	}
+
+	err := s.put(&Outgoing{Manifest: m, To: username, Started: now, Updated: now})
+	return m, false, err
+}
+
+func sameFile(a, b *protocol.Manifest) bool {
+	return a.SHA256 == b.SHA256 && a.Size == b.Size && a.Filename == b.Filename && a.Format == b.Format
+}
+
+// Remove drops the file with id being sent to, or received from, peer, once
+// it's been sent or received or the transfer has been cancelled.
+func (s *Store) Remove(peer string, incoming bool, id protocol.FileID) error {
+	if incoming {
+		base := s.incomingBase(peer, id)
+		if err := os.Remove(base + stateExt); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if err := os.Remove(base + partExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.outgoing[id]
+	if !ok || o.To != peer {
+		return ErrNotFound
+	}
+	delete(s.outgoing, id)
+	if err := s.save(); err != nil {
+		s.outgoing[id] = o
+		return err
+	}
+	return nil
+}
+
+// incomingBase returns the path, without an extension, of the state and the
+// part file of the file with id which username is sending. The IDs of files
+// being received are picked by their senders, so the path is told apart by
+// the sender too.
+func (s *Store) incomingBase(username string, id protocol.FileID) string {
+	sum := sha256.Sum256([]byte(username))
+	return filepath.Join(s.dir, id.String()+"-"+hex.EncodeToString(sum[:8]))
+}
+
+// Transfer is a file being sent or received, as kept in the store.
+type Transfer struct {
+	Manifest *protocol.Manifest
+	Peer     string
+	Incoming bool
+	Started  time.Time
+	// Received is how many packets of a file being received had arrived
+	// when it was last saved.
+	Received uint64
+}
+
+// List returns the files being sent, oldest first, followed by the ones
+// being received. The ones which can't be read are left out.
+func (s *Store) List() []Transfer {
+	s.mu.Lock()
+	var transfers []Transfer
+	for _, o := range s.sorted() {
+		transfers = append(transfers, Transfer{Manifest: o.Manifest, Peer: o.To, Started: o.Started})
+	}
+	s.mu.Unlock()
+
+	entries, _ := os.ReadDir(s.dir)
+	var incoming []Transfer
+	for _, e := range entries {
+		name := e.Name()
+		if name == outgoingFileName || !strings.HasSuffix(name, stateExt) {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			continue
+		}
+		var st incomingState
+		if err := json.Unmarshal(b, &st); err != nil || st.Manifest == nil || st.Manifest.Validate() != nil {
+			continue
+		}
+		received := protocol.NewReceived(st.Manifest.Packets)
+		if err := received.UnmarshalBinary(st.Received); err != nil {
+			continue
+		}
+
+		incoming = append(incoming, Transfer{
+			Manifest: st.Manifest,
+			Peer:     st.From,
+			Incoming: true,
+			Started:  st.Started,
+			Received: received.Count(),
+		})
+	}
+	sort.Slice(incoming, func(i, j int) bool {
+		return incoming[i].Started.Before(incoming[j].Started)
+	})
+	return append(transfers, incoming...)
+}
+
+// put must be called with s.mu held.
+func (s *Store) put(o *Outgoing) error {
+	prev := s.outgoing[o.Manifest.ID]
+	s.outgoing[o.Manifest.ID] = o
+	if err := s.save(); err != nil {
+		if prev != nil {
+			s.outgoing[o.Manifest.ID] = prev
+		} else {
+			delete(s.outgoing, o.Manifest.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// sorted must be called with s.mu held.
+func (s *Store) sorted() []Outgoing {
+	outgoing := make([]Outgoing, 0, len(s.outgoing))
+	for _, o := range s.outgoing {
+		outgoing = append(outgoing, *o)
+	}
+	sort.Slice(outgoing, func(i, j int) bool {
+		if outgoing[i].Started.Equal(outgoing[j].Started) {
+			return outgoing[i].Manifest.ID.String() < outgoing[j].Manifest.ID.String()
+		}
+		return outgoing[i].Started.Before(outgoing[j].Started)
+	})
+	return outgoing
+}
+
+// save must be called with s.mu held.
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(fsutil.WriteFile(filepath.Join(s.dir, outgoingFileName), b), "failed to save transfers")
+}
@@ -0,0 +1,275 @@
+package resume
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/protocol"
+)
+
+func open(t *testing.T, dir string) *Store {
+	t.Helper()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testFile returns data spanning a few chunks and its manifest.
+func testFile(sender string, fill byte) ([]byte, *protocol.Manifest) {
+	data := bytes.Repeat([]byte{fill}, 3*protocol.ChunkSize+100)
+	return data, protocol.NewManifest(sender, "notes.txt", "", data)
+}
+
+func chunk(m *protocol.Manifest, data []byte, seq uint64) *protocol.Chunk {
+	off := (seq - 1) * protocol.ChunkSize
+	end := off + protocol.ChunkSize
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+	return &protocol.Chunk{ID: m.ID, Packets: m.Packets, Seq: seq, Data: data[off:end]}
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name string
+		to   string
+		// fill and filename make the file sent the second time another one.
+		fill        byte
+		filename    string
+		restart     bool
+		wantResumed bool
+	}{
+		{name: "same file", to: "bob", fill: 'a', wantResumed: true},
+		{name: "after a restart", to: "bob", fill: 'a', restart: true, wantResumed: true},
+		{name: "to someone else", to: "carol", fill: 'a'},
+		{name: "another file", to: "bob", fill: 'b'},
+		{name: "renamed", to: "bob", fill: 'a', filename: "other.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := open(t, dir)
+
+			_, first := testFile("alice", 'a')
+			if m, resumed, err := s.Send("bob", first); err != nil || resumed || m != first {
+				t.Fatalf("first Send = %v, %v", resumed, err)
+			}
+
+			if tt.restart {
+				s = open(t, dir)
+			}
+			_, again := testFile("alice", tt.fill)
+			if tt.filename != "" {
+				again.Filename = tt.filename
+			}
+			m, resumed, err := s.Send(tt.to, again)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resumed != tt.wantResumed {
+				t.Errorf("resumed = %v, want %v", resumed, tt.wantResumed)
+			}
+			wantID := again.ID
+			if tt.wantResumed {
+				wantID = first.ID
+			}
+			if m.ID != wantID {
+				t.Errorf("sent as %s, want %s", m.ID.Short(), wantID.Short())
+			}
+		})
+	}
+}
+
+func TestReceive(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare runs on the directory after chunks 1 and 3 have been
+		// received and the file closed.
+		prepare     func(t *testing.T, base string)
+		from        string
+		wantResumed bool
+	}{
+		{name: "resumed", from: "alice", wantResumed: true},
+		// kept apart from alice's, whose ID mallory picked too
+		{name: "from someone else", from: "mallory"},
+		{
+			name: "part file truncated",
+			from: "alice",
+			prepare: func(t *testing.T, base string) {
+				if err := os.Truncate(base+partExt, 10); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "state corrupt",
+			from: "alice",
+			prepare: func(t *testing.T, base string) {
+				if err := os.WriteFile(base+stateExt, []byte("{"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "part file removed",
+			from: "alice",
+			prepare: func(t *testing.T, base string) {
+				if err := os.Remove(base + partExt); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := open(t, dir)
+			data, m := testFile("alice", 'a')
+
+			in, resumed, err := s.Receive("alice", m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resumed {
+				t.Error("new file taken to be resumed")
+			}
+			for _, seq := range []uint64{1, 3} {
+				if isNew, err := in.AddChunk(chunk(m, data, seq)); err != nil || !isNew {
+					t.Fatalf("AddChunk(%d) = %v, %v", seq, isNew, err)
+				}
+			}
+			if err := in.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, s.incomingBase("alice", m.ID))
+			}
+
+			s = open(t, dir)
+			in, resumed, err = s.Receive(tt.from, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resumed != tt.wantResumed {
+				t.Errorf("resumed = %v, want %v", resumed, tt.wantResumed)
+			}
+
+			wantReceived := uint64(1)
+			if tt.wantResumed {
+				wantReceived = 3
+			}
+			if received, _ := in.Progress(); received != wantReceived {
+				t.Errorf("%d packets received, want %d", received, wantReceived)
+			}
+
+			for seq := uint64(1); seq < m.Packets; seq++ {
+				isNew, err := in.AddChunk(chunk(m, data, seq))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wasKept := tt.wantResumed && (seq == 1 || seq == 3); isNew == wasKept {
+					t.Errorf("chunk %d new = %v", seq, isNew)
+				}
+			}
+			got, err := in.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("file changed in transit")
+			}
+
+			if !s.Receiving(tt.from, m.ID) || s.Receiving("carol", m.ID) {
+				t.Error("file not kept as being received from its sender only")
+			}
+			if err := in.Remove(); err != nil {
+				t.Fatal(err)
+			}
+			if s.Receiving(tt.from, m.ID) {
+				t.Error("file kept after it was removed")
+			}
+			if kept := s.Receiving("alice", m.ID); kept != (tt.from != "alice") {
+				t.Errorf("alice's file kept = %v", kept)
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	s := open(t, t.TempDir())
+
+	_, outgoing := testFile("alice", 'a')
+	if _, _, err := s.Send("bob", outgoing); err != nil {
+		t.Fatal(err)
+	}
+	// bob picked the ID of the file alice is sending him for his own
+	_, incoming := testFile("bob", 'b')
+	incoming.ID = outgoing.ID
+	in, _, err := s.Receive("bob", incoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Close()
+
+	tests := []struct {
+		name     string
+		peer     string
+		incoming bool
+		id       protocol.FileID
+		wantErr  error
+		// wantLeft is how many transfers are left after it.
+		wantLeft int
+	}{
+		{"incoming from someone else", "carol", true, incoming.ID, ErrNotFound, 2},
+		{"outgoing to someone else", "carol", false, outgoing.ID, ErrNotFound, 2},
+		{"incoming", "bob", true, incoming.ID, nil, 1},
+		{"incoming removed already", "bob", true, incoming.ID, ErrNotFound, 1},
+		{"outgoing", "bob", false, outgoing.ID, nil, 0},
+		{"unknown", "bob", false, protocol.NewFileID(), ErrNotFound, 0},
+	}
+	for _, tt := range tests {
+		if err := s.Remove(tt.peer, tt.incoming, tt.id); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if left := s.List(); len(left) != tt.wantLeft {
+			t.Errorf("%s: %d transfers left, want %d", tt.name, len(left), tt.wantLeft)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	s := open(t, t.TempDir())
+
+	_, outgoing := testFile("alice", 'a')
+	if _, _, err := s.Send("bob", outgoing); err != nil {
+		t.Fatal(err)
+	}
+	data, incoming := testFile("carol", 'c')
+	in, _, err := s.Receive("carol", incoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.AddChunk(chunk(incoming, data, 2)); err != nil {
+		t.Fatal(err)
+	}
+	in.Close()
+
+	want := []Transfer{
+		{Manifest: outgoing, Peer: "bob"},
+		{Manifest: incoming, Peer: "carol", Incoming: true, Received: 2},
+	}
+	got := s.List()
+	if len(got) != len(want) {
+		t.Fatalf("listed %d transfers, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Manifest.ID != want[i].Manifest.ID || got[i].Peer != want[i].Peer ||
+			got[i].Incoming != want[i].Incoming || got[i].Received != want[i].Received {
+			t.Errorf("transfer %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+)
+
+// Mail is sealed to the identity key of its recipient, in its Montgomery
+// form, so that it can be read without the recipient being online:
+//
+//	ephemeral key | ChaCha20-Poly1305(username length | username | identity key | signature | message)
+//
+// The sender signs its ephemeral key, the recipient and the message with its
+// identity key, so the server keeping it can neither read nor forge it.
+
+// MailOverhead is how much larger sealed mail is than its message, besides
+// the username of the sender.
+const MailOverhead = curve25519.PointSize + 1 + ed25519.PublicKeySize + ed25519.SignatureSize + chacha20poly1305.Overhead
+
+// SealMail seals msg from username from to username to owning toKey.
+func SealMail(id *identity.Identity, from, to string, toKey ed25519.PublicKey, msg []byte) ([]byte, error) {
+	if len(from) > 255 {
+		return nil, errors.New("username too long")
+	}
+
+	point, err := montgomery(toKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ePriv, ePub, err := newEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ePriv, point)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to agree on a key")
+	}
+	aead, err := mailCipher(shared, ePub, point)
+	if err != nil {
+		return nil, err
+	}
+
+	var plain bytes.Buffer
+	plain.WriteByte(byte(len(from)))
+	plain.WriteString(from)
+	plain.Write(id.PublicKey())
+	plain.Write(id.Sign(mailSigned(ePub, toKey, from, to, msg)))
+	plain.Write(msg)
+
+	sealed := make([]byte, 0, len(ePub)+plain.Len()+aead.Overhead())
+	sealed = append(sealed, ePub...)
+	return aead.Seal(sealed, make([]byte, aead.NonceSize()), plain.Bytes(), nil), nil
+}
+
+// OpenMail opens mail sealed to id as username to. verify is called with the
+// username and identity key of the sender, and fails the opening if it
+// returns an error.
+func OpenMail(
+	id *identity.Identity,
+	to string,
+	sealed []byte,
+	verify func(username string, key ed25519.PublicKey) error,
+) (from string, msg []byte, err error) {
+	if len(sealed) < MailOverhead {
+		return "", nil, errors.New("mail too short")
+	}
+	ePub := sealed[:curve25519.PointSize]
+
+	shared, err := id.SharedSecret(ePub)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to agree on a key")
+	}
+	point, err := montgomery(id.PublicKey())
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := mailCipher(shared, ePub, point)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[len(ePub):], nil)
+	if err != nil {
+		return "", nil, errors.New("mail isn't sealed to this identity")
+	}
+
+	n := int(plain[0])
+	if len(plain) < 1+n+ed25519.PublicKeySize+ed25519.SignatureSize {
+		return "", nil, errors.New("malformed mail")
+	}
+	from = string(plain[1 : 1+n])
+	plain = plain[1+n:]
+	key := ed25519.PublicKey(plain[:ed25519.PublicKeySize])
+	sig := plain[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	msg = plain[ed25519.PublicKeySize+ed25519.SignatureSize:]
+
+	if !ed25519.Verify(key, mailSigned(ePub, id.PublicKey(), from, to, msg), sig) {
+		return "", nil, errors.New("invalid mail signature")
+	}
+	if err := verify(from, key); err != nil {
+		return "", nil, err
+	}
+	return from, msg, nil
+}
+
+func mailCipher(shared, ePub, point []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ePub...), point...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("p2p-messenger mail")), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func mailSigned(ePub []byte, toKey ed25519.PublicKey, from, to string, msg []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("p2p-messenger mail")
+	b.Write(ePub)
+	b.Write(toKey)
+	b.WriteByte(byte(len(from)))
+	b.WriteString(from)
+	b.WriteByte(byte(len(to)))
+	b.WriteString(to)
+	b.Write(msg)
+	return b.Bytes()
+}
+
+// fieldPrime is 2^255 - 19.
+var fieldPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// montgomery converts the Ed25519 public key to the X25519 point it's
+// birationally equivalent to, u = (1 + y) / (1 - y).
+func montgomery(key ed25519.PublicKey) ([]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid identity key")
+	}
+
+	// the key is y in little-endian with the sign of x in the top bit
+	le := make([]byte, len(key))
+	copy(le, key)
+	le[len(le)-1] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, fieldPrime)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("invalid identity key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, fieldPrime))
+	u.Mod(u, fieldPrime)
+
+	point := make([]byte, curve25519.PointSize)
+	u.FillBytes(point)
+	return reverse(point), nil
+}
+
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
@@ -0,0 +1,80 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+)
+
+func TestMail(t *testing.T) {
+	alice, bob, carol := newIdentity(t), newIdentity(t), newIdentity(t)
+
+	tests := []struct {
+		name   string
+		mutate func(sealed []byte) []byte
+		// opener and as are who opens the mail and as which username, bob
+		// if not set.
+		opener  *identity.Identity
+		as      string
+		verify  func(string, ed25519.PublicKey) error
+		wantErr error
+	}{
+		{name: "ok"},
+		{name: "tampered", mutate: func(s []byte) []byte { s[len(s)-1] ^= 1; return s }},
+		{name: "ephemeral key tampered", mutate: func(s []byte) []byte { s[0] ^= 1; return s }},
+		{name: "truncated", mutate: func(s []byte) []byte { return s[:MailOverhead-1] }},
+		{name: "sealed to someone else", opener: carol},
+		{name: "opened as someone else", as: "carol"},
+		{
+			name:    "sender rejected",
+			verify:  func(string, ed25519.PublicKey) error { return errRejected },
+			wantErr: errRejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := SealMail(alice, "alice", "bob", bob.PublicKey(), []byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.mutate != nil {
+				sealed = tt.mutate(sealed)
+			}
+			opener, as := tt.opener, tt.as
+			if opener == nil {
+				opener = bob
+			}
+			if as == "" {
+				as = "bob"
+			}
+			verify := tt.verify
+			if verify == nil {
+				verify = func(username string, key ed25519.PublicKey) error {
+					if username != "alice" || !key.Equal(alice.PublicKey()) {
+						return errRejected
+					}
+					return nil
+				}
+			}
+
+			from, msg, err := OpenMail(opener, as, sealed, verify)
+			if tt.name == "ok" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if from != "alice" || string(msg) != "hello" {
+					t.Errorf("opened %q from %s", msg, from)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("mail opened")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+// Package secure runs authenticated key exchanges between two peers, either
+// over a connection which seals everything written to it afterwards, or over
+// datagrams to key a transfer. Mail is sealed to the identity of an offline
+// peer without an exchange.
+//
+// The handshake is a signed ephemeral Diffie-Hellman, with both peers signing
+// the transcript with their identity keys:
+//
+//	initiator -> responder: magic, version, ephemeral key, identity key, username
+//	responder -> initiator: ephemeral key, identity key, signature
+//	initiator -> responder: signature
+//
+// Each direction then has its own ChaCha20-Poly1305 key derived from the
+// X25519 shared secret with HKDF, and records carry a 16-bit length followed
+// by the ciphertext. Nonces are record counters, so records can't be
+// replayed, reordered or dropped unnoticed.
+package secure
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+)
+
+const (
+	// HandshakeTimeout bounds how long the handshake may take.
+	HandshakeTimeout = 10 * time.Second
+
+	version = 1
+
+	// maxRecordSize is the largest plaintext sealed in a record.
+	maxRecordSize = 16 << 10
+)
+
+var magic = [4]byte{'P', '2', 'P', 'S'}
+
+var (
+	ErrUnknownPeerKey   = errors.New("peer didn't present the expected identity key")
+	ErrInvalidSignature = errors.New("invalid handshake signature")
+	ErrUnsupported      = errors.New("not a secure connection of a supported version")
+)
+
+// Conn is a connection whose traffic is sealed. Its Read and Write may be
+// used concurrently with each other.
+type Conn struct {
+	net.Conn
+
+	peerUsername string
+	peerKey      ed25519.PublicKey
+
+	rmu     sync.Mutex
+	recv    cipher.AEAD
+	recvSeq uint64
+	rbuf    []byte
+
+	wmu     sync.Mutex
+	send    cipher.AEAD
+	sendSeq uint64
+}
+
+// PeerUsername returns the username the peer presented, which is the one it
+// was dialled as on the initiating side.
+func (c *Conn) PeerUsername() string {
+	return c.peerUsername
+}
+
+// PeerKey returns the identity key of the peer.
+func (c *Conn) PeerKey() ed25519.PublicKey {
+	return c.peerKey
+}
+
+// Client runs the handshake on conn as username, expecting the peer to be
+// peerUsername owning peerKey.
+func Client(
+	conn net.Conn,
+	id *identity.Identity,
+	username string,
+	peerUsername string,
+	peerKey ed25519.PublicKey,
+) (*Conn, error) {
+	if len(username) > 255 {
+		return nil, errors.New("username too long")
+	}
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ePriv, ePub, err := newEphemeral()
+	if err != nil {
+		return nil, err
+	}
+
+	var hello bytes.Buffer
+	hello.Write(magic[:])
+	hello.WriteByte(version)
+	hello.Write(ePub)
+	hello.Write(id.PublicKey())
+	hello.WriteByte(byte(len(username)))
+	hello.WriteString(username)
+	if _, err := conn.Write(hello.Bytes()); err != nil {
+		return nil, errors.Wrap(err, "failed to send handshake")
+	}
+
+	reply := make([]byte, curve25519.PointSize+ed25519.PublicKeySize+ed25519.SignatureSize)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, errors.Wrap(err, "failed to read handshake reply")
+	}
+	rePub := reply[:curve25519.PointSize]
+	rKey := ed25519.PublicKey(reply[curve25519.PointSize : curve25519.PointSize+ed25519.PublicKeySize])
+	rSig := reply[curve25519.PointSize+ed25519.PublicKeySize:]
+
+	if !bytes.Equal(rKey, peerKey) {
+		return nil, ErrUnknownPeerKey
+	}
+
+	th := transcriptHash(hello.Bytes(), rePub, rKey)
+	if !ed25519.Verify(rKey, signed("responder", th), rSig) {
+		return nil, ErrInvalidSignature
+	}
+
+	if _, err := conn.Write(id.Sign(signed("initiator", th))); err != nil {
+		return nil, errors.Wrap(err, "failed to send handshake signature")
+	}
+
+	c := &Conn{
+		Conn:         conn,
+		peerUsername: peerUsername,
+		peerKey:      rKey,
+	}
+	if err := c.deriveKeys(ePriv, rePub, th, true); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Server runs the handshake on conn accepted from a peer. verify is called
+// with the username and identity key the peer presented, and fails the
+// handshake if it returns an error.
+func Server(
+	conn net.Conn,
+	id *identity.Identity,
+	verify func(username string, key ed25519.PublicKey) error,
+) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	header := make([]byte, len(magic)+1+curve25519.PointSize+ed25519.PublicKeySize+1)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, errors.Wrap(err, "failed to read handshake")
+	}
+	if !bytes.Equal(header[:len(magic)], magic[:]) || header[len(magic)] != version {
+		return nil, ErrUnsupported
+	}
+
+	usernameLen := int(header[len(header)-1])
+	hello := make([]byte, len(header)+usernameLen)
+	copy(hello, header)
+	if _, err := io.ReadFull(conn, hello[len(header):]); err != nil {
+		return nil, errors.Wrap(err, "failed to read handshake")
+	}
+
+	iePub := hello[len(magic)+1 : len(magic)+1+curve25519.PointSize]
+	iKey := ed25519.PublicKey(hello[len(magic)+1+curve25519.PointSize : len(header)-1])
+	username := string(hello[len(header):])
+
+	if err := verify(username, iKey); err != nil {
+		return nil, err
+	}
+
+	ePriv, ePub, err := newEphemeral()
+	if err != nil {
+		return nil, err
+	}
+
+	th := transcriptHash(hello, ePub, id.PublicKey())
+
+	var reply bytes.Buffer
+	reply.Write(ePub)
+	reply.Write(id.PublicKey())
+	reply.Write(id.Sign(signed("responder", th)))
+	if _, err := conn.Write(reply.Bytes()); err != nil {
+		return nil, errors.Wrap(err, "failed to send handshake reply")
+	}
+
+	iSig := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(conn, iSig); err != nil {
+		return nil, errors.Wrap(err, "failed to read handshake signature")
+	}
+	if !ed25519.Verify(iKey, signed("initiator", th), iSig) {
+		return nil, ErrInvalidSignature
+	}
+
+	c := &Conn{
+		Conn:         conn,
+		peerUsername: username,
+		peerKey:      iKey,
+	}
+	if err := c.deriveKeys(ePriv, iePub, th, false); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newEphemeral() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+// transcriptHash covers everything exchanged before the signatures, so that
+// signing it binds the ephemeral keys to both identities.
+func transcriptHash(hello, responderEphemeral, responderKey []byte) []byte {
+	h := sha256.New()
+	h.Write(hello)
+	h.Write(responderEphemeral)
+	h.Write(responderKey)
+	return h.Sum(nil)
+}
+
+func signed(role string, th []byte) []byte {
+	return append([]byte("p2p-messenger handshake "+role+"\n"), th...)
+}
+
+func (c *Conn) deriveKeys(priv, peerPub, th []byte, initiator bool) error {
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return errors.Wrap(err, "invalid ephemeral key")
+	}
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, th, []byte("p2p-messenger session keys")), keys); err != nil {
+		return err
+	}
+
+	i2r, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return err
+	}
+	r2i, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return err
+	}
+
+	if initiator {
+		c.send, c.recv = i2r, r2i
+	} else {
+		c.send, c.recv = r2i, i2r
+	}
+	return nil
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+	return n
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+
+		header := make([]byte, 2, 2+len(chunk)+c.send.Overhead())
+		binary.BigEndian.PutUint16(header, uint16(len(chunk)+c.send.Overhead()))
+		record := c.send.Seal(header, nonce(c.sendSeq), chunk, header)
+		c.sendSeq++
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rbuf) == 0 {
+		var header [2]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, err
+		}
+
+		record := make([]byte, binary.BigEndian.Uint16(header[:]))
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		plain, err := c.recv.Open(record[:0], nonce(c.recvSeq), record, header[:])
+		if err != nil {
+			return 0, errors.New("secure: message authentication failed")
+		}
+		c.recvSeq++
+		c.rbuf = plain
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
@@ -0,0 +1,282 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+)
+
+var errRejected = errors.New("rejected")
+
+func newIdentity(t *testing.T) *identity.Identity {
+	t.Helper()
+	id, err := identity.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func accept(string, ed25519.PublicKey) error { return nil }
+
+// handshake runs Client as alice against Server as bob over a pipe, closing
+// either end once its side fails so that the other one isn't left waiting.
+func handshake(
+	alice, bob *identity.Identity,
+	expected ed25519.PublicKey,
+	verify func(string, ed25519.PublicKey) error,
+) (client, server *Conn, clientErr, serverErr error) {
+	c, s := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server, serverErr = Server(s, bob, verify)
+		if serverErr != nil {
+			s.Close()
+		}
+	}()
+
+	client, clientErr = Client(c, alice, "alice", "bob", expected)
+	if clientErr != nil {
+		c.Close()
+	}
+	<-done
+	return client, server, clientErr, serverErr
+}
+
+func TestHandshake(t *testing.T) {
+	alice, bob, carol := newIdentity(t), newIdentity(t), newIdentity(t)
+
+	tests := []struct {
+		name          string
+		expected      ed25519.PublicKey
+		verify        func(string, ed25519.PublicKey) error
+		wantClientErr error
+		wantServerErr error
+	}{
+		{
+			name:     "ok",
+			expected: bob.PublicKey(),
+			verify: func(username string, key ed25519.PublicKey) error {
+				if username != "alice" || !key.Equal(alice.PublicKey()) {
+					return errRejected
+				}
+				return nil
+			},
+		},
+		{
+			name:          "unexpected server key",
+			expected:      carol.PublicKey(),
+			verify:        accept,
+			wantClientErr: ErrUnknownPeerKey,
+		},
+		{
+			name:          "rejected by the server",
+			expected:      bob.PublicKey(),
+			verify:        func(string, ed25519.PublicKey) error { return errRejected },
+			wantServerErr: errRejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, clientErr, serverErr := handshake(alice, bob, tt.expected, tt.verify)
+
+			if tt.wantClientErr == nil && tt.wantServerErr == nil {
+				if clientErr != nil || serverErr != nil {
+					t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+				}
+				defer client.Close()
+				defer server.Close()
+				if server.PeerUsername() != "alice" || !server.PeerKey().Equal(alice.PublicKey()) {
+					t.Errorf("server sees %s", server.PeerUsername())
+				}
+				if client.PeerUsername() != "bob" || !client.PeerKey().Equal(bob.PublicKey()) {
+					t.Errorf("client sees %s", client.PeerUsername())
+				}
+				exchange(t, client, server)
+				exchange(t, server, client)
+				return
+			}
+
+			if tt.wantClientErr != nil && !errors.Is(clientErr, tt.wantClientErr) {
+				t.Errorf("client err = %v, want %v", clientErr, tt.wantClientErr)
+			}
+			if tt.wantServerErr != nil && !errors.Is(serverErr, tt.wantServerErr) {
+				t.Errorf("server err = %v, want %v", serverErr, tt.wantServerErr)
+			}
+			if clientErr == nil || serverErr == nil {
+				t.Errorf("one side succeeded: client %v, server %v", clientErr, serverErr)
+			}
+		})
+	}
+}
+
+// exchange writes a message longer than a record from one end and reads it
+// at the other.
+func exchange(t *testing.T, from, to *Conn) {
+	t.Helper()
+
+	msg := bytes.Repeat([]byte("0123456789"), maxRecordSize/5)
+	go from.Write(msg)
+
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(to, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("message changed in transit")
+	}
+}
+
+func TestServerRejectsOtherVersions(t *testing.T) {
+	hello := func(magic string, version byte) []byte {
+		b := append([]byte(magic), version)
+		return append(b, make([]byte, 32+32+1)...)
+	}
+
+	tests := []struct {
+		name  string
+		hello []byte
+	}{
+		{"bad magic", hello("HTTP", 1)},
+		{"version mismatch", hello("P2PS", 2)},
+		{"version zero", hello("P2PS", 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			go c.Write(tt.hello)
+
+			if _, err := Server(s, newIdentity(t), accept); !errors.Is(err, ErrUnsupported) {
+				t.Errorf("err = %v, want %v", err, ErrUnsupported)
+			}
+		})
+	}
+}
+
+// recordConn collects what's written to it, and is read from what's put in
+// its buffer.
+type recordConn struct {
+	net.Conn
+	bytes.Buffer
+}
+
+func (c *recordConn) Read(b []byte) (int, error)  { return c.Buffer.Read(b) }
+func (c *recordConn) Write(b []byte) (int, error) { return c.Buffer.Write(b) }
+
+func TestConnRejectsTamperedRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		// mutate returns the records received given the two ones sent.
+		mutate   func(one, two []byte) [][]byte
+		wantRead []string
+		wantEOF  bool
+	}{
+		{
+			name:     "intact",
+			mutate:   func(one, two []byte) [][]byte { return [][]byte{one, two} },
+			wantRead: []string{"one", "two"},
+		},
+		{
+			name: "tampered",
+			mutate: func(one, two []byte) [][]byte {
+				one[len(one)-1] ^= 1
+				return [][]byte{one, two}
+			},
+		},
+		{
+			name: "tampered length",
+			mutate: func(one, two []byte) [][]byte {
+				one[1]--
+				return [][]byte{one[:len(one)-1], two}
+			},
+		},
+		{
+			name:     "replayed",
+			mutate:   func(one, two []byte) [][]byte { return [][]byte{one, one} },
+			wantRead: []string{"one"},
+		},
+		{
+			name:   "reordered",
+			mutate: func(one, two []byte) [][]byte { return [][]byte{two, one} },
+		},
+		{
+			name:   "dropped",
+			mutate: func(one, two []byte) [][]byte { return [][]byte{two} },
+		},
+		{
+			name:     "truncated",
+			mutate:   func(one, two []byte) [][]byte { return [][]byte{one, two[:len(two)-3]} },
+			wantRead: []string{"one"},
+			wantEOF:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := sealedPair(t)
+
+			sent := &recordConn{}
+			client.Conn = sent
+			var records [][]byte
+			for _, msg := range []string{"one", "two"} {
+				if _, err := client.Write([]byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+				records = append(records, append([]byte{}, sent.Bytes()...))
+				sent.Reset()
+			}
+
+			received := &recordConn{}
+			for _, r := range tt.mutate(records[0], records[1]) {
+				received.Write(r)
+			}
+			server.Conn = received
+
+			for _, want := range tt.wantRead {
+				b := make([]byte, 16)
+				n, err := server.Read(b)
+				if err != nil {
+					t.Fatalf("failed to read %q: %v", want, err)
+				}
+				if string(b[:n]) != want {
+					t.Fatalf("read %q, want %q", b[:n], want)
+				}
+			}
+
+			_, err := server.Read(make([]byte, 16))
+			switch {
+			case tt.wantEOF:
+				if err != io.ErrUnexpectedEOF {
+					t.Errorf("err = %v, want %v", err, io.ErrUnexpectedEOF)
+				}
+			case len(tt.wantRead) == 2:
+				if err != io.EOF {
+					t.Errorf("err = %v at the end, want %v", err, io.EOF)
+				}
+			default:
+				if err == nil || err == io.EOF {
+					t.Errorf("err = %v, want an authentication failure", err)
+				}
+			}
+		})
+	}
+}
+
+// sealedPair returns the two ends of a handshake between new identities.
+func sealedPair(t *testing.T) (client, server *Conn) {
+	t.Helper()
+	alice, bob := newIdentity(t), newIdentity(t)
+	client, server, clientErr, serverErr := handshake(alice, bob, bob.PublicKey(), accept)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	return client, server
+}
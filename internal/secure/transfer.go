@@ -0,0 +1,316 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+)
+
+// Transfers are keyed with a handshake of two datagrams, as a handshake over
+// UDP has to be retried as a whole when one of them is lost:
+//
+//	initiator -> responder: offer, signed by the initiator
+//	responder -> initiator: accept, signing the offer and its own ephemeral key
+//
+// Each sealed datagram carries the transfer ID and its sequence number in the
+// clear, followed by the ciphertext. Unlike records of a Conn, datagrams may
+// be lost or reordered, so the receiver only rejects sequence numbers it has
+// seen or which are too old to tell.
+
+// TransferIDSize is the size of the random ID of a transfer.
+const TransferIDSize = 16
+
+// sealedHeaderSize is the size of the transfer ID and sequence number in front
+// of a sealed datagram.
+const sealedHeaderSize = TransferIDSize + 8
+
+// replayWindowSize is how far behind the newest datagram received one may be
+// and still be accepted.
+const replayWindowSize = 64
+
+var ErrReplayed = errors.New("datagram replayed or too old")
+
+// TransferOffer opens the handshake of a transfer.
+type TransferOffer struct {
+	ID        []byte
+	From      string
+	To        string
+	Ephemeral []byte
+	Key       ed25519.PublicKey
+	Signature []byte
+}
+
+// TransferAccept answers a TransferOffer.
+type TransferAccept struct {
+	ID        []byte
+	Ephemeral []byte
+	Key       ed25519.PublicKey
+	Signature []byte
+}
+
+// Offerer is the initiating side of a transfer handshake.
+type Offerer struct {
+	offer   *TransferOffer
+	priv    []byte
+	peerKey ed25519.PublicKey
+}
+
+// Offer starts the handshake of a new transfer from username to peerUsername
+// owning peerKey.
+func Offer(id *identity.Identity, username, peerUsername string, peerKey ed25519.PublicKey) (*Offerer, error) {
+	transferID := make([]byte, TransferIDSize)
+	if _, err := rand.Read(transferID); err != nil {
+		return nil, err
+	}
+
+	priv, pub, err := newEphemeral()
+	if err != nil {
+		return nil, err
+	}
+
+	o := &TransferOffer{
+		ID:        transferID,
+		From:      username,
+		To:        peerUsername,
+		Ephemeral: pub,
+		Key:       id.PublicKey(),
+	}
+	o.Signature = id.Sign(offerMessage(o))
+
+	return &Offerer{offer: o, priv: priv, peerKey: peerKey}, nil
+}
+
+// Offer returns the offer to send, as many times as needed until it's
+// accepted.
+func (o *Offerer) Offer() *TransferOffer {
+	return o.offer
+}
+
+// Finish completes the handshake with the answer of the peer.
+func (o *Offerer) Finish(a *TransferAccept) (*Transfer, error) {
+	if !bytes.Equal(a.ID, o.offer.ID) {
+		return nil, errors.New("accept of another transfer")
+	}
+	if !bytes.Equal(a.Key, o.peerKey) {
+		return nil, ErrUnknownPeerKey
+	}
+
+	th := transferTranscriptHash(o.offer, a)
+	if !ed25519.Verify(a.Key, signed("transfer accept", th), a.Signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	return newTransfer(o.offer.ID, o.offer.To, a.Key, o.priv, a.Ephemeral, th, true)
+}
+
+// AcceptTransfer answers offer as id. verify is called with the username and
+// identity key the peer presented, and fails the handshake if it returns an
+// error.
+func AcceptTransfer(
+	id *identity.Identity,
+	offer *TransferOffer,
+	verify func(username string, key ed25519.PublicKey) error,
+) (*Transfer, *TransferAccept, error) {
+	if len(offer.ID) != TransferIDSize || len(offer.Key) != ed25519.PublicKeySize {
+		return nil, nil, ErrUnsupported
+	}
+	if !ed25519.Verify(offer.Key, offerMessage(offer), offer.Signature) {
+		return nil, nil, ErrInvalidSignature
+	}
+	if err := verify(offer.From, offer.Key); err != nil {
+		return nil, nil, err
+	}
+
+	priv, pub, err := newEphemeral()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a := &TransferAccept{
+		ID:        offer.ID,
+		Ephemeral: pub,
+		Key:       id.PublicKey(),
+	}
+	th := transferTranscriptHash(offer, a)
+	a.Signature = id.Sign(signed("transfer accept", th))
+
+	t, err := newTransfer(offer.ID, offer.From, offer.Key, priv, offer.Ephemeral, th, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, a, nil
+}
+
+func offerMessage(o *TransferOffer) []byte {
+	var b bytes.Buffer
+	b.WriteString("p2p-messenger transfer offer\n")
+	b.Write(o.ID)
+	b.Write(o.Ephemeral)
+	b.Write(o.Key)
+	b.WriteString(o.From + "\n" + o.To)
+	return b.Bytes()
+}
+
+func transferTranscriptHash(o *TransferOffer, a *TransferAccept) []byte {
+	h := sha256.New()
+	h.Write(offerMessage(o))
+	h.Write(o.Signature)
+	h.Write(a.Ephemeral)
+	h.Write(a.Key)
+	return h.Sum(nil)
+}
+
+// Transfer seals and opens the datagrams of one transfer between two peers.
+type Transfer struct {
+	id           []byte
+	peerUsername string
+	peerKey      ed25519.PublicKey
+
+	send    cipher.AEAD
+	sendSeq atomic.Uint64
+
+	recv     cipher.AEAD
+	windowMu sync.Mutex
+	window   replayWindow
+}
+
+func newTransfer(
+	id []byte,
+	peerUsername string,
+	peerKey ed25519.PublicKey,
+	priv []byte,
+	peerPub []byte,
+	th []byte,
+	initiator bool,
+) (*Transfer, error) {
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ephemeral key")
+	}
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, th, []byte("p2p-messenger transfer keys")), keys); err != nil {
+		return nil, err
+	}
+
+	i2r, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	r2i, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Transfer{
+		id:           id,
+		peerUsername: peerUsername,
+		peerKey:      peerKey,
+	}
+	if initiator {
+		t.send, t.recv = i2r, r2i
+	} else {
+		t.send, t.recv = r2i, i2r
+	}
+	return t, nil
+}
+
+func (t *Transfer) ID() []byte {
+	return t.id
+}
+
+// PeerUsername returns the username of the peer at the other end, which has
+// proven it owns it.
+func (t *Transfer) PeerUsername() string {
+	return t.peerUsername
+}
+
+func (t *Transfer) PeerKey() ed25519.PublicKey {
+	return t.peerKey
+}
+
+// Seal returns b sealed to be sent to the peer.
+func (t *Transfer) Seal(b []byte) []byte {
+	seq := t.sendSeq.Add(1) - 1
+
+	header := make([]byte, sealedHeaderSize, sealedHeaderSize+len(b)+t.send.Overhead())
+	copy(header, t.id)
+	binary.BigEndian.PutUint64(header[TransferIDSize:], seq)
+	return t.send.Seal(header, nonce(seq), b, header)
+}
+
+// Open returns the content of sealed, which was sent by the peer.
+func (t *Transfer) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < sealedHeaderSize || !bytes.Equal(sealed[:TransferIDSize], t.id) {
+		return nil, errors.New("datagram of another transfer")
+	}
+
+	header := sealed[:sealedHeaderSize]
+	seq := binary.BigEndian.Uint64(header[TransferIDSize:])
+
+	b, err := t.recv.Open(nil, nonce(seq), sealed[sealedHeaderSize:], header)
+	if err != nil {
+		return nil, errors.New("secure: message authentication failed")
+	}
+
+	t.windowMu.Lock()
+	defer t.windowMu.Unlock()
+	if !t.window.accept(seq) {
+		return nil, ErrReplayed
+	}
+	return b, nil
+}
+
+// SealedTransferID returns the ID of the transfer sealed was sealed for.
+func SealedTransferID(sealed []byte) ([]byte, bool) {
+	if len(sealed) < sealedHeaderSize {
+		return nil, false
+	}
+	return sealed[:TransferIDSize], true
+}
+
+// replayWindow remembers which of the last replayWindowSize sequence numbers
+// were received.
+type replayWindow struct {
+	// next is one past the highest sequence number received.
+	next uint64
+	// bit i of seen is set if next-1-i was received.
+	seen uint64
+}
+
+func (w *replayWindow) accept(seq uint64) bool {
+	if seq >= w.next {
+		if shift := seq - w.next + 1; shift < replayWindowSize {
+			w.seen <<= shift
+		} else {
+			w.seen = 0
+		}
+		w.seen |= 1
+		w.next = seq + 1
+		return true
+	}
+
+	age := w.next - 1 - seq
+	if age >= replayWindowSize {
+		return false
+	}
+	bit := uint64(1) << age
+	if w.seen&bit != 0 {
+		return false
+	}
+	w.seen |= bit
+	return true
+}
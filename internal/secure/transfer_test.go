@@ -0,0 +1,245 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+// transferPair keys a transfer from alice to bob.
+func transferPair(t *testing.T) (sender, receiver *Transfer) {
+	t.Helper()
+	alice, bob := newIdentity(t), newIdentity(t)
+
+	o, err := Offer(alice, "alice", "bob", bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, a, err := AcceptTransfer(bob, o.Offer(), accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err = o.Finish(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, receiver
+}
+
+func TestTransferHandshake(t *testing.T) {
+	alice, bob, carol := newIdentity(t), newIdentity(t), newIdentity(t)
+
+	tests := []struct {
+		name string
+		// expected is the key alice expects of bob.
+		expected    ed25519.PublicKey
+		mutateOffer func(o *TransferOffer)
+		mutate      func(a *TransferAccept)
+		verify      func(string, ed25519.PublicKey) error
+		wantErr     error
+	}{
+		{
+			name:     "ok",
+			expected: bob.PublicKey(),
+		},
+		{
+			name:        "tampered offer",
+			expected:    bob.PublicKey(),
+			mutateOffer: func(o *TransferOffer) { o.To = "carol" },
+			wantErr:     ErrInvalidSignature,
+		},
+		{
+			name:        "offer with another key",
+			expected:    bob.PublicKey(),
+			mutateOffer: func(o *TransferOffer) { o.Key = carol.PublicKey() },
+			wantErr:     ErrInvalidSignature,
+		},
+		{
+			name:        "malformed offer",
+			expected:    bob.PublicKey(),
+			mutateOffer: func(o *TransferOffer) { o.ID = o.ID[:4] },
+			wantErr:     ErrUnsupported,
+		},
+		{
+			name:     "offer rejected",
+			expected: bob.PublicKey(),
+			verify:   func(string, ed25519.PublicKey) error { return errRejected },
+			wantErr:  errRejected,
+		},
+		{
+			name:     "unexpected key",
+			expected: carol.PublicKey(),
+			wantErr:  ErrUnknownPeerKey,
+		},
+		{
+			name:     "tampered accept",
+			expected: bob.PublicKey(),
+			mutate: func(a *TransferAccept) {
+				a.Ephemeral = append([]byte{}, a.Ephemeral...)
+				a.Ephemeral[0] ^= 1
+			},
+			wantErr: ErrInvalidSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := Offer(alice, "alice", "bob", tt.expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			offer := *o.Offer()
+			if tt.mutateOffer != nil {
+				tt.mutateOffer(&offer)
+			}
+			verify := tt.verify
+			if verify == nil {
+				verify = func(username string, key ed25519.PublicKey) error {
+					if username != "alice" || !key.Equal(alice.PublicKey()) {
+						return errRejected
+					}
+					return nil
+				}
+			}
+
+			receiver, a, err := AcceptTransfer(bob, &offer, verify)
+			if err != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("accepting err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.mutate != nil {
+				tt.mutate(a)
+			}
+
+			sender, err := o.Finish(a)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if sender.PeerUsername() != "bob" || receiver.PeerUsername() != "alice" {
+				t.Errorf("peers are %s and %s", sender.PeerUsername(), receiver.PeerUsername())
+			}
+			b, err := receiver.Open(sender.Seal([]byte("hello")))
+			if err != nil || string(b) != "hello" {
+				t.Errorf("opened %q, %v", b, err)
+			}
+			b, err = sender.Open(receiver.Seal([]byte("ack")))
+			if err != nil || string(b) != "ack" {
+				t.Errorf("opened %q, %v", b, err)
+			}
+		})
+	}
+}
+
+func TestTransferRejectsReplays(t *testing.T) {
+	tests := []struct {
+		name   string
+		sealed int
+		// open is the order the datagrams are opened in, and rejected the
+		// positions in it which are to be rejected.
+		open     []int
+		rejected []int
+	}{
+		{"in order", 3, []int{0, 1, 2}, nil},
+		{"reordered", 3, []int{2, 0, 1}, nil},
+		{"replayed", 3, []int{0, 1, 0, 2, 2}, []int{2, 4}},
+		{"replayed late", 70, []int{0, 69, 0}, []int{2}},
+		{"within the window", 70, []int{69, 6}, nil},
+		{"older than the window", 70, []int{69, 5}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, receiver := transferPair(t)
+			sealed := make([][]byte, tt.sealed)
+			for i := range sealed {
+				sealed[i] = sender.Seal([]byte{byte(i)})
+			}
+
+			for i, seq := range tt.open {
+				wantRejected := false
+				for _, r := range tt.rejected {
+					wantRejected = wantRejected || r == i
+				}
+
+				b, err := receiver.Open(sealed[seq])
+				if wantRejected {
+					if !errors.Is(err, ErrReplayed) {
+						t.Errorf("opening %d: err = %v, want %v", seq, err, ErrReplayed)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("opening %d: %v", seq, err)
+				}
+				if len(b) != 1 || b[0] != byte(seq) {
+					t.Errorf("opened %v, want %d", b, seq)
+				}
+			}
+		})
+	}
+}
+
+func TestTransferRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(sealed []byte, other *Transfer) []byte
+	}{
+		{"ciphertext", func(s []byte, _ *Transfer) []byte { s[len(s)-1] ^= 1; return s }},
+		{"sequence number", func(s []byte, _ *Transfer) []byte { s[sealedHeaderSize-1] ^= 1; return s }},
+		{"transfer ID", func(s []byte, _ *Transfer) []byte { s[0] ^= 1; return s }},
+		{"truncated", func(s []byte, _ *Transfer) []byte { return s[:sealedHeaderSize-1] }},
+		{"of another transfer", func(_ []byte, other *Transfer) []byte { return other.Seal([]byte("hello")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, receiver := transferPair(t)
+			other, _ := transferPair(t)
+
+			sealed := tt.mutate(sender.Seal([]byte("hello")), other)
+			if _, err := receiver.Open(sealed); err == nil {
+				t.Fatal("tampered datagram opened")
+			}
+			// the genuine datagram is still accepted after a forged one
+			if _, err := receiver.Open(sender.Seal([]byte("hello"))); err != nil {
+				t.Errorf("genuine datagram rejected: %v", err)
+			}
+		})
+	}
+
+	sender, _ := transferPair(t)
+	if _, err := sender.Open(sender.Seal([]byte("hello"))); err == nil {
+		t.Error("datagram reflected to its sender opened")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	tests := []struct {
+		seq  uint64
+		want bool
+	}{
+		{0, true},
+		{0, false},
+		{5, true},
+		{3, true},
+		{3, false},
+		{100, true},
+		{37, true},
+		{36, false},
+		{5, false},
+		{99, true},
+		{1000, true},
+		{100, false},
+		{999, true},
+	}
+	for _, tt := range tests {
+		if got := w.accept(tt.seq); got != tt.want {
+			t.Errorf("accept(%d) = %v, want %v", tt.seq, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package stun
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+)
+
+// ParseTrustedProxies parses IPs and CIDRs of the proxies whose
+// X-Forwarded-For header is trusted.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy %q", proxy)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// observedIP returns the address r came from. X-Forwarded-For is only
+// honored for hops added by trusted proxies.
+func (s *Stun) observedIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !s.trusted(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !s.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (s *Stun) trusted(ip net.IP) bool {
+	for _, n := range s.cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddr replaces the host of the claimed address with the observed IP.
+func publicAddr(observed net.IP, claimed string) (string, error) {
+	_, port, err := net.SplitHostPort(claimed)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid address %q", claimed)
+	}
+	return net.JoinHostPort(observed.String(), port), nil
+}
+
+// publicUDPAddr prefers the mapping the peer discovered over STUN, which
+// unlike the claimed port survives NATs that remap ports. It's only trusted
+// if it's on the observed IP, so a peer can't point others at a third party.
+func publicUDPAddr(observed net.IP, req *request.PostPeer) (string, error) {
+	if req.PublicUDPAddr != "" {
+		host, _, err := net.SplitHostPort(req.PublicUDPAddr)
+		if err == nil && net.ParseIP(host).Equal(observed) {
+			return req.PublicUDPAddr, nil
+		}
+	}
+	return publicAddr(observed, req.UDPAddr)
+}
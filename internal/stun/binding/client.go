@@ -0,0 +1,102 @@
+package binding
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Retransmission schedule of RFC 5389 section 7.2.1.
+const (
+	initialRTO = 500 * time.Millisecond
+	maxRetries = 7
+)
+
+// Client discovers the public mapping of a UDP socket it shares with other
+// protocols. Whoever reads the socket must pass every datagram to Handle.
+type Client struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	pending map[[12]byte]chan *Message
+}
+
+func NewClient(conn net.PacketConn) *Client {
+	return &Client{
+		conn:    conn,
+		pending: make(map[[12]byte]chan *Message),
+	}
+}
+
+// Handle consumes b if it's a response to one of our requests and reports
+// whether it was a STUN message at all.
+func (c *Client) Handle(b []byte) bool {
+	if !IsMessage(b) {
+		return false
+	}
+
+	m, err := Decode(b)
+	if err != nil {
+		return true
+	}
+
+	c.mu.Lock()
+	ch, ok := c.pending[m.TransactionID]
+	delete(c.pending, m.TransactionID)
+	c.mu.Unlock()
+
+	if ok {
+		ch <- m
+	}
+	return true
+}
+
+// Discover asks the STUN server at server for the address it sees our socket
+// at, i.e. the public mapping the NAT created for it.
+func (c *Client) Discover(ctx context.Context, server string) (*net.UDPAddr, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error resolving STUN server %q", server)
+	}
+
+	req, err := NewBindingRequest()
+	if err != nil {
+		return nil, err
+	}
+	b := req.Encode()
+
+	ch := make(chan *Message, 1)
+	c.mu.Lock()
+	c.pending[req.TransactionID] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, req.TransactionID)
+		c.mu.Unlock()
+	}()
+
+	rto := initialRTO
+	for i := 0; i < maxRetries; i++ {
+		if _, err := c.conn.WriteTo(b, serverAddr); err != nil {
+			return nil, errors.Wrapf(err, "error sending binding request to %s", server)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(rto):
+			rto *= 2
+		case resp := <-ch:
+			if resp.Type != TypeBindingSuccess {
+				return nil, errors.Errorf("STUN server %s rejected the binding request", server)
+			}
+			return resp.MappedAddress()
+		}
+	}
+
+	return nil, errors.Errorf("no response from STUN server %s", server)
+}
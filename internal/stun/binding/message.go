@@ -0,0 +1,212 @@
+package binding
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Message types and attributes of RFC 5389 that are used here.
+const (
+	TypeBindingRequest       uint16 = 0x0001
+	TypeBindingSuccess       uint16 = 0x0101
+	TypeBindingErrorResponse uint16 = 0x0111
+
+	AttrMappedAddress    uint16 = 0x0001
+	AttrXORMappedAddress uint16 = 0x0020
+	AttrSoftware         uint16 = 0x8022
+	AttrFingerprint      uint16 = 0x8028
+
+	MagicCookie uint32 = 0x2112A442
+
+	headerSize     = 20
+	fingerprintXOR = 0x5354554e
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+var ErrNotSTUN = errors.New("not a STUN message")
+
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+type Message struct {
+	Type          uint16
+	TransactionID [12]byte
+	Attributes    []Attribute
+}
+
+func NewBindingRequest() (*Message, error) {
+	m := &Message{Type: TypeBindingRequest}
+	if _, err := rand.Read(m.TransactionID[:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IsMessage reports whether b looks like a STUN message. It lets STUN share a
+// socket with other protocols.
+func IsMessage(b []byte) bool {
+	return len(b) >= headerSize &&
+		b[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(b[4:8]) == MagicCookie &&
+		int(binary.BigEndian.Uint16(b[2:4]))+headerSize == len(b)
+}
+
+// Encode encodes m, appending a FINGERPRINT attribute.
+func (m *Message) Encode() []byte {
+	b := make([]byte, headerSize, 128)
+	binary.BigEndian.PutUint16(b[0:2], m.Type)
+	binary.BigEndian.PutUint32(b[4:8], MagicCookie)
+	copy(b[8:20], m.TransactionID[:])
+
+	for _, attr := range m.Attributes {
+		b = appendAttribute(b, attr.Type, attr.Value)
+	}
+
+	// the length covers the fingerprint when the crc is computed
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerSize+8))
+	crc := crc32.ChecksumIEEE(b) ^ fingerprintXOR
+	var value [4]byte
+	binary.BigEndian.PutUint32(value[:], crc)
+	return appendAttribute(b, AttrFingerprint, value[:])
+}
+
+func appendAttribute(b []byte, typ uint16, value []byte) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[0:2], typ)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+	b = append(b, header[:]...)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Decode decodes a STUN message and verifies its FINGERPRINT, if any.
+func Decode(b []byte) (*Message, error) {
+	if !IsMessage(b) {
+		return nil, ErrNotSTUN
+	}
+
+	m := &Message{Type: binary.BigEndian.Uint16(b[0:2])}
+	copy(m.TransactionID[:], b[8:20])
+
+	for off := headerSize; off < len(b); {
+		if off+4 > len(b) {
+			return nil, errors.New("truncated attribute header")
+		}
+		typ := binary.BigEndian.Uint16(b[off : off+2])
+		length := int(binary.BigEndian.Uint16(b[off+2 : off+4]))
+		if off+4+length > len(b) {
+			return nil, errors.Errorf("truncated attribute 0x%04x", typ)
+		}
+		value := b[off+4 : off+4+length]
+
+		if typ == AttrFingerprint {
+			if length != 4 || off+8 != len(b) {
+				return nil, errors.New("malformed FINGERPRINT attribute")
+			}
+			want := crc32.ChecksumIEEE(b[:off]) ^ fingerprintXOR
+			if binary.BigEndian.Uint32(value) != want {
+				return nil, errors.New("FINGERPRINT mismatch")
+			}
+			break
+		}
+
+		m.Attributes = append(m.Attributes, Attribute{typ, value})
+		off += 4 + (length+3)&^3
+	}
+
+	return m, nil
+}
+
+func (m *Message) Get(typ uint16) ([]byte, bool) {
+	for _, attr := range m.Attributes {
+		if attr.Type == typ {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+// AddXORMappedAddress adds the XOR-MAPPED-ADDRESS attribute for addr.
+func (m *Message) AddXORMappedAddress(addr *net.UDPAddr) {
+	value := encodeAddress(addr)
+	xorAddress(value, m.TransactionID)
+	m.Attributes = append(m.Attributes, Attribute{AttrXORMappedAddress, value})
+}
+
+// MappedAddress returns the address in XOR-MAPPED-ADDRESS, falling back to
+// the MAPPED-ADDRESS of older servers.
+func (m *Message) MappedAddress() (*net.UDPAddr, error) {
+	if value, ok := m.Get(AttrXORMappedAddress); ok {
+		value = append([]byte(nil), value...)
+		if len(value) >= 4 {
+			xorAddress(value, m.TransactionID)
+		}
+		return decodeAddress(value)
+	}
+	if value, ok := m.Get(AttrMappedAddress); ok {
+		return decodeAddress(value)
+	}
+	return nil, errors.New("no mapped address in message")
+}
+
+func encodeAddress(addr *net.UDPAddr) []byte {
+	family, ip := byte(familyIPv6), addr.IP.To16()
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		family, ip = familyIPv4, ip4
+	}
+
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	copy(value[4:], ip)
+	return value
+}
+
+func decodeAddress(value []byte) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, errors.New("malformed address attribute")
+	}
+
+	var ipLen int
+	switch value[1] {
+	case familyIPv4:
+		ipLen = net.IPv4len
+	case familyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, errors.Errorf("unknown address family 0x%02x", value[1])
+	}
+	if len(value) != 4+ipLen {
+		return nil, errors.New("malformed address attribute")
+	}
+
+	return &net.UDPAddr{
+		IP:   append(net.IP(nil), value[4:]...),
+		Port: int(binary.BigEndian.Uint16(value[2:4])),
+	}, nil
+}
+
+// xorAddress applies the XOR of XOR-MAPPED-ADDRESS to an encoded address in
+// place. It's its own inverse.
+func xorAddress(value []byte, txID [12]byte) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], MagicCookie)
+	copy(key[4:], txID[:])
+
+	value[2] ^= key[0]
+	value[3] ^= key[1]
+	for i := 4; i < len(value); i++ {
+		value[i] ^= key[i-4]
+	}
+}
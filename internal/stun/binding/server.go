@@ -0,0 +1,77 @@
+package binding
+
+import (
+	"context"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+const software = "golang-p2p-messenger"
+
+// Server answers Binding Requests with the address they came from.
+type Server struct {
+	logger *logrus.Logger
+}
+
+func NewServer(logger *logrus.Logger) *Server {
+	return &Server{logger: logger}
+}
+
+// Serve answers the requests received on conn until ctx is done.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		resp, err := s.respond(buf[:n], addr)
+		if err != nil {
+			s.logger.Debugf("dropping datagram from %s: %v\n", addr, err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			s.logger.Warnf("error answering binding request of %s: %v\n", addr, err)
+		}
+	}
+}
+
+func (s *Server) respond(b []byte, addr net.Addr) ([]byte, error) {
+	req, err := Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	if req.Type != TypeBindingRequest {
+		return nil, nil
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, nil
+	}
+
+	resp := &Message{
+		Type:          TypeBindingSuccess,
+		TransactionID: req.TransactionID,
+	}
+	resp.AddXORMappedAddress(udpAddr)
+	resp.Attributes = append(resp.Attributes, Attribute{AttrSoftware, []byte(software)})
+	return resp.Encode(), nil
+}
@@ -0,0 +1,143 @@
+package stun
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+)
+
+const (
+	challengeTTL = 30 * time.Second
+
+	// maxChallenges bounds the memory taken by challenges nobody answers.
+	maxChallenges = 1 << 16
+)
+
+type challenge struct {
+	username string
+	expires  time.Time
+}
+
+// challenges are the nonces handed out to peers to sign, by nonce. Each can
+// be used once.
+type challenges struct {
+	mu      sync.Mutex
+	pending map[string]challenge
+}
+
+func newChallenges() *challenges {
+	return &challenges{
+		pending: make(map[string]challenge),
+	}
+}
+
+func (c *challenges) issue(username string) (string, error) {
+	nonce, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) >= maxChallenges {
+		now := time.Now()
+		for n, ch := range c.pending {
+			if now.After(ch.expires) {
+				delete(c.pending, n)
+			}
+		}
+		if len(c.pending) >= maxChallenges {
+			return "", errors.New("too many pending challenges")
+		}
+	}
+
+	c.pending[nonce] = challenge{
+		username: username,
+		expires:  time.Now().Add(challengeTTL),
+	}
+	return nonce, nil
+}
+
+// take reports whether nonce was issued to username and hasn't expired, and
+// forgets it.
+func (c *challenges) take(username, nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch, ok := c.pending[nonce]
+	if !ok {
+		return false
+	}
+	delete(c.pending, nonce)
+	return ch.username == username && time.Now().Before(ch.expires)
+}
+
+// ChallengeHandler hands out nonces to sign to prove the ownership of a
+// username.
+func (s *Stun) ChallengeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			req  request.PostChallenge
+			resp response.PostChallenge
+			enc  = json.NewEncoder(w)
+		)
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = fmt.Sprintf("error decoding request: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		if req.Username == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = "username is empty"
+			enc.Encode(resp)
+			return
+		}
+
+		nonce, err := s.challenges.issue(req.Username)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			resp.Error = fmt.Sprintf("error issuing challenge: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		resp.OK = true
+		resp.Nonce = nonce
+		resp.TTL = int64(challengeTTL / time.Second)
+		w.WriteHeader(http.StatusOK)
+		enc.Encode(resp)
+	})
+}
+
+// verify checks that proof is the signature by key of a challenge issued to
+// username for action. On failure it returns the status code to respond with.
+func (s *Stun) verify(username, action string, key ed25519.PublicKey, proof *request.Proof) (status int, err error) {
+	if !s.challenges.take(username, proof.Nonce) {
+		return http.StatusUnauthorized, errors.New("unknown or expired challenge")
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return http.StatusBadRequest, errors.New("invalid public key")
+	}
+	if !identity.VerifyChallenge(key, action, username, proof.Nonce, proof.Signature) {
+		return http.StatusForbidden, errors.Errorf("invalid signature of challenge for %s", username)
+	}
+	return http.StatusOK, nil
+}
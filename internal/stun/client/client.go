@@ -0,0 +1,443 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/peer"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+)
+
+var (
+	ErrNotFound = errors.New("peer not found")
+	ErrConflict = errors.New("username already exists")
+)
+
+// Registration is what the server hands out for a successful registration.
+type Registration struct {
+	// Token proves ownership of the registration.
+	Token string
+	TTL   time.Duration
+	// ObservedIP is the address the server saw the peer at.
+	ObservedIP string
+}
+
+// Client talks to the discovery server over HTTP.
+type Client struct {
+	addr string
+	http *http.Client
+}
+
+func New(addr string) *Client {
+	return &Client{
+		addr: addr,
+		http: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Challenge asks the server for a nonce to sign to prove the ownership of
+// username.
+func (c *Client) Challenge(ctx context.Context, username string) (nonce string, err error) {
+	body, err := json.Marshal(&request.PostChallenge{Username: username})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/challenge/", "", bytes.NewReader(body))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get challenge from STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	var respBody response.PostChallenge
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return "", errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return "", errors.Errorf(
+			"failed to get challenge for %s from server at %s with status %s and error: %s",
+			username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return respBody.Nonce, nil
+}
+
+// prove answers a fresh challenge for action on username with id.
+func (c *Client) prove(ctx context.Context, id *identity.Identity, action, username string) (*request.Proof, error) {
+	nonce, err := c.Challenge(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return &request.Proof{
+		Nonce:     nonce,
+		Signature: id.SignChallenge(action, username, nonce),
+	}, nil
+}
+
+// Register registers req as owned by id.
+func (c *Client) Register(ctx context.Context, req *request.PostPeer, id *identity.Identity) (*Registration, error) {
+	proof, err := c.prove(ctx, id, identity.ActionRegister, req.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := *req
+	signed.PublicKey = id.PublicKey()
+	signed.Proof = *proof
+
+	body, err := json.Marshal(&signed)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/peer/", "", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return nil, ErrConflict
+	}
+
+	var respBody response.PostPeer
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nil, errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return nil, errors.Errorf(
+			"failed to register %s on STUN server at %s with status %s and error: %s",
+			req.Username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return &Registration{
+		Token:      respBody.Token,
+		TTL:        time.Duration(respBody.TTL) * time.Second,
+		ObservedIP: respBody.ObservedIP,
+	}, nil
+}
+
+// Heartbeat renews the lease of username, owned by id, and returns its new
+// duration.
+func (c *Client) Heartbeat(ctx context.Context, username string, id *identity.Identity) (ttl time.Duration, err error) {
+	proof, err := c.prove(ctx, id, identity.ActionRenew, username)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(&request.PutPeer{Proof: *proof})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, "/peer/"+username, "", bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to send heartbeat to STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, ErrNotFound
+	}
+
+	var respBody response.PutPeer
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return 0, errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return 0, errors.Errorf(
+			"failed to renew lease of %s on server at %s with status %s and error: %s",
+			username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return time.Duration(respBody.TTL) * time.Second, nil
+}
+
+// Deregister removes the registration of username, owned by id.
+func (c *Client) Deregister(ctx context.Context, username string, id *identity.Identity) error {
+	proof, err := c.prove(ctx, id, identity.ActionDeregister, username)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(&request.DeletePeer{Proof: *proof})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodDelete, "/peer/"+username, "", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to deregister from STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	var respBody response.DeletePeer
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return errors.Errorf(
+			"failed to deregister %s from server at %s with status %s and error: %s",
+			username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+	return nil
+}
+
+// Peer returns the registration of username.
+func (c *Client) Peer(ctx context.Context, username string) (*peer.Peer, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/peer/"+username, "", nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up %s on STUN server: %s", username, c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	var respBody response.GetPeer
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nil, errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK || len(respBody.Peers) == 0 {
+		return nil, errors.Errorf(
+			"failed to get peer %s from server at %s with status %s and error: %s",
+			username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return respBody.Peers[0], nil
+}
+
+// Punch asks the server to have target probe us and returns target along
+// with the ID of the attempt.
+func (c *Client) Punch(ctx context.Context, username, token, target string) (*response.PostPunch, error) {
+	body, err := json.Marshal(&request.PostPunch{
+		Username: username,
+		Target:   target,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/punch/", token, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request hole punching from STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	var respBody response.PostPunch
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nil, errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return nil, errors.Errorf(
+			"failed to request hole punching to %s from server at %s with status %s and error: %s",
+			target,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return &respBody, nil
+}
+
+// Relay asks the server to set up a relay to target and have target join it.
+// The relay carries a byte stream if stream is set, or datagrams otherwise.
+func (c *Client) Relay(ctx context.Context, username, token, target string, stream bool) (*response.PostRelay, error) {
+	body, err := json.Marshal(&request.PostRelay{
+		Username: username,
+		Target:   target,
+		Stream:   stream,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/relay/", token, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request a relay from STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	var respBody response.PostRelay
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nil, errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return nil, errors.Errorf(
+			"failed to request a relay to %s from server at %s with status %s and error: %s",
+			target,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return &respBody, nil
+}
+
+// Signals waits for signals addressed to username. It may return none if
+// nothing happened for a while.
+func (c *Client) Signals(ctx context.Context, username, token string) ([]response.Signal, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/signal/"+username, token, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to poll STUN server for signals: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	var respBody response.GetSignals
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nil, errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return nil, errors.Errorf(
+			"failed to poll signals of %s from server at %s with status %s and error: %s",
+			username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return respBody.Signals, nil
+}
+
+// DefaultSTUNPort is where the discovery server answers STUN binding
+// requests unless configured otherwise.
+const DefaultSTUNPort = "3478"
+
+// LocalIP returns the IP of the interface used to reach the server, which is
+// the private address other peers behind the same NAT can reach us at.
+func (c *Client) LocalIP() (net.IP, error) {
+	u, err := c.url()
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	// no packets are sent, this only picks a route
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find a route to %s", host)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// STUNAddr returns the default address of the STUN binding service of the
+// server.
+func (c *Client) STUNAddr() (string, error) {
+	u, err := c.url()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(u.Hostname(), DefaultSTUNPort), nil
+}
+
+// RelayAddr returns the address to reach a relay advertised as addr at,
+// which is on the host of the server if addr doesn't name one.
+func (c *Client) RelayAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid relay address %q", addr)
+	}
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		u, err := c.url()
+		if err != nil {
+			return "", err
+		}
+		host = u.Hostname()
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func (c *Client) url() (*url.URL, error) {
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid server address %q", c.addr)
+	}
+	return u, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.http.Do(req)
+}
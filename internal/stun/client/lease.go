@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+)
+
+// Lease keeps a registration alive by sending heartbeats in the background.
+type Lease struct {
+	Username string
+	// ObservedIP is the address the server saw the peer at when it
+	// registered.
+	ObservedIP string
+
+	client   *Client
+	identity *identity.Identity
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu    sync.Mutex
+	token string
+}
+
+// KeepAlive sends a heartbeat every third of the lease duration until ctx
+// is done or the lease is stopped. If the server has already forgotten the
+// registration, it is registered again.
+func (c *Client) KeepAlive(
+	ctx context.Context,
+	req *request.PostPeer,
+	reg *Registration,
+	id *identity.Identity,
+	logger *logrus.Logger,
+) *Lease {
+	ctx, cancel := context.WithCancel(ctx)
+	l := &Lease{
+		Username:   req.Username,
+		ObservedIP: reg.ObservedIP,
+		client:     c,
+		identity:   id,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		token:      reg.Token,
+	}
+
+	go func() {
+		defer close(l.done)
+
+		ttl := reg.TTL
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval(ttl)):
+			}
+
+			newTTL, err := c.Heartbeat(ctx, req.Username, id)
+			if errors.Is(err, ErrNotFound) {
+				logger.Warnf("lease of %q expired, registering again\n", req.Username)
+				var newReg *Registration
+				newReg, err = c.Register(ctx, req, id)
+				if err == nil {
+					l.setToken(newReg.Token)
+					newTTL = newReg.TTL
+				}
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Errorln("Error renewing lease:", "error", err)
+				}
+				continue
+			}
+			ttl = newTTL
+		}
+	}()
+
+	return l
+}
+
+// Token returns the token that proves ownership of the registration to
+// signal other peers.
+func (l *Lease) Token() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.token
+}
+
+func (l *Lease) setToken(token string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.token = token
+}
+
+// Stop stops the heartbeats and waits for the background goroutine to exit.
+func (l *Lease) Stop() {
+	l.cancel()
+	<-l.done
+}
+
+// Release stops the heartbeats and removes the registration from the server.
+func (l *Lease) Release(ctx context.Context) error {
+	l.Stop()
+	err := l.client.Deregister(ctx, l.Username, l.identity)
+	if errors.Is(err, ErrNotFound) {
+		// already expired
+		return nil
+	}
+	return err
+}
+
+func interval(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return time.Second
+	}
+	return ttl / 3
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/mailbox"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+)
+
+var (
+	ErrMailboxFull     = errors.New("mailbox is full")
+	ErrMailboxDisabled = errors.New("the server keeps no mail")
+)
+
+// Key returns the identity key owning username, which outlives its
+// registration.
+func (c *Client) Key(ctx context.Context, username string) (ed25519.PublicKey, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/key/"+username, "", nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up the key of %s on STUN server: %s", username, c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	var respBody response.GetKey
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nil, errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return nil, errors.Errorf(
+			"failed to get the key of %s from server at %s with status %s and error: %s",
+			username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return respBody.PublicKey, nil
+}
+
+// PostMail deposits e in the mailbox of to on behalf of e.From.
+func (c *Client) PostMail(ctx context.Context, token, to string, e *mailbox.Envelope) error {
+	body, err := json.Marshal(&request.PostMail{Envelope: *e})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/mailbox/"+to, token, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to deposit mail on STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusInsufficientStorage:
+		return ErrMailboxFull
+	case http.StatusServiceUnavailable:
+		return ErrMailboxDisabled
+	}
+
+	var respBody response.PostMail
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return errors.Errorf(
+			"failed to deposit mail for %s on server at %s with status %s and error: %s",
+			to,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+	return nil
+}
+
+// Mail returns the envelopes in the mailbox of username, oldest first.
+func (c *Client) Mail(ctx context.Context, username, token string) ([]*mailbox.Envelope, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/mailbox/"+username, token, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch mail from STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return nil, ErrMailboxDisabled
+	}
+
+	var respBody response.GetMail
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nil, errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return nil, errors.Errorf(
+			"failed to fetch mail of %s from server at %s with status %s and error: %s",
+			username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+
+	return respBody.Envelopes, nil
+}
+
+// DeleteMail removes the envelopes with ids from the mailbox of username.
+func (c *Client) DeleteMail(ctx context.Context, username, token string, ids []string) error {
+	body, err := json.Marshal(&request.DeleteMail{IDs: ids})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodDelete, "/mailbox/"+username, token, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete mail from STUN server: %s", c.addr)
+	}
+	defer resp.Body.Close()
+
+	var respBody response.DeleteMail
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return errors.Wrap(err, "failed to decode response body")
+	}
+
+	if resp.StatusCode != http.StatusOK || !respBody.OK {
+		return errors.Errorf(
+			"failed to delete mail of %s from server at %s with status %s and error: %s",
+			username,
+			c.addr,
+			resp.Status,
+			respBody.Error,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/fsutil"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
+)
+
+type Config struct {
+	// Path is the JSON file the records are kept in. It's created if it
+	// doesn't exist.
+	Path string
+}
+
+type record struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt time.Time       `json:"expires_at,omitempty"`
+}
+
+func (r record) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// File is a thread-safe repository persisted in a single JSON file.
+// Every mutation rewrites the file atomically, so it's meant for small
+// deployments rather than heavy traffic.
+type File[T any] struct {
+	path string
+
+	mu      sync.RWMutex
+	records map[string]record
+	closed  bool
+}
+
+func New[T any](cfg *Config) (*File[T], error) {
+	f := &File[T]{
+		path:    cfg.Path,
+		records: make(map[string]record),
+	}
+
+	b, err := os.ReadFile(cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, f.flush()
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading file %q", cfg.Path)
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &f.records); err != nil {
+			return nil, errors.Wrapf(err, "error decoding file %q", cfg.Path)
+		}
+	}
+	return f, nil
+}
+
+func (f *File[T]) Ping(ctx context.Context) (pong string, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return "", errors.New("repository is closed")
+	}
+	if _, err := os.Stat(f.path); err != nil {
+		return "", errors.Wrapf(err, "error accessing file %q", f.path)
+	}
+	return "PONG", nil
+}
+
+func (f *File[T]) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	return f.flush()
+}
+
+func (f *File[T]) Get(ctx context.Context, key string) (val T, err error) {
+	f.mu.RLock()
+	r, ok := f.records[key]
+	f.mu.RUnlock()
+
+	if !ok || r.expired(time.Now()) {
+		err = repository.ErrNotFound
+		return
+	}
+
+	err = json.Unmarshal(r.Value, &val)
+	return
+}
+
+func (f *File[T]) Set(ctx context.Context, key string, val T, ttl time.Duration) error {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling value %v", val)
+	}
+
+	r := record{Value: b}
+	if ttl > 0 {
+		r.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.records[key] = r
+	return f.flush()
+}
+
+func (f *File[T]) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	r, ok := f.records[key]
+	if !ok || r.expired(now) {
+		return repository.ErrNotFound
+	}
+
+	r.ExpiresAt = time.Time{}
+	if ttl > 0 {
+		r.ExpiresAt = now.Add(ttl)
+	}
+	f.records[key] = r
+	return f.flush()
+}
+
+func (f *File[T]) Delete(ctx context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r, ok := f.records[key]
+	if !ok || r.expired(time.Now()) {
+		return repository.ErrNotFound
+	}
+
+	delete(f.records, key)
+	return f.flush()
+}
+
+func (f *File[T]) Exists(ctx context.Context, key string) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	r, ok := f.records[key]
+	return ok && !r.expired(time.Now()), nil
+}
+
+func (f *File[T]) Keys(ctx context.Context) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(f.records))
+	for key, r := range f.records {
+		if !r.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *File[T]) Values(ctx context.Context) ([]T, error) {
+	keys, err := f.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]T, 0, len(keys))
+	for _, key := range keys {
+		value, err := f.Get(ctx, key)
+		if errors.Is(err, repository.ErrNotFound) {
+			// expired since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (f *File[T]) Size(ctx context.Context) (int64, error) {
+	keys, err := f.Keys(ctx)
+	return int64(len(keys)), err
+}
+
+// flush drops the expired records and writes the rest to disk.
+// f.mu must be held for writing.
+func (f *File[T]) flush() error {
+	now := time.Now()
+	for key, r := range f.records {
+		if r.expired(now) {
+			delete(f.records, key)
+		}
+	}
+
+	b, err := json.MarshalIndent(f.records, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error encoding records")
+	}
+
+	return errors.Wrapf(fsutil.WriteFile(f.path, b), "error writing file %q", f.path)
+}
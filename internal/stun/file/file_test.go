@@ -0,0 +1,140 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
+)
+
+type peer struct {
+	Addr string
+}
+
+func open(t *testing.T, path string) *File[peer] {
+	t.Helper()
+	f, err := New[peer](&Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// prepare runs on a repository holding "alice", which never expires.
+		prepare func(f *File[peer]) error
+		key     string
+		want    *peer
+	}{
+		{name: "set", key: "alice", want: &peer{"1.1.1.1:1"}},
+		{name: "unknown", key: "bob"},
+		{
+			name:    "overwritten",
+			prepare: func(f *File[peer]) error { return f.Set(ctx, "alice", peer{"2.2.2.2:2"}, 0) },
+			key:     "alice",
+			want:    &peer{"2.2.2.2:2"},
+		},
+		{
+			name:    "deleted",
+			prepare: func(f *File[peer]) error { return f.Delete(ctx, "alice") },
+			key:     "alice",
+		},
+		{
+			name: "expired",
+			prepare: func(f *File[peer]) error {
+				err := f.Set(ctx, "bob", peer{"3.3.3.3:3"}, 10*time.Millisecond)
+				time.Sleep(20 * time.Millisecond)
+				return err
+			},
+			key: "bob",
+		},
+		{
+			name:    "expiring later",
+			prepare: func(f *File[peer]) error { return f.Expire(ctx, "alice", time.Hour) },
+			key:     "alice",
+			want:    &peer{"1.1.1.1:1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "peers.json")
+			f := open(t, path)
+			if err := f.Set(ctx, "alice", peer{"1.1.1.1:1"}, 0); err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				if err := tt.prepare(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// read back from the file, as after a restart
+			f = open(t, path)
+			defer f.Close()
+			got, err := f.Get(ctx, tt.key)
+			if tt.want == nil {
+				if !errors.Is(err, repository.ErrNotFound) {
+					t.Errorf("got %+v, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != *tt.want {
+				t.Errorf("got %+v, want %+v", got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestFileList(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := open(t, filepath.Join(dir, "peers.json"))
+	defer f.Close()
+
+	for _, key := range []string{"carol", "alice", "bob"} {
+		if err := f.Set(ctx, key, peer{key}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Set(ctx, "dave", peer{"dave"}, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	keys, _ := f.Keys(ctx)
+	values, _ := f.Values(ctx)
+	size, _ := f.Size(ctx)
+	if fmt.Sprint(keys) != "[alice bob carol]" || fmt.Sprint(values) != "[{alice} {bob} {carol}]" || size != 3 {
+		t.Errorf("listed %v, %v and size %d", keys, values, size)
+	}
+
+	// only the file itself is left, without the ones written aside
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files in the directory", len(entries))
+	}
+}
+
+func TestFileCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New[peer](&Config{Path: path}); err == nil {
+		t.Error("corrupt file opened")
+	}
+}
@@ -0,0 +1,281 @@
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/mailbox"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
+)
+
+const (
+	DefaultMailboxRetention   = 7 * 24 * time.Hour
+	DefaultMailboxQuota       = 1 << 20
+	DefaultMailboxMaxMessages = 100
+	DefaultMaxMailSize        = 64 << 10
+)
+
+// KeyHandler returns the key owning a username, which messages for its owner
+// are sealed to while it's offline.
+func (s *Stun) KeyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			resp response.GetKey
+			enc  = json.NewEncoder(w)
+		)
+
+		username := r.URL.Path[len("/key/"):]
+		key, err := s.keys.Get(context.Background(), username)
+		if errors.Is(err, repository.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			resp.Error = fmt.Sprintf("username %s isn't owned by anyone", username)
+			enc.Encode(resp)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp.Error = fmt.Sprintf("error getting owner of username: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		resp.OK = true
+		resp.PublicKey = key
+		w.WriteHeader(http.StatusOK)
+		enc.Encode(resp)
+	})
+}
+
+// MailboxHandler keeps messages for peers while they're offline. Messages
+// are deposited by registered peers, and fetched and deleted by the owner of
+// the mailbox.
+func (s *Stun) MailboxHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.cfg.Mailbox {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(response.PostMail{Error: "mailboxes are disabled"})
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			s.postMail(w, r)
+		case http.MethodGet:
+			s.getMail(w, r)
+		case http.MethodDelete:
+			s.deleteMail(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (s *Stun) postMail(w http.ResponseWriter, r *http.Request) {
+	var (
+		req  request.PostMail
+		resp response.PostMail
+		enc  = json.NewEncoder(w)
+	)
+
+	recipient := r.URL.Path[len("/mailbox/"):]
+
+	// the envelope is a little larger than the sealed message in JSON
+	body := io.LimitReader(r.Body, int64(2*s.cfg.MaxMailSize+4096))
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = fmt.Sprintf("error decoding request: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
+	if status, err := s.authorize(r, req.From); err != nil {
+		s.metrics.mail.WithLabelValues("forbidden").Inc()
+		w.WriteHeader(status)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	if req.ID == "" || len(req.Sealed) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = "message has no id or content"
+		enc.Encode(resp)
+		return
+	}
+	if len(req.Sealed) > s.cfg.MaxMailSize {
+		s.metrics.mail.WithLabelValues("too_large").Inc()
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		resp.Error = fmt.Sprintf("message of %d bytes exceeds the maximum of %d", len(req.Sealed), s.cfg.MaxMailSize)
+		enc.Encode(resp)
+		return
+	}
+
+	// mail is only kept for usernames someone can prove the ownership of
+	if exists, err := s.keys.Exists(context.Background(), recipient); err != nil || !exists {
+		status, msg := http.StatusNotFound, fmt.Sprintf("username %s isn't owned by anyone", recipient)
+		if err != nil {
+			status, msg = http.StatusInternalServerError, fmt.Sprintf("error getting owner of username: %v", err)
+		}
+		w.WriteHeader(status)
+		resp.Error = msg
+		enc.Encode(resp)
+		return
+	}
+
+	s.mailboxMu.Lock()
+	defer s.mailboxMu.Unlock()
+
+	m, err := s.mailbox(recipient)
+	if err != nil {
+		s.metrics.mail.WithLabelValues("error").Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	if m.Has(req.ID) {
+		// a retry of a deposit whose response was lost
+		resp.OK = true
+		w.WriteHeader(http.StatusOK)
+		enc.Encode(resp)
+		return
+	}
+
+	if len(m.Envelopes) >= s.cfg.MailboxMaxMessages || m.Size()+len(req.Sealed) > s.cfg.MailboxQuota {
+		s.metrics.mail.WithLabelValues("full").Inc()
+		w.WriteHeader(http.StatusInsufficientStorage)
+		resp.Error = fmt.Sprintf("the mailbox of %s is full", recipient)
+		enc.Encode(resp)
+		return
+	}
+
+	e := req.Envelope
+	e.Time = time.Now()
+	m.Envelopes = append(m.Envelopes, &e)
+
+	// the mailbox outlives its newest message by the retention
+	if err := s.mailboxes.Set(context.Background(), recipient, m, s.cfg.MailboxRetention); err != nil {
+		s.metrics.mail.WithLabelValues("error").Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Error = fmt.Sprintf("error storing message: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
+	s.metrics.mail.WithLabelValues("ok").Inc()
+
+	resp.OK = true
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(resp)
+}
+
+func (s *Stun) getMail(w http.ResponseWriter, r *http.Request) {
+	var (
+		resp response.GetMail
+		enc  = json.NewEncoder(w)
+	)
+
+	username := r.URL.Path[len("/mailbox/"):]
+	if status, err := s.authorize(r, username); err != nil {
+		w.WriteHeader(status)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	s.mailboxMu.Lock()
+	m, err := s.mailbox(username)
+	s.mailboxMu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	resp.OK = true
+	resp.Envelopes = m.Envelopes
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(resp)
+}
+
+// deleteMail removes the messages the owner of the mailbox has fetched.
+func (s *Stun) deleteMail(w http.ResponseWriter, r *http.Request) {
+	var (
+		req  request.DeleteMail
+		resp response.DeleteMail
+		enc  = json.NewEncoder(w)
+	)
+
+	username := r.URL.Path[len("/mailbox/"):]
+	if status, err := s.authorize(r, username); err != nil {
+		w.WriteHeader(status)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = fmt.Sprintf("error decoding request: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
+	s.mailboxMu.Lock()
+	defer s.mailboxMu.Unlock()
+
+	m, err := s.mailbox(username)
+	if err == nil {
+		resp.Deleted = m.Remove(req.IDs)
+		if len(m.Envelopes) == 0 {
+			err = s.mailboxes.Delete(context.Background(), username)
+			if errors.Is(err, repository.ErrNotFound) {
+				err = nil
+			}
+		} else if resp.Deleted > 0 {
+			err = s.mailboxes.Set(context.Background(), username, m, s.cfg.MailboxRetention)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Error = fmt.Sprintf("error deleting messages: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
+	resp.OK = true
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(resp)
+}
+
+// mailbox returns the mailbox of username without the expired messages,
+// which is empty if there's none. s.mailboxMu must be held, which only
+// serializes the requests to this server: several servers sharing a
+// repository may lose messages deposited concurrently.
+func (s *Stun) mailbox(username string) (*mailbox.Mailbox, error) {
+	m, err := s.mailboxes.Get(context.Background(), username)
+	if errors.Is(err, repository.ErrNotFound) {
+		return &mailbox.Mailbox{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting mailbox")
+	}
+
+	m.Expire(s.cfg.MailboxRetention)
+	return m, nil
+}
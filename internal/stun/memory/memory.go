@@ -0,0 +1,197 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
+)
+
+type entry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// Memory is a thread-safe repository which lives in memory.
+// Values are stored marshalled, just like in Redis, so callers never share
+// them with the repository.
+type Memory[T any] struct {
+	mu      sync.RWMutex
+	entries map[string]entry
+	// purgeAt is how many entries trigger the next purge of the expired
+	// ones on Set.
+	purgeAt int
+}
+
+// minPurgeAt keeps a few entries from being purged on every Set.
+const minPurgeAt = 64
+
+func New[T any]() *Memory[T] {
+	return &Memory[T]{entries: make(map[string]entry), purgeAt: minPurgeAt}
+}
+
+func (m *Memory[T]) Ping(ctx context.Context) (pong string, err error) {
+	return "PONG", nil
+}
+
+func (m *Memory[T]) Close() error {
+	return nil
+}
+
+func (m *Memory[T]) Get(ctx context.Context, key string) (val T, err error) {
+	m.mu.RLock()
+	e, ok := m.entries[key]
+	m.mu.RUnlock()
+
+	if ok && e.expired(time.Now()) {
+		m.deleteExpired(key)
+		ok = false
+	}
+	if !ok {
+		err = repository.ErrNotFound
+		return
+	}
+
+	err = json.Unmarshal(e.value, &val)
+	return
+}
+
+func (m *Memory[T]) Set(ctx context.Context, key string, val T, ttl time.Duration) error {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling value %v", val)
+	}
+
+	e := entry{value: b}
+	if ttl > 0 {
+		e.expiresAt = time.Now().Add(ttl)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = e
+	// purged once the entries have doubled since the last purge, which
+	// bounds the expired ones kept at little cost per Set
+	if len(m.entries) >= m.purgeAt {
+		m.purge()
+	}
+	return nil
+}
+
+func (m *Memory[T]) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	e, ok := m.entries[key]
+	if !ok || e.expired(now) {
+		return repository.ErrNotFound
+	}
+
+	e.expiresAt = time.Time{}
+	if ttl > 0 {
+		e.expiresAt = now.Add(ttl)
+	}
+	m.entries[key] = e
+	return nil
+}
+
+func (m *Memory[T]) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || e.expired(time.Now()) {
+		return repository.ErrNotFound
+	}
+
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *Memory[T]) Exists(ctx context.Context, key string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.entries[key]
+	return ok && !e.expired(time.Now()), nil
+}
+
+func (m *Memory[T]) Keys(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.purge()
+
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *Memory[T]) Values(ctx context.Context) ([]T, error) {
+	keys, err := m.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]T, 0, len(keys))
+	for _, key := range keys {
+		value, err := m.Get(ctx, key)
+		if errors.Is(err, repository.ErrNotFound) {
+			// expired since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (m *Memory[T]) Size(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.purge()
+	return int64(len(m.entries)), nil
+}
+
+// purge removes the expired entries. m.mu must be held for writing.
+func (m *Memory[T]) purge() {
+	now := time.Now()
+	for key, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+
+	m.purgeAt = 2 * len(m.entries)
+	if m.purgeAt < minPurgeAt {
+		m.purgeAt = minPurgeAt
+	}
+}
+
+// deleteExpired removes the entry with key if it has expired, unless it has
+// been set again since it was read.
+func (m *Memory[T]) deleteExpired(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[key]; ok && e.expired(time.Now()) {
+		delete(m.entries, key)
+	}
+}
@@ -0,0 +1,194 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
+)
+
+// expiring is a ttl which has run out once waitExpiry has passed.
+const (
+	expiring   = 10 * time.Millisecond
+	waitExpiry = 20 * time.Millisecond
+)
+
+type peer struct {
+	Addr string
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// prepare runs on a repository holding "alice", which never expires.
+		prepare func(m *Memory[peer]) error
+		key     string
+		want    *peer
+	}{
+		{name: "set", key: "alice", want: &peer{"1.1.1.1:1"}},
+		{name: "unknown", key: "bob"},
+		{
+			name:    "overwritten",
+			prepare: func(m *Memory[peer]) error { return m.Set(ctx, "alice", peer{"2.2.2.2:2"}, 0) },
+			key:     "alice",
+			want:    &peer{"2.2.2.2:2"},
+		},
+		{
+			name:    "deleted",
+			prepare: func(m *Memory[peer]) error { return m.Delete(ctx, "alice") },
+			key:     "alice",
+		},
+		{
+			name: "expired",
+			prepare: func(m *Memory[peer]) error {
+				err := m.Set(ctx, "bob", peer{"3.3.3.3:3"}, expiring)
+				time.Sleep(waitExpiry)
+				return err
+			},
+			key: "bob",
+		},
+		{
+			name: "expiry set",
+			prepare: func(m *Memory[peer]) error {
+				err := m.Expire(ctx, "alice", expiring)
+				time.Sleep(waitExpiry)
+				return err
+			},
+			key: "alice",
+		},
+		{
+			name: "expiry extended",
+			prepare: func(m *Memory[peer]) error {
+				if err := m.Set(ctx, "bob", peer{"3.3.3.3:3"}, expiring); err != nil {
+					return err
+				}
+				err := m.Expire(ctx, "bob", time.Hour)
+				time.Sleep(waitExpiry)
+				return err
+			},
+			key:  "bob",
+			want: &peer{"3.3.3.3:3"},
+		},
+		{
+			name: "expiry removed",
+			prepare: func(m *Memory[peer]) error {
+				if err := m.Set(ctx, "bob", peer{"3.3.3.3:3"}, expiring); err != nil {
+					return err
+				}
+				err := m.Expire(ctx, "bob", 0)
+				time.Sleep(waitExpiry)
+				return err
+			},
+			key:  "bob",
+			want: &peer{"3.3.3.3:3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New[peer]()
+			if err := m.Set(ctx, "alice", peer{"1.1.1.1:1"}, 0); err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				if err := tt.prepare(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := m.Get(ctx, tt.key)
+			exists, _ := m.Exists(ctx, tt.key)
+			if tt.want == nil {
+				if !errors.Is(err, repository.ErrNotFound) || exists {
+					t.Errorf("got %+v, %v, exists = %v", got, err, exists)
+				}
+				if err := m.Delete(ctx, tt.key); !errors.Is(err, repository.ErrNotFound) {
+					t.Errorf("deleting err = %v, want %v", err, repository.ErrNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != *tt.want || !exists {
+				t.Errorf("got %+v, exists = %v, want %+v", got, exists, *tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryList(t *testing.T) {
+	ctx := context.Background()
+	m := New[peer]()
+
+	for _, key := range []string{"carol", "alice", "bob"} {
+		if err := m.Set(ctx, key, peer{key}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Set(ctx, "dave", peer{"dave"}, expiring); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitExpiry)
+
+	keys, _ := m.Keys(ctx)
+	values, _ := m.Values(ctx)
+	size, _ := m.Size(ctx)
+	if fmt.Sprint(keys) != "[alice bob carol]" || fmt.Sprint(values) != "[{alice} {bob} {carol}]" || size != 3 {
+		t.Errorf("listed %v, %v and size %d", keys, values, size)
+	}
+}
+
+func TestMemoryPurge(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// access touches the expired entries, if at all, before they're
+		// counted.
+		access func(m *Memory[peer], n int)
+	}{
+		{
+			name: "read",
+			access: func(m *Memory[peer], n int) {
+				for i := 0; i < n; i++ {
+					m.Get(ctx, fmt.Sprint(i))
+				}
+			},
+		},
+		{
+			name: "others set",
+			access: func(m *Memory[peer], n int) {
+				for i := 0; i < 2*minPurgeAt; i++ {
+					m.Set(ctx, fmt.Sprint("live", i%minPurgeAt), peer{}, 0)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New[peer]()
+			n := minPurgeAt - 1
+			for i := 0; i < n; i++ {
+				if err := m.Set(ctx, fmt.Sprint(i), peer{}, expiring); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(waitExpiry)
+
+			tt.access(m, n)
+
+			m.mu.RLock()
+			defer m.mu.RUnlock()
+			for key, e := range m.entries {
+				if e.expired(time.Now()) {
+					t.Fatalf("expired %q kept among %d entries", key, len(m.entries))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package stun
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	registrations *prometheus.CounterVec
+	lookups       *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	relays        prometheus.Gauge
+	relayedBytes  prometheus.Counter
+	mail          *prometheus.CounterVec
+}
+
+func newMetrics(s *Stun) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		registrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "stun",
+			Name:      "registrations_total",
+			Help:      "Number of registration attempts by result.",
+		}, []string{"result"}),
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "stun",
+			Name:      "lookups_total",
+			Help:      "Number of peer lookups by username, by whether the peer was found.",
+		}, []string{"result"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "stun",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of the requests to the peer endpoints by HTTP method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		relays: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "stun",
+			Name:      "relays",
+			Help:      "Number of relays forwarding traffic.",
+		}),
+		relayedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "stun",
+			Name:      "relayed_bytes_total",
+			Help:      "Number of bytes forwarded by relays.",
+		}),
+		mail: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "stun",
+			Name:      "mail_total",
+			Help:      "Number of messages deposited in mailboxes by result.",
+		}, []string{"result"}),
+	}
+
+	peers := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "stun",
+		Name:      "peers",
+		Help:      "Number of registered peers.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		size, err := s.repo.Size(ctx)
+		if err != nil {
+			s.logger.Errorln("Error getting repository size:", "error", err)
+			return -1
+		}
+		return float64(size)
+	})
+
+	m.registry.MustRegister(
+		m.registrations,
+		m.lookups,
+		m.latency,
+		m.relays,
+		m.relayedBytes,
+		m.mail,
+		peers,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(m.latency, h)
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,82 @@
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
+)
+
+// PunchHandler coordinates UDP hole punching: the target is signalled to
+// probe the requester while the requester is told the target's candidates.
+func (s *Stun) PunchHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			req  request.PostPunch
+			resp response.PostPunch
+			enc  = json.NewEncoder(w)
+		)
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = fmt.Sprintf("error decoding request: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		if status, err := s.authorize(r, req.Username); err != nil {
+			w.WriteHeader(status)
+			resp.Error = err.Error()
+			enc.Encode(resp)
+			return
+		}
+
+		self, err := s.repo.Get(context.Background(), req.Username)
+		if err == nil {
+			resp.Peer, err = s.repo.Get(context.Background(), req.Target)
+		}
+		if errors.Is(err, repository.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			resp.Error = fmt.Sprintf("there is no peer with username %s", req.Target)
+			enc.Encode(resp)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp.Error = fmt.Sprintf("error getting peer: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		id, err := newToken()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp.Error = fmt.Sprintf("error generating id: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		s.hub.push(req.Target, response.Signal{
+			Type: response.SignalPunch,
+			ID:   id,
+			Peer: self.Public(),
+		})
+
+		resp.OK = true
+		resp.ID = id
+		resp.Peer = resp.Peer.Public()
+		w.WriteHeader(http.StatusOK)
+		enc.Encode(resp)
+	})
+}
@@ -3,6 +3,8 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"strings"
+	"time"
 
 	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
 	"github.com/pkg/errors"
@@ -11,10 +13,17 @@ import (
 
 type Config struct {
 	URL string
+	// DB and Password override the ones in URL when set.
+	DB       *int
+	Password string
+	// KeyPrefix namespaces the keys, so that several repositories can share
+	// a database.
+	KeyPrefix string
 }
 
 type Redis[T any] struct {
 	client *redis.Client
+	prefix string
 }
 
 func New[T any](cfg *Config) (*Redis[T], error) {
@@ -22,8 +31,14 @@ func New[T any](cfg *Config) (*Redis[T], error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "error parsing redis url %q", cfg.URL)
 	}
+	if cfg.DB != nil {
+		opt.DB = *cfg.DB
+	}
+	if cfg.Password != "" {
+		opt.Password = cfg.Password
+	}
 	client := redis.NewClient(opt)
-	return &Redis[T]{client}, nil
+	return &Redis[T]{client, cfg.KeyPrefix}, nil
 }
 
 func (r *Redis[T]) Ping(ctx context.Context) (pong string, err error) {
@@ -35,7 +50,7 @@ func (r *Redis[T]) Close() error {
 }
 
 func (r *Redis[T]) Get(ctx context.Context, key string) (val T, err error) {
-	res, err := r.client.Get(ctx, key).Result()
+	res, err := r.client.Get(ctx, r.prefix+key).Result()
 	if err == redis.Nil {
 		err = repository.ErrNotFound
 		return
@@ -49,17 +64,53 @@ func (r *Redis[T]) Get(ctx context.Context, key string) (val T, err error) {
 	return
 }
 
-func (r *Redis[T]) Set(ctx context.Context, key string, val T) error {
+func (r *Redis[T]) Set(ctx context.Context, key string, val T, ttl time.Duration) error {
 	b, err := json.Marshal(val) // can't we just store and then cast?
 	if err != nil {
 		return errors.Wrapf(err, "error marshalling value %v", val)
 	}
 
-	return r.client.Set(ctx, key, string(b), 0).Err()
+	return r.client.Set(ctx, r.prefix+key, string(b), ttl).Err()
+}
+
+func (r *Redis[T]) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	var (
+		ok  bool
+		err error
+	)
+	if ttl == 0 {
+		ok, err = r.client.Persist(ctx, r.prefix+key).Result()
+		if err == nil && !ok {
+			// PERSIST also reports false for keys without a ttl.
+			var exists bool
+			exists, err = r.Exists(ctx, key)
+			ok = exists
+		}
+	} else {
+		ok, err = r.client.Expire(ctx, r.prefix+key, ttl).Result()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error setting ttl of key %v", key)
+	}
+	if !ok {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+func (r *Redis[T]) Delete(ctx context.Context, key string) error {
+	count, err := r.client.Del(ctx, r.prefix+key).Result()
+	if err != nil {
+		return errors.Wrapf(err, "error deleting key %v", key)
+	}
+	if count == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
 }
 
 func (r *Redis[T]) Exists(ctx context.Context, key string) (bool, error) {
-	count, err := r.client.Exists(ctx, key).Result()
+	count, err := r.client.Exists(ctx, r.prefix+key).Result()
 	if err != nil {
 		return false, errors.Wrapf(err, "error checking if key %v exists", key)
 	}
@@ -68,9 +119,9 @@ func (r *Redis[T]) Exists(ctx context.Context, key string) (bool, error) {
 }
 
 func (r *Redis[T]) Keys(ctx context.Context) (keys []string, err error) {
-	iter := r.client.Scan(ctx, 0, "", 0).Iterator()
+	iter := r.client.Scan(ctx, 0, r.pattern(), 0).Iterator()
 	for iter.Next(ctx) {
-		keys = append(keys, iter.Val())
+		keys = append(keys, strings.TrimPrefix(iter.Val(), r.prefix))
 	}
 	if err = iter.Err(); err != nil {
 		keys = nil
@@ -93,13 +144,17 @@ func (r *Redis[T]) Values(ctx context.Context) (values []T, err error) {
 		cursor uint64
 	)
 	for {
-		keys, cursor, err = r.client.Scan(ctx, cursor, "*", count).Result()
+		keys, cursor, err = r.client.Scan(ctx, cursor, r.pattern(), count).Result()
 		if err != nil {
 			return
 		}
 
 		for _, key := range keys {
-			value, err := r.Get(ctx, key)
+			value, err := r.Get(ctx, strings.TrimPrefix(key, r.prefix))
+			if errors.Is(err, repository.ErrNotFound) {
+				// expired since it was scanned
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -114,6 +169,12 @@ func (r *Redis[T]) Values(ctx context.Context) (values []T, err error) {
 }
 
 func (r *Redis[T]) Size(ctx context.Context) (int64, error) {
+	if r.prefix != "" {
+		// the database may hold keys of other repositories too
+		keys, err := r.Keys(ctx)
+		return int64(len(keys)), err
+	}
+
 	keyCount, err := r.client.DBSize(ctx).Result()
 	if err != nil {
 		return 0, err
@@ -121,3 +182,16 @@ func (r *Redis[T]) Size(ctx context.Context) (int64, error) {
 
 	return keyCount, nil
 }
+
+// pattern matches the keys of this repository.
+func (r *Redis[T]) pattern() string {
+	var b strings.Builder
+	for _, c := range r.prefix {
+		if strings.ContainsRune(`*?[]^\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('*')
+	return b.String()
+}
@@ -0,0 +1,367 @@
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/relay"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
+)
+
+// relayIdleTimeout is how long a relay is kept open without traffic.
+const relayIdleTimeout = time.Minute
+
+// RelayHandler sets up a relay between the requester and the target, which
+// is signalled to join it.
+func (s *Stun) RelayHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			req  request.PostRelay
+			resp response.PostRelay
+			enc  = json.NewEncoder(w)
+		)
+
+		if s.cfg.RelayAddr == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			resp.Error = "relaying is disabled"
+			enc.Encode(resp)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = fmt.Sprintf("error decoding request: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		if status, err := s.authorize(r, req.Username); err != nil {
+			w.WriteHeader(status)
+			resp.Error = err.Error()
+			enc.Encode(resp)
+			return
+		}
+
+		self, err := s.repo.Get(context.Background(), req.Username)
+		if err == nil {
+			_, err = s.repo.Get(context.Background(), req.Target)
+		}
+		if errors.Is(err, repository.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			resp.Error = fmt.Sprintf("there is no peer with username %s", req.Target)
+			enc.Encode(resp)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp.Error = fmt.Sprintf("error getting peer: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		id, err := newToken()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			resp.Error = fmt.Sprintf("error generating id: %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		s.relays.add(id, req.Username, req.Target)
+		s.hub.push(req.Target, response.Signal{
+			Type:   response.SignalRelay,
+			ID:     id,
+			Peer:   self.Public(),
+			Addr:   s.cfg.RelayAddr,
+			Stream: req.Stream,
+		})
+
+		resp.OK = true
+		resp.ID = id
+		resp.Addr = s.cfg.RelayAddr
+		w.WriteHeader(http.StatusOK)
+		enc.Encode(resp)
+	})
+}
+
+// ServeRelay accepts relay connections on l until ctx is done.
+func (s *Stun) ServeRelay(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveRelayConn(conn)
+	}
+}
+
+func (s *Stun) serveRelayConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(relay.JoinTimeout))
+
+	buf := make([]byte, relay.MaxFrameSize)
+	n, err := relay.ReadFrame(conn, buf)
+	if err != nil {
+		s.logger.Debugln("Error reading relay hello:", "error", err)
+		conn.Close()
+		return
+	}
+
+	var hello relay.Hello
+	if err := json.Unmarshal(buf[:n], &hello); err != nil {
+		s.rejectRelay(conn, errors.Wrap(err, "error decoding hello"))
+		return
+	}
+
+	if _, err := s.checkToken(hello.Username, hello.Token); err != nil {
+		s.rejectRelay(conn, err)
+		return
+	}
+
+	other, err := s.relays.join(hello.ID, hello.Username, conn)
+	if err != nil {
+		s.rejectRelay(conn, err)
+		return
+	}
+	if other == nil {
+		// the peer joining second forwards the traffic
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	other.SetDeadline(time.Time{})
+
+	welcome, _ := json.Marshal(relay.Welcome{OK: true})
+	if err := relay.WriteFrame(conn, welcome); err != nil {
+		conn.Close()
+		other.Close()
+		return
+	}
+	if err := relay.WriteFrame(other, welcome); err != nil {
+		conn.Close()
+		other.Close()
+		return
+	}
+
+	s.pipe(conn, other)
+}
+
+func (s *Stun) rejectRelay(conn net.Conn, err error) {
+	defer conn.Close()
+
+	b, _ := json.Marshal(relay.Welcome{Error: err.Error()})
+	relay.WriteFrame(conn, b)
+}
+
+// pipe forwards frames between a and b until both are done sending.
+func (s *Stun) pipe(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	s.metrics.relays.Inc()
+	defer s.metrics.relays.Dec()
+
+	lim := newLimiter(s.cfg.RelayRate)
+
+	var wg sync.WaitGroup
+	forward := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		buf := make([]byte, relay.MaxFrameSize)
+		for {
+			src.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+			n, err := relay.ReadFrame(src, buf)
+			if err == io.EOF {
+				// let dst read what's been forwarded before it's closed
+				if tcp, ok := dst.(*net.TCPConn); ok {
+					tcp.CloseWrite()
+					return
+				}
+			}
+			if err != nil {
+				// unblocks the other direction
+				a.Close()
+				b.Close()
+				return
+			}
+
+			lim.wait(2 + n)
+			if err := relay.WriteFrame(dst, buf[:n]); err != nil {
+				a.Close()
+				b.Close()
+				return
+			}
+			s.metrics.relayedBytes.Add(float64(2 + n))
+		}
+	}
+
+	wg.Add(2)
+	go forward(a, b)
+	go forward(b, a)
+	wg.Wait()
+}
+
+type relaySession struct {
+	peers  [2]string
+	joined [2]bool
+	// first is the connection of the peer that joined first.
+	first  net.Conn
+	paired chan struct{}
+}
+
+// relays keeps the relays that have been set up until both peers join them.
+type relays struct {
+	mu       sync.Mutex
+	sessions map[string]*relaySession
+}
+
+func newRelays() *relays {
+	return &relays{
+		sessions: make(map[string]*relaySession),
+	}
+}
+
+func (r *relays) add(id, a, b string) {
+	sess := &relaySession{
+		peers:  [2]string{a, b},
+		paired: make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	r.sessions[id] = sess
+	r.mu.Unlock()
+
+	time.AfterFunc(2*relay.JoinTimeout, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.sessions[id] == sess {
+			delete(r.sessions, id)
+		}
+	})
+}
+
+// join adds conn of username to the relay id. The peer joining first waits
+// for the other one and gets no connection back, the one joining second gets
+// the connection of the first.
+func (r *relays) join(id, username string, conn net.Conn) (net.Conn, error) {
+	r.mu.Lock()
+
+	sess := r.sessions[id]
+	if sess == nil {
+		r.mu.Unlock()
+		return nil, errors.New("unknown or expired relay")
+	}
+
+	side := -1
+	for i, p := range sess.peers {
+		if p == username && !sess.joined[i] {
+			side = i
+			break
+		}
+	}
+	if side < 0 {
+		r.mu.Unlock()
+		return nil, errors.Errorf("%s may not join the relay", username)
+	}
+	sess.joined[side] = true
+
+	if sess.first != nil {
+		delete(r.sessions, id)
+		close(sess.paired)
+		r.mu.Unlock()
+		return sess.first, nil
+	}
+
+	sess.first = conn
+	r.mu.Unlock()
+
+	timer := time.NewTimer(relay.JoinTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-sess.paired:
+		return nil, nil
+	case <-timer.C:
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-sess.paired:
+		return nil, nil
+	default:
+	}
+	if r.sessions[id] == sess {
+		delete(r.sessions, id)
+	}
+	return nil, errors.New("the other peer didn't join the relay in time")
+}
+
+// limiter is a token bucket shared by both directions of a relay.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter of rate bytes per second, or nil if rate isn't
+// positive.
+func newLimiter(rate int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	// a whole frame must fit in the bucket
+	burst := math.Max(float64(rate), 2+relay.MaxFrameSize)
+	return &limiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be sent.
+func (l *limiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
@@ -2,14 +2,19 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+// Repository is a key/value store whose records may expire.
+// A ttl of zero means that the record never expires.
 type Repository[T any] interface {
 	Ping(ctx context.Context) (pong string, err error)
 	Get(ctx context.Context, key string) (val T, err error)
-	Set(ctx context.Context, key string, val T) error
+	Set(ctx context.Context, key string, val T, ttl time.Duration) error
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
 	Exists(ctx context.Context, key string) (bool, error)
 	Keys(ctx context.Context) ([]string, error)
 	Values(ctx context.Context) ([]T, error)
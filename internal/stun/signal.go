@@ -0,0 +1,120 @@
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
+)
+
+const (
+	DefaultSignalWait = 8 * time.Second
+
+	maxQueuedSignals = 32
+)
+
+// hub queues signals for peers until they poll for them.
+type hub struct {
+	mu     sync.Mutex
+	queues map[string][]response.Signal
+	notify map[string]chan struct{}
+}
+
+func newHub() *hub {
+	return &hub{
+		queues: make(map[string][]response.Signal),
+		notify: make(map[string]chan struct{}),
+	}
+}
+
+func (h *hub) push(username string, sig response.Signal) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	q := append(h.queues[username], sig)
+	if len(q) > maxQueuedSignals {
+		q = q[len(q)-maxQueuedSignals:]
+	}
+	h.queues[username] = q
+
+	if ch := h.notify[username]; ch != nil {
+		close(ch)
+		delete(h.notify, username)
+	}
+}
+
+// wait returns the queued signals of username, waiting up to timeout for
+// one to arrive if there are none.
+func (h *hub) wait(ctx context.Context, username string, timeout time.Duration) []response.Signal {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		h.mu.Lock()
+		if q := h.queues[username]; len(q) > 0 {
+			delete(h.queues, username)
+			h.mu.Unlock()
+			return q
+		}
+		ch := h.notify[username]
+		if ch == nil {
+			ch = make(chan struct{})
+			h.notify[username] = ch
+		}
+		h.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func (h *hub) drop(username string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.queues, username)
+}
+
+// SignalHandler lets a registered peer long-poll for its signals.
+func (s *Stun) SignalHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			resp response.GetSignals
+			enc  = json.NewEncoder(w)
+		)
+
+		username := r.URL.Path[len("/signal/"):]
+		if username == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = "username is empty"
+			enc.Encode(resp)
+			return
+		}
+
+		if status, err := s.authorize(r, username); err != nil {
+			w.WriteHeader(status)
+			resp.Error = err.Error()
+			enc.Encode(resp)
+			return
+		}
+
+		resp.OK = true
+		resp.Signals = s.hub.wait(r.Context(), username, s.cfg.SignalWait)
+		w.WriteHeader(http.StatusOK)
+		if err := enc.Encode(resp); err != nil {
+			s.logger.Warnf("Error delivering %d signals to %s: %v\n", len(resp.Signals), username, err)
+		}
+	})
+}
@@ -1,43 +1,163 @@
 package stun
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/ArminGh02/golang-p2p-messenger/internal/identity"
+	"github.com/ArminGh02/golang-p2p-messenger/internal/mailbox"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/peer"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/request"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/response"
 	"github.com/ArminGh02/golang-p2p-messenger/internal/stun/repository"
 )
 
+const DefaultLeaseTTL = 30 * time.Second
+
+type Config struct {
+	// LeaseTTL is how long a registration lives without a heartbeat.
+	LeaseTTL time.Duration
+	// TrustedProxies are the proxies allowed to set X-Forwarded-For.
+	TrustedProxies []*net.IPNet
+	// SignalWait is how long a poll for signals is held open. It must be
+	// shorter than the write timeout of the HTTP server.
+	SignalWait time.Duration
+	// RelayAddr is the address relays are served on, empty if relaying is
+	// disabled.
+	RelayAddr string
+	// OwnershipTTL is how long a username stays bound to the key of its
+	// owner after its last registration or renewal. Zero means forever.
+	OwnershipTTL time.Duration
+	// RelayRate caps the bytes per second forwarded by a relay in both
+	// directions together. Zero means no cap.
+	RelayRate int
+	// Mailbox enables keeping messages for offline peers.
+	Mailbox bool
+	// MailboxRetention is how long messages are kept in mailboxes.
+	MailboxRetention time.Duration
+	// MailboxQuota caps the bytes of the messages kept for a peer, and
+	// MailboxMaxMessages their number.
+	MailboxQuota       int
+	MailboxMaxMessages int
+	// MaxMailSize is the largest message accepted in a mailbox.
+	MaxMailSize int
+}
+
 type Stun struct {
-	repo   repository.Repository[*peer.Peer]
-	logger *logrus.Logger // TODO: use interface
+	repo repository.Repository[*peer.Peer]
+	// keys are the public keys of the owners of usernames, which outlive
+	// registrations.
+	keys       repository.Repository[ed25519.PublicKey]
+	mailboxes  repository.Repository[*mailbox.Mailbox]
+	mailboxMu  sync.Mutex
+	logger     *logrus.Logger // TODO: use interface
+	cfg        Config
+	metrics    *metrics
+	hub        *hub
+	relays     *relays
+	challenges *challenges
 }
 
-func New(repo repository.Repository[*peer.Peer], logger *logrus.Logger) *Stun {
-	return &Stun{
-		repo:   repo,
-		logger: logger,
+func New(
+	repo repository.Repository[*peer.Peer],
+	keys repository.Repository[ed25519.PublicKey],
+	mailboxes repository.Repository[*mailbox.Mailbox],
+	logger *logrus.Logger,
+	cfg *Config,
+) *Stun {
+	s := &Stun{
+		repo:      repo,
+		keys:      keys,
+		mailboxes: mailboxes,
+		logger:    logger,
+		cfg:       *cfg,
+	}
+	if s.cfg.LeaseTTL <= 0 {
+		s.cfg.LeaseTTL = DefaultLeaseTTL
+	}
+	if s.cfg.SignalWait <= 0 {
+		s.cfg.SignalWait = DefaultSignalWait
+	}
+	if s.cfg.MailboxRetention <= 0 {
+		s.cfg.MailboxRetention = DefaultMailboxRetention
 	}
+	if s.cfg.MailboxQuota <= 0 {
+		s.cfg.MailboxQuota = DefaultMailboxQuota
+	}
+	if s.cfg.MailboxMaxMessages <= 0 {
+		s.cfg.MailboxMaxMessages = DefaultMailboxMaxMessages
+	}
+	if s.cfg.MaxMailSize <= 0 {
+		s.cfg.MaxMailSize = DefaultMaxMailSize
+	}
+	s.metrics = newMetrics(s)
+	s.hub = newHub()
+	s.relays = newRelays()
+	s.challenges = newChallenges()
+	return s
 }
 
-func (s *Stun) PeerHandler() http.Handler {
+// HealthHandler reports whether the process is alive.
+func (s *Stun) HealthHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// ReadyHandler reports whether the repository is reachable.
+func (s *Stun) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+
+		if _, err := s.repo.Ping(ctx); err != nil {
+			s.logger.Warnln("Readiness check failed:", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "repository unavailable: %v\n", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// MetricsHandler exposes the metrics of the server in the Prometheus format.
+func (s *Stun) MetricsHandler() http.Handler {
+	return s.metrics.handler()
+}
+
+func (s *Stun) PeerHandler() http.Handler {
+	return s.metrics.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
 			s.postPeer(w, r)
+		case http.MethodPut:
+			s.putPeer(w, r)
 		case http.MethodGet:
 			s.getPeer(w, r)
+		case http.MethodDelete:
+			s.deletePeer(w, r)
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
-	})
+	}))
 }
 
 func (s *Stun) postPeer(w http.ResponseWriter, r *http.Request) {
@@ -55,38 +175,283 @@ func (s *Stun) postPeer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usernameExists, err := s.repo.Exists(context.Background(), req.Username)
-	if err != nil {
+	if status, err := s.verify(req.Username, identity.ActionRegister, req.PublicKey, &req.Proof); err != nil {
+		s.metrics.registrations.WithLabelValues("forbidden").Inc()
+		w.WriteHeader(status)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	// the owner may replace its own registration, e.g. after a crash
+	old, err := s.repo.Get(context.Background(), req.Username)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		s.metrics.registrations.WithLabelValues("error").Inc()
 		w.WriteHeader(http.StatusInternalServerError)
 		resp.Error = fmt.Sprintf("error checking if username %q exists: %v", req.Username, err)
 		enc.Encode(resp)
 		return
 	}
 
-	if usernameExists {
+	if err == nil && !bytes.Equal(old.PublicKey, req.PublicKey) {
+		s.metrics.registrations.WithLabelValues("conflict").Inc()
 		w.WriteHeader(http.StatusConflict)
 		resp.Error = fmt.Sprintf("username %q already exists", req.Username)
 		enc.Encode(resp)
 		return
 	}
 
+	if status, err := s.claim(req.Username, req.PublicKey); err != nil {
+		s.metrics.registrations.WithLabelValues("forbidden").Inc()
+		w.WriteHeader(status)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		s.metrics.registrations.WithLabelValues("error").Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Error = fmt.Sprintf("error generating token: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
+	observed := s.observedIP(r)
+	if observed == nil {
+		s.metrics.registrations.WithLabelValues("error").Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = fmt.Sprintf("could not determine the address of %s", r.RemoteAddr)
+		enc.Encode(resp)
+		return
+	}
+
+	resp.ObservedIP = observed.String()
+	resp.PublicUDPAddr, err = publicUDPAddr(observed, &req)
+	if err == nil {
+		resp.PublicTCPAddr, err = publicAddr(observed, req.TCPAddr)
+	}
+	if err != nil {
+		s.metrics.registrations.WithLabelValues("error").Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
 	peer := &peer.Peer{
-		UDPAddr:  req.UDPAddr, // TODO: why not use address in http.Request.RemoteAddr?
-		TCPAddr:  req.TCPAddr,
-		Username: req.Username,
+		UDPAddr:       req.UDPAddr,
+		TCPAddr:       req.TCPAddr,
+		PublicUDPAddr: resp.PublicUDPAddr,
+		PublicTCPAddr: resp.PublicTCPAddr,
+		Username:      req.Username,
+		PublicKey:     req.PublicKey,
+		WireVersion:   req.WireVersion,
+		TokenHash:     hashToken(token),
 	}
-	if err := s.repo.Set(context.Background(), peer.Username, peer); err != nil {
+	if err := s.repo.Set(context.Background(), peer.Username, peer, s.cfg.LeaseTTL); err != nil {
+		s.metrics.registrations.WithLabelValues("error").Inc()
 		w.WriteHeader(http.StatusInternalServerError)
 		resp.Error = fmt.Sprintf("error adding peer: %v", err)
 		enc.Encode(resp)
 		return
 	}
 
+	s.metrics.registrations.WithLabelValues("ok").Inc()
+
+	resp.OK = true
+	resp.TTL = int64(s.cfg.LeaseTTL / time.Second)
+	resp.Token = token
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(resp)
+}
+
+// putPeer renews the lease of an existing registration.
+func (s *Stun) putPeer(w http.ResponseWriter, r *http.Request) {
+	var (
+		resp response.PutPeer
+		enc  = json.NewEncoder(w)
+	)
+
+	username := r.URL.Path[len("/peer/"):]
+	if username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = "username is empty"
+		enc.Encode(resp)
+		return
+	}
+
+	var req request.PutPeer
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = fmt.Sprintf("error decoding request: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
+	p, status, err := s.owner(username)
+	if err == nil {
+		status, err = s.verify(username, identity.ActionRenew, p.PublicKey, &req.Proof)
+	}
+	if err != nil {
+		w.WriteHeader(status)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	err = s.repo.Expire(context.Background(), username, s.cfg.LeaseTTL)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		resp.Error = fmt.Sprintf("there is no peer with username %s", username)
+		enc.Encode(resp)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Error = fmt.Sprintf("error renewing lease: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
+	if s.cfg.OwnershipTTL > 0 {
+		if err := s.keys.Set(context.Background(), username, p.PublicKey, s.cfg.OwnershipTTL); err != nil {
+			s.logger.Warnf("Error renewing ownership of %s: %v\n", username, err)
+		}
+	}
+
+	resp.OK = true
+	resp.TTL = int64(s.cfg.LeaseTTL / time.Second)
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(resp)
+}
+
+// deletePeer removes a registration on behalf of its owner.
+func (s *Stun) deletePeer(w http.ResponseWriter, r *http.Request) {
+	var (
+		resp response.DeletePeer
+		enc  = json.NewEncoder(w)
+	)
+
+	username := r.URL.Path[len("/peer/"):]
+	if username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = "username is empty"
+		enc.Encode(resp)
+		return
+	}
+
+	var req request.DeletePeer
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = fmt.Sprintf("error decoding request: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
+	p, status, err := s.owner(username)
+	if err == nil {
+		status, err = s.verify(username, identity.ActionDeregister, p.PublicKey, &req.Proof)
+	}
+	if err != nil {
+		w.WriteHeader(status)
+		resp.Error = err.Error()
+		enc.Encode(resp)
+		return
+	}
+
+	s.hub.drop(username)
+
+	err = s.repo.Delete(context.Background(), username)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		resp.Error = fmt.Sprintf("there is no peer with username %s", username)
+		enc.Encode(resp)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Error = fmt.Sprintf("error deleting peer: %v", err)
+		enc.Encode(resp)
+		return
+	}
+
 	resp.OK = true
 	w.WriteHeader(http.StatusOK)
 	enc.Encode(resp)
 }
 
+// owner returns the registration of username. On failure it returns the
+// status code to respond with.
+func (s *Stun) owner(username string) (p *peer.Peer, status int, err error) {
+	p, err = s.repo.Get(context.Background(), username)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, http.StatusNotFound, errors.Errorf("there is no peer with username %s", username)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error getting peer")
+	}
+	return p, http.StatusOK, nil
+}
+
+// claim binds username to key unless it's bound to another key already. On
+// failure it returns the status code to respond with.
+func (s *Stun) claim(username string, key ed25519.PublicKey) (status int, err error) {
+	owner, err := s.keys.Get(context.Background(), username)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return http.StatusInternalServerError, errors.Wrap(err, "error getting owner of username")
+	}
+	if err == nil && !bytes.Equal(owner, key) {
+		return http.StatusForbidden, errors.Errorf("username %s is owned by another key", username)
+	}
+
+	if err := s.keys.Set(context.Background(), username, key, s.cfg.OwnershipTTL); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "error claiming username")
+	}
+	return http.StatusOK, nil
+}
+
+// authorize checks that r carries the token of the registration of username.
+// On failure it returns the status code to respond with.
+func (s *Stun) authorize(r *http.Request, username string) (status int, err error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return s.checkToken(username, token)
+}
+
+// checkToken checks that token is the one of the registration of username.
+func (s *Stun) checkToken(username, token string) (status int, err error) {
+	if token == "" {
+		return http.StatusUnauthorized, errors.New("missing registration token")
+	}
+
+	p, err := s.repo.Get(context.Background(), username)
+	if errors.Is(err, repository.ErrNotFound) {
+		return http.StatusNotFound, errors.Errorf("there is no peer with username %s", username)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "error getting peer")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(p.TokenHash)) != 1 {
+		return http.StatusForbidden, errors.Errorf("not the owner of username %s", username)
+	}
+	return http.StatusOK, nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func (s *Stun) getPeer(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Path[len("/peer/"):]
 
@@ -113,7 +478,10 @@ func (s *Stun) listPeers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp.OK = true
-	resp.Peers = peers
+	resp.Peers = make([]*peer.Peer, len(peers))
+	for i, p := range peers {
+		resp.Peers[i] = p.Public()
+	}
 	w.WriteHeader(http.StatusOK)
 	enc.Encode(resp)
 }
@@ -126,6 +494,7 @@ func (s *Stun) peerByUsername(w http.ResponseWriter, username string) {
 
 	p, err := s.repo.Get(context.Background(), username)
 	if errors.Is(err, repository.ErrNotFound) {
+		s.metrics.lookups.WithLabelValues("miss").Inc()
 		w.WriteHeader(http.StatusNotFound)
 		resp.Error = fmt.Sprintf("there is no peer with username %s", username)
 		enc.Encode(resp)
@@ -138,8 +507,10 @@ func (s *Stun) peerByUsername(w http.ResponseWriter, username string) {
 		return
 	}
 
+	s.metrics.lookups.WithLabelValues("hit").Inc()
+
 	resp.OK = true
-	resp.Peers = []*peer.Peer{p}
+	resp.Peers = []*peer.Peer{p.Public()}
 	w.WriteHeader(http.StatusOK)
 	enc.Encode(resp)
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 
@@ -14,7 +16,7 @@ func main() {
 	logger := logrus.New()
 	logger.Out = os.Stdout
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	exitCmd := exit.NewCommand(cancel)
 	if err := root.NewCommand(exitCmd).ExecuteContext(ctx); err != nil {
 		logger.Fatalln("Error executing command:", "error", err)